@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// blobPrefix denotes a response body file.  Bodies are stored once per distinct
+// content, named by the SHA-256 of that content, so that many urls serving the
+// same bytes (CDN mirrors, cache-busting query strings) share one copy.
+// response body file name: -b-l-o-b-<hex encoded SHA-256 of the body>
+// Caches that encrypt their files key the name instead; see blobName.
+var blobPrefix = "-b-l-o-b-"
+
+// tmpPrefix denotes a file that is still being written.
+var tmpPrefix = "-t-m-p-"
+
+// blob is a response body shared by every resource with identical content.
+// refs counts those resources; once it drops to zero the blob is deleted.
+// file holds the body as stored, compressed as given by encoding, or is nil while
+// the body has only been found on disk and not read yet; see fetchBlob.
+// memoryOnly is set if the body couldn't be saved to disk.
+type blob struct {
+	file       *bytes.Buffer
+	encoding   string
+	refs       int
+	footprint  footprint
+	memoryOnly bool
+}
+
+// ToBlobDiskString returns the disk filename under which a response body
+// with contents body is stored.
+func ToBlobDiskString(body []byte) (res string) {
+	return blobDiskString(sha256.Sum256(body))
+}
+
+// blobDiskString returns the disk filename of the blob with SHA-256 sum.
+func blobDiskString(sum [sha256.Size]byte) (res string) {
+	return blobPrefix + hex.EncodeToString(sum[:])
+}
+
+// blobName returns the name of the blob file for the body with SHA-256 sum:
+// blobDiskString, or, if the cache encrypts its files, a name keyed with the
+// current key, which says nothing about the body.
+func (cache *memoryCache) blobName(sum [sha256.Size]byte) string {
+	if cache.keyring == nil {
+		return blobDiskString(sum)
+	}
+	return cache.keyring.fileName(0, blobPrefix, string(sum[:]))
+}
+
+// blobNames returns every name the blob file for the body with SHA-256 sum may
+// be found under: blobName first, then, if the cache encrypts its files, the
+// names keyed with its older keys, and the name it had before it was encrypted.
+func (cache *memoryCache) blobNames(sum [sha256.Size]byte) (names []string) {
+	names = append(names, cache.blobName(sum))
+	if cache.keyring == nil {
+		return names
+	}
+	for key := 1; key < len(cache.keyring.names); key++ {
+		names = append(names, cache.keyring.fileName(key, blobPrefix, string(sum[:])))
+	}
+	return append(names, blobDiskString(sum))
+}
+
+// retainBlob adds a reference to the blob with SHA-256 sum and returns it.
+// If there is no such blob yet, fi, stored with encoding, becomes that blob: it is counted
+// against the size of the cache as fiSize, and a goroutine is dispatched to save it to disk.
+func (cache *memoryCache) retainBlob(sum [sha256.Size]byte, fi *bytes.Buffer, encoding string, fiSize footprint) (b *blob) {
+	if b, ok := cache.blobs[sum]; ok {
+		b.refs++
+		return b
+	}
+
+	b = &blob{file: fi, encoding: encoding, refs: 1, footprint: fiSize}
+	cache.blobs[sum] = b
+	cache.used = cache.used.add(fiSize)
+
+	// Dispatch a goroutine to save to disk.  If that fails, everything
+	// sharing this body only lives in memory.
+	cache.persistAsync(cache.blobName(sum), fi.Bytes(), func() {
+		if cache.blobs[sum] == b {
+			b.memoryOnly = true
+		}
+	})
+	return b
+}
+
+// fetchBlob returns the blob with SHA-256 sum, reading its body from disk first
+// if it hasn't been yet.  A body that fails its checksum is quarantined.
+// The cache must be locked.  It is unlocked while the body is read, so that
+// a slow disk doesn't hold up everything else; anything the caller looked up
+// beforehand may have changed by the time fetchBlob returns.
+func (cache *memoryCache) fetchBlob(sum [sha256.Size]byte) (b *blob, err error) {
+	b, ok := cache.blobs[sum]
+	if !ok {
+		return nil, ErrResourceNotInCache
+	}
+	if b.file != nil {
+		return b, nil
+	}
+
+	encoding := b.encoding
+	cache.Unlock()
+	stored, name, stale, err := cache.loadBlob(sum, encoding)
+	cache.Lock()
+
+	// Meanwhile the blob may have been released, or read by someone else.
+	if b, ok = cache.blobs[sum]; !ok || b.encoding != encoding {
+		return nil, ErrResourceNotInCache
+	}
+	if b.file != nil {
+		return b, nil
+	}
+	switch err {
+	case nil:
+	case ErrAuthenticationFailed:
+		cache.rejected++
+		return nil, err
+	case ErrChecksumMismatch:
+		cache.corrupt++
+		cache.quarantine(name)
+		return nil, err
+	default:
+		return nil, err
+	}
+	b.file = bytes.NewBuffer(stored)
+
+	// Re-seal it under the current key and name if it wasn't already.
+	if stale {
+		cache.persistAsync(cache.blobName(sum), stored, nil)
+	}
+	return b, nil
+}
+
+// releaseBlob drops a reference to the blob with SHA-256 sum.  Once nothing
+// references it, it is deleted from memory, and a goroutine is dispatched
+// to delete it from disk.
+func (cache *memoryCache) releaseBlob(sum [sha256.Size]byte) {
+	b, ok := cache.blobs[sum]
+	if !ok {
+		return
+	}
+	if b.refs--; b.refs > 0 {
+		return
+	}
+
+	cache.used = cache.used.sub(b.footprint)
+	delete(cache.blobs, sum)
+	cache.deleteAsync(cache.blobName(sum))
+}
+
+// persist writes contents to the file name in the cache's store,
+// sealed first if the cache encrypts its files.
+func (cache *memoryCache) persist(name string, contents []byte) (err error) {
+	return cache.persistWith(cache.store.Put, name, contents)
+}
+
+// persistWith is like persist, but writes to the store with put.
+func (cache *memoryCache) persistWith(put func(name string, contents []byte) error, name string, contents []byte) (err error) {
+	if cache.keyring != nil {
+		if contents, err = cache.keyring.seal(name, contents); err != nil {
+			return err
+		}
+	}
+	return put(name, contents)
+}
+
+// rename writes contents, read from the file from, to the file to, and waits
+// for it to be written.  If that fails, from is kept (see unloaded), so that
+// collect leaves it for next time.  It is only for startup.
+func (cache *memoryCache) rename(from, to string, contents []byte, skipped *unloaded) {
+	if cache.queue.do(writeJob{name: to, contents: contents}) != nil && from != to {
+		skipped.keep(from)
+	}
+}
+
+// load reads the file name from the cache's store, opening it if the cache encrypts
+// its files.  stale reports whether it was sealed under an old key.
+func (cache *memoryCache) load(name string) (contents []byte, stale bool, err error) {
+	contents, err = cache.store.Get(name)
+	if err != nil || cache.keyring == nil {
+		return contents, false, err
+	}
+	return cache.keyring.open(name, contents)
+}
@@ -2,16 +2,14 @@ package cache
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -43,6 +41,8 @@ var (
 // headerPrefix denotes a header file from a response body file.
 // response body file name:  justin.jpg
 // has header file name: -h-e-a-d-e-r-justin.jpg
+// Response bodies are now stored in blob files (see blobPrefix), and the header
+// file records which blob holds the body.
 var headerPrefix = "-h-e-a-d-e-r-"
 
 // Cache is a generic cache interface type.
@@ -58,12 +58,106 @@ type Cache interface {
 	// the http.Header previously saved.
 	GetWithHeaders(url url.URL) (*bytes.Buffer, http.Header, error)
 
+	// GetStale is like GetWithHeaders, but also retrieves a resource that has
+	// expired, if it is still within the cache's StaleGrace, along with how long
+	// ago it expired (0 if it hasn't).  Retrieving a stale resource doesn't count
+	// as using it.
+	GetStale(url url.URL) (*bytes.Buffer, http.Header, time.Duration, error)
+
+	// GetResponse is like GetStale, but also retrieves the HTTP status the
+	// resource was saved with (see SaveOptions.Status), so that it can be
+	// served as it was received.
+	GetResponse(url url.URL) (*bytes.Buffer, http.Header, int, time.Duration, error)
+
 	// SaveWithHeaders saves a resource to the cache along with
 	// http.Header h for later use.
 	SaveWithHeaders(url url.URL, fi *bytes.Buffer, h http.Header) error
 
-	// Size returns the current size of the cache (not the max size).
+	// SaveWithTTL is like SaveWithHeaders, but the resource expires ttl after
+	// it is saved instead of after the cache's expiration goes by unused.
+	// A ttl of NoExpiry keeps the resource until it is evicted.
+	SaveWithTTL(url url.URL, fi *bytes.Buffer, h http.Header, ttl time.Duration) error
+
+	// SaveWithOptions saves a resource to the cache along with everything in opts.
+	SaveWithOptions(url url.URL, fi *bytes.Buffer, opts SaveOptions) error
+
+	// SavePart saves data as the bytes starting at offset of the body of the
+	// resource at url, size bytes in all, so that large resources can be cached a
+	// range at a time.  Parts are merged with whatever of the resource is cached
+	// already, unless their strong validators in opts.Header differ (see
+	// StrongValidator), in which case what was cached is dropped; parts without
+	// one aren't cached at all.  All of what is cached of the resource expires as
+	// opts.TTL says, counting from the last part saved.  Once all of the body is
+	// cached, the resource is saved whole with opts, as by SaveWithOptions.
+	SavePart(url url.URL, offset int64, data []byte, size int64, opts SaveOptions) error
+
+	// GetPart retrieves the range r of the body of the resource at url, cached
+	// whole or in parts, along with its headers and the size of its whole body.
+	// If some of r isn't cached, the data is nil and missing lists the ranges that
+	// aren't, so that only those need fetching.  An empty r just reports the
+	// headers and size.
+	GetPart(url url.URL, r Range) (data []byte, h http.Header, size int64, missing []Range, err error)
+
+	// Size returns the current size of the cache (not the max size), as the
+	// sum of its distinct response body sizes only: logical bytes, whatever
+	// Config.Dimension the max size is enforced against.  See Stats for the
+	// other measures.
 	Size() int
+
+	// Stats reports how much space the cache is using, measured as
+	// logical body bytes, memory bytes and disk bytes.
+	Stats() Stats
+
+	// Pin marks the resource at url as one that must always be served from
+	// the cache.  Pinned resources count against the cache size, but are never
+	// evicted to make room for others and never expire.  A url can be pinned
+	// before it has been saved.
+	Pin(url url.URL) error
+
+	// Unpin reverses Pin, making the resource at url evictable again.
+	Unpin(url url.URL) error
+
+	// RefreshDone lets the resource at url be passed to Config.OnRefreshAhead
+	// again, once fetching it again is over.  If that worked, saving it did this
+	// already; if it failed, the resource would otherwise never be refreshed ahead.
+	RefreshDone(url url.URL)
+
+	// Collect removes every file from disk that the cache no longer refers to,
+	// such as the leftovers of failed saves and deletes, and returns how many
+	// bytes that reclaimed.  The cache also does this when it starts up.
+	Collect() (int64, error)
+
+	// Ready returns a channel that is closed once the cache is warm: straight
+	// away, unless it was configured to warm up in the background.
+	Ready() <-chan struct{}
+
+	// Flush waits until everything saved or deleted so far has been written to
+	// disk, and returns the first error writing to disk since the last Flush.
+	Flush() error
+
+	// Export writes a snapshot of every resource in the cache to w, as a tar
+	// archive of bodies and metadata.  The cache carries on serving meanwhile.
+	Export(w io.Writer) error
+
+	// Import saves every resource in a snapshot written by Export into the cache,
+	// replacing any already at the same url.  Resources that have expired since,
+	// or don't fit, are left out.
+	Import(r io.Reader) error
+
+	// ExportWARC writes every resource in the cache to w as a WARC 1.1 file,
+	// with a request and a response record per resource.
+	ExportWARC(w io.Writer) error
+
+	// ImportWARC saves every 200 OK response in a WARC file into the cache,
+	// replacing any already at the same url.  Responses that don't fit are left out.
+	ImportWARC(r io.Reader) error
+
+	// Close stops the cache's background work, waits until everything saved or
+	// deleted so far has been written to disk, and unlocks its mount paths, so
+	// that another cache can open them.  It returns the first error doing so.
+	// A Config.Store is left open, for whoever opened it to close.  Nothing is
+	// written to disk once the cache is closed.
+	Close() error
 }
 
 // lru is an implementation of an LRU cache that satisfies interface Cache.
@@ -77,14 +171,49 @@ type lfu struct {
 }
 
 // memoryCache is an in memory cache with basic utility functions.
-// Files are purged after expiration seconds.  The cache has maxSize maxSize
-// and current size size.  It is internally modelled by a hashmap.
+// Files expire after expiration seconds, and are purged staleGrace after that.
+// Files used within refresh of their expiry are passed to onRefresh.  The cache has maxSize maxSize
+// and current usage used, and maxSize is enforced against used along dimension.
+// It is internally modelled by a hashmap, with response bodies kept in a second
+// hashmap keyed by their SHA-256 so that identical bodies are only stored once.
+// Urls in pinned are never evicted or purged, whether or not they are in memory yet.
+// Everything in memory is persisted to store through queue, from which it is
+// loaded on startup.  The cache holds locks on its mount paths until it is
+// closed, and done is closed then, to stop its background goroutines.
 type memoryCache struct {
-	maxSize    int64 // Use int64 because os.File stores its size metric as int64
-	size       int64 // Same as above
-	expiration time.Duration
-	memory     map[url.URL]*resource
-	mountPath  string
+	maxSize     int64 // Use int64 because os.File stores its size metric as int64
+	used        footprint
+	dimension   Dimension
+	expiration  time.Duration
+	staleGrace  time.Duration
+	memory      map[url.URL]*resource
+	blobs       map[[sha256.Size]byte]*blob
+	pinned      map[url.URL]bool
+	partials    map[url.URL]*partial
+	compression Compression
+	keyring     *Keyring
+	rejected    int
+	corrupt     int
+	scrubbed    int
+	collected   int
+	reclaimed   int64
+	ioErrors    int
+	onIOError   func(err error)
+	refresh     time.Duration
+	onRefresh   func(url url.URL, h http.Header)
+	minFree     int64
+	freeDisk    int64
+	diskBudget  int64
+	nextToGo    func(cache *memoryCache) (url.URL, bool)
+	mountPaths  []string
+	stripes     *StripedStore
+	store       Store
+	queue       *writeQueue
+	readOnly    bool
+	ready       chan struct{}
+	locks       []*mountLock
+	done        chan struct{}
+	closed      bool
 	sync.Mutex
 }
 
@@ -92,12 +221,26 @@ type memoryCache struct {
 // the time at which this resource was entered into the cache.
 // It also contains an access count, which is the number of times
 // this resource has been accessed via the cache.  Both of these metrics
-// are useful for implemented LRU / LFU replacement policies
+// are useful for implemented LRU / LFU replacement policies.
+// Its body is the blob with SHA-256 sum, shared with every other resource with the same body.
+// expires and noExpiry override the cache's expiration for this resource,
+// encodedHeaders holds the header file as it is written to disk,
+// and footprint is the space this resource takes up in the cache, not counting its body.
+// memoryOnly is set if the header file couldn't be saved to disk, and
+// refreshing once it has been passed to onRefresh.
 type resource struct {
-	file            *bytes.Buffer
+	sum             [sha256.Size]byte
 	saveTime        time.Time
 	accessCount     int
 	originalHeaders http.Header
+	expires         time.Time
+	noExpiry        bool
+	status          int
+	fetched         time.Time
+	encodedHeaders  []byte
+	footprint       footprint
+	memoryOnly      bool
+	refreshing      bool
 }
 
 // fileSize returns the size, in bytes, of fi.
@@ -106,13 +249,33 @@ func fileSize(fi *bytes.Buffer) (size int64, err error) {
 	return int64(fi.Len()), nil
 }
 
-// purgeExpired purges expired resources from the cache.
-// Resources in memory are deleted immediately, and a goroutine
-// is dispatched to delete the item from disk.
+// staleFor returns how long ago r expired, or 0 if it hasn't.  Unless r has an
+// explicit expiry, it expires once it has gone unused for idle.
+func (r *resource) staleFor(idle time.Duration) (stale time.Duration) {
+	switch {
+	case r.noExpiry:
+		return 0
+	case !r.expires.IsZero():
+		stale = time.Since(r.expires)
+	default:
+		stale = time.Since(r.saveTime) - idle
+	}
+	if stale < 0 {
+		return 0
+	}
+	return stale
+}
+
+// purgeExpired purges resources from the cache that expired more than the
+// stale grace period ago.  Resources in memory are deleted immediately, and a
+// goroutine is dispatched to delete the item from disk.
 func (cache *memoryCache) purgeExpired() {
-	// Go through all cache items.
+	// Go through all cache items.  Pinned items never expire.
 	for url, resource := range cache.memory {
-		if time.Since(resource.saveTime) > cache.expiration {
+		if cache.pinned[url] {
+			continue
+		}
+		if cache.staleGrace != NoExpiry && resource.staleFor(cache.expiration) > cache.staleGrace {
 			// This file has expired.  Delete this resource.
 			if err := cache.deleteResource(url); err != nil {
 				// If there was an error deleting this resource,
@@ -121,6 +284,7 @@ func (cache *memoryCache) purgeExpired() {
 			}
 		}
 	}
+	cache.purgeExpiredPartials()
 	return
 }
 
@@ -155,100 +319,134 @@ func FromHeaderDiskString(ds string) (resURL url.URL) {
 	return *url
 }
 
+// headerName returns the name of the header file for u: ToHeaderDiskString,
+// or, if the cache encrypts its files, a name keyed with the current key,
+// which says nothing about u.
+func (cache *memoryCache) headerName(u url.URL) string {
+	if cache.keyring == nil {
+		return ToHeaderDiskString(u)
+	}
+	return cache.keyring.fileName(0, headerPrefix, u.String())
+}
+
+// headerURL returns the url of the resource whose header file, named name, holds meta.
+func headerURL(name string, meta metadata) (u url.URL, err error) {
+	if meta.URL == "" {
+		return FromHeaderDiskString(name), nil
+	}
+	parsed, err := url.Parse(meta.URL)
+	if err != nil {
+		return u, err
+	}
+	return *parsed, nil
+}
+
 // saveResource saves fi to cache. Files are saved immediately to the in-memory cache,
 // and a goroutine is dispatched to save the file to disk.  If fi won't fit in the cache,
 // resources are removed from cache until fi can be saved.  The provided function argument
-// nextToGo determines which resource is the next item to be removed from the cache.
-func (cache *memoryCache) saveResource(u url.URL, fi *bytes.Buffer, nextToGo func(cache *memoryCache) url.URL, h http.Header) (err error) {
+// nextToGo determines which resource is the next item to be removed from the cache,
+// and reports false if there is nothing left that may be removed.  Headers and expiry
+// are taken from opts.  Read-only caches refuse to save anything.
+func (cache *memoryCache) saveResource(u url.URL, fi *bytes.Buffer, nextToGo func(cache *memoryCache) (url.URL, bool), opts SaveOptions) (err error) {
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+
+	// Get the size of fi, and encode its metadata so that we know how much space
+	// the header file takes up too.  Bodies are stored by their SHA-256, so work that out first.
+	bodySize, err := fileSize(fi)
+	if err != nil {
+		return err
+	}
+	meta := newMetadata(opts)
+	meta.Sum, meta.URL = sha256.Sum256(fi.Bytes()), u.String()
+
+	// If the body is already stored, it is stored the way it is.  If not,
+	// compress it now if it is worth it.
+	stored := fi
+	if b, ok := cache.blobs[meta.Sum]; ok {
+		stored, meta.Encoding = nil, b.encoding
+	} else if compressible(opts.Header) {
+		compressed, encoding, err := compress(cache.compression, fi.Bytes())
+		if err != nil {
+			return err
+		}
+		stored, meta.Encoding = bytes.NewBuffer(compressed), encoding
+	}
+	meta.Size = bodySize
 
-	// save tries to save fi of size fiSize to cache.  If it succeeds, return true,
-	// if not, return false.
-	save := func(url url.URL, fi *bytes.Buffer, fiSize int64, cache *memoryCache) (fit bool) {
+	encodedHeaders, err := encodeMetadata(meta)
+	if err != nil {
+		return err
+	}
+	size := measureEntry(u, int64(len(encodedHeaders)))
+	var blobSize footprint
+	if stored != nil {
+		blobSize = measureBody(bodySize, int64(stored.Len()))
+	}
+
+	// save tries to save fi, taking up space fiSize besides its body, to cache.
+	// If it succeeds, return true, if not, return false.
+	save := func(url url.URL, fi *bytes.Buffer, fiSize footprint, cache *memoryCache) (fit bool) {
 		// Make sure fi will fit in the cache.  Calculate the amount of space we need.
-		var needSize int64
-		if file, ok := cache.memory[url]; ok {
+		// We need room for the size of fi + the size of everything in the cache,
+		// but if some other resource has the same body, fi's body takes up no extra room.
+		needSize := cache.used.add(fiSize)
+		if _, ok := cache.blobs[meta.Sum]; !ok {
+			needSize = needSize.add(blobSize)
+		}
+		old, ok := cache.memory[url]
+		if ok {
 			// This url is already in the cache. The file size however,
 			// could have changed so we should re-save and recalculate sizes.
-			alreadyInMemSize, err := fileSize(file.file)
-			if err != nil {
-				return false
-			}
-
-			// We need room for the size of fi + the size of everything in the cache - the size of the duplicate
-			// resource to be deleted.
-			needSize = fiSize + cache.size - alreadyInMemSize
-		} else {
-			// This url is not in the cache.
-			// We need room for the size of fi + the size of everything in the cache.
-			needSize = fiSize + cache.size
-		}
-
-		// If it fits, save it and return.
-		if needSize <= cache.maxSize {
-			cache.memory[url] = &resource{
-				file:            fi,
-				saveTime:        time.Now(),
-				originalHeaders: h,
+			// Take away the size of the duplicate resource to be deleted,
+			// and its body too if nothing else shares it.
+			needSize = needSize.sub(old.footprint)
+			if b := cache.blobs[old.sum]; old.sum != meta.Sum && b.refs == 1 {
+				needSize = needSize.sub(b.footprint)
 			}
-			cache.size = needSize
-
-			// Dispatch a goroutine to save to disk.
-			go func() {
-				// Create the file.
-				savePath := filepath.Join(cache.mountPath, ToDiskString(url))
-				toSave, err := os.Create(savePath)
-				if err != nil {
-					return
-				}
-				defer toSave.Close()
-
-				// Copy contents from our resource to a file.
-				// We dont wan't to drain the in-memory buffer, so make a copy
-				// and copy that over.
-				newBuf := bytes.NewBuffer(fi.Bytes())
-				if _, err = io.Copy(toSave, newBuf); err != nil {
-					return
-				}
-
-				// Flush file contents to disk.
-				if err = toSave.Sync(); err != nil {
-					return
-				}
-			}()
-
-			// Also save the headers to disk.
-			// Pass in a copy of h, just in case.
-			go func(h http.Header) {
-				// Create the header file.
-				headerSavePath := filepath.Join(cache.mountPath, ToHeaderDiskString(url))
-				toSave, err := os.Create(headerSavePath)
-				if err != nil {
-					return
-				}
-				defer toSave.Close()
-
-				// Encode the header into the file.
-				enc := gob.NewEncoder(toSave)
-				if err = enc.Encode(h); err != nil {
-					return
-				}
-
-				// Flush file contents to disk.
-				if err = toSave.Sync(); err != nil {
-					return
-				}
-			}(h)
+		}
+		// Whatever parts of it are cached are superseded, once it's saved.
+		if p, ok := cache.partials[url]; ok {
+			needSize = needSize.sub(p.total())
+		}
 
-			return true
+		// If it doesn't fit, give up.
+		if !cache.fits(needSize) {
+			return false
 		}
-		// It didn't fit.
-		return false
-	}
 
-	// Get the size of fi.
-	size, err := fileSize(fi)
-	if err != nil {
-		return err
+		// It fits, save it and return.  Take a reference to fi's body before
+		// dropping the duplicate's, in case they are one and the same.
+		cache.retainBlob(meta.Sum, stored, meta.Encoding, blobSize)
+		if ok {
+			cache.used = cache.used.sub(old.footprint)
+			cache.releaseBlob(old.sum)
+		}
+		res := &resource{
+			sum:             meta.Sum,
+			saveTime:        time.Now(),
+			originalHeaders: meta.Header,
+			expires:         meta.Expires,
+			noExpiry:        meta.NoExpiry,
+			status:          meta.Status,
+			fetched:         meta.Fetched,
+			encodedHeaders:  encodedHeaders,
+			footprint:       fiSize,
+		}
+		cache.memory[url] = res
+		cache.used = cache.used.add(fiSize)
+		cache.dropPartial(url)
+
+		// Also save the headers and expiry to disk.  They were gob-encoded up front
+		// so that they could be counted against the cache size.  If that fails,
+		// this resource only lives in memory.
+		cache.persistAsync(cache.headerName(url), encodedHeaders, func() {
+			if cache.memory[url] == res {
+				res.memoryOnly = true
+			}
+		})
+		return true
 	}
 
 	// Before doing anything, try and see if fi fits in the cache.
@@ -262,7 +460,16 @@ func (cache *memoryCache) saveResource(u url.URL, fi *bytes.Buffer, nextToGo fun
 	// Start removing resources, one by one.  Try and save fi until it fits.
 	for !fits {
 		// It didn't fit, so get the next resource to remove and remove it.
-		toRemove := nextToGo(cache)
+		// Partly cached resources go before any whole one.  If there is nothing
+		// left to remove, fi is bigger than the whole cache (less whatever is pinned).
+		if cache.dropOldestPartial(u) {
+			fits = save(u, fi, size, cache)
+			continue
+		}
+		toRemove, ok := nextToGo(cache)
+		if !ok {
+			return ErrCacheSizeExceeded
+		}
 		if err := cache.deleteResource(toRemove); err != nil {
 			// There was an issue deleting this resource, continue to the next.
 			continue
@@ -277,29 +484,14 @@ func (cache *memoryCache) saveResource(u url.URL, fi *bytes.Buffer, nextToGo fun
 func (cache *memoryCache) deleteResource(url url.URL) (err error) {
 	if resource, ok := cache.memory[url]; ok {
 		// The resource exists, we can delete it.
-		// Get its size, subtract that value from the total size,
-		// and delete is from memory.  Also dispatch a goroutine to delete from disk.
-		size, err := fileSize(resource.file)
-		if err != nil {
-			return err
-		}
-		cache.size -= size
+		// Subtract its footprint from the total size,
+		// and delete is from memory.  Its body goes too, unless it is shared.
+		cache.used = cache.used.sub(resource.footprint)
 		delete(cache.memory, url)
+		cache.releaseBlob(resource.sum)
 
-		// Dispatch goroutine to delete from disk.
-		go func() {
-			// Delete the response body file.
-			deletePath := filepath.Join(cache.mountPath, ToDiskString(url))
-			if err := os.Remove(deletePath); err != nil {
-				return
-			}
-
-			// And also delete the header gob-encoded file.
-			headerDeletePath := filepath.Join(cache.mountPath, ToHeaderDiskString(url))
-			if err := os.Remove(headerDeletePath); err != nil {
-				return
-			}
-		}()
+		// Dispatch goroutine to delete the header gob-encoded file from disk.
+		cache.deleteAsync(cache.headerName(url))
 
 		return nil
 	}
@@ -309,80 +501,358 @@ func (cache *memoryCache) deleteResource(url url.URL) (err error) {
 
 // getResource retrieves the file saved in the cache by url.
 // Everytime a resource is retrieved, its accessCount increments by 1.
-// If the resource specified by url does not exist in the cache, an appropriate error
-// is returned.
+// If the resource specified by url does not exist in the cache, or has expired,
+// an appropriate error is returned.
 func (cache *memoryCache) getResource(url url.URL) (fi *bytes.Buffer, h http.Header, err error) {
-	if resource, ok := cache.memory[url]; ok {
-		// The resource is here; increment its accessCount and return it.
-		// Also, set its saveTime to time.Now().
+	fi, h, _, _, err = cache.getStale(url, false)
+	return fi, h, err
+}
+
+// getStale is getResource, but if allowStale is set, a resource that has expired
+// but hasn't been purged yet is retrieved too, and stale is how long ago it expired.
+// status is the HTTP status it was saved with.
+// Stale resources are left as they are, so that using them doesn't revive them.
+// Compressed files are decompressed into a new buffer.  A body still on disk is
+// loaded first; if that fails, the resource is dropped.
+func (cache *memoryCache) getStale(url url.URL, allowStale bool) (fi *bytes.Buffer, h http.Header, status int, stale time.Duration, err error) {
+	resource, ok := cache.memory[url]
+	if !ok {
+		// Resource was not found, error.
+		return nil, nil, 0, 0, ErrResourceNotInCache
+	}
+	if !cache.pinned[url] {
+		stale = resource.staleFor(cache.expiration)
+	}
+	if stale > 0 && !allowStale {
+		return nil, nil, 0, 0, ErrResourceNotInCache
+	}
+	b, err := cache.fetchBlob(resource.sum)
+	if cache.memory[url] != resource {
+		// It was replaced or deleted while its body was read; start over.
+		return cache.getStale(url, allowStale)
+	}
+	if err != nil {
+		cache.deleteResource(url)
+		return nil, nil, 0, 0, ErrResourceNotInCache
+	}
+
+	// The resource is here; increment its accessCount and return it.
+	// Also, set its saveTime to time.Now().
+	if stale == 0 {
 		resource.accessCount++
 		resource.saveTime = time.Now()
-		return resource.file, resource.originalHeaders, nil
+		cache.checkRefresh(url, resource)
+	}
+
+	// Header files written before statuses were recorded are all 200 OK.
+	status = resource.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if b.encoding == encodingIdentity {
+		return b.file, resource.originalHeaders, status, stale, nil
+	}
+	body, err := decompress(b.encoding, b.file.Bytes())
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	return bytes.NewBuffer(body), resource.originalHeaders, status, stale, nil
+}
+
+// checkRefresh passes url to onRefresh, from its own goroutine, if its
+// resource expires within refresh and hasn't been passed already.  Only
+// resources with an explicit expiry can be refreshed ahead; the rest don't
+// expire while they're being used.
+func (cache *memoryCache) checkRefresh(url url.URL, resource *resource) {
+	if cache.onRefresh == nil || resource.refreshing || resource.noExpiry || resource.expires.IsZero() || cache.pinned[url] {
+		return
+	}
+	if time.Until(resource.expires) < cache.refresh {
+		resource.refreshing = true
+		go cache.onRefresh(url, resource.originalHeaders)
 	}
-	// Resource was not found, error.
-	return nil, nil, ErrResourceNotInCache
 }
 
 // getLFU finds the LFU used item in cache, and returns its url.
-func getLFU(cache *memoryCache) (lfuURL url.URL) {
+// Pinned items are never chosen; found is false if every item is pinned.
+func getLFU(cache *memoryCache) (lfuURL url.URL, found bool) {
 	var lfu int
-	// Initialize our lfu to the first item of the map.
-	for url, resource := range cache.memory {
-		lfu = resource.accessCount
-		lfuURL = url
-		break
-	}
 
 	// Find the lfu resource, and return that url.
 	for url, resource := range cache.memory {
-		if resource.accessCount < lfu {
+		if cache.pinned[url] {
+			continue
+		}
+		if !found || resource.accessCount < lfu {
 			lfu = resource.accessCount
 			lfuURL = url
+			found = true
 		}
 	}
-	return lfuURL
+	return lfuURL, found
 }
 
 // getLRU finds the LRU item in cache, and returns its url.
-func getLRU(cache *memoryCache) (lruURL url.URL) {
+// Pinned items are never chosen; found is false if every item is pinned.
+func getLRU(cache *memoryCache) (lruURL url.URL, found bool) {
 	var lruTime time.Time
-	// Initialize our lruTime to the first item of the map.
-	for url, resource := range cache.memory {
-		lruTime = resource.saveTime
-		lruURL = url
-		break
-	}
 
 	// Find the lru resource, and return that url.
 	for url, resource := range cache.memory {
-		if resource.saveTime.Before(lruTime) {
+		if cache.pinned[url] {
+			continue
+		}
+		if !found || resource.saveTime.Before(lruTime) {
 			lruTime = resource.saveTime
 			lruURL = url
+			found = true
 		}
 	}
-	return lruURL
+	return lruURL, found
+}
+
+// pin marks url as pinned.
+func (cache *memoryCache) pin(url url.URL) (err error) {
+	cache.pinned[url] = true
+	return nil
+}
+
+// unpin clears the pinned mark on url.  Once unpinned,
+// the resource ages like any other: its idle time restarts now.
+func (cache *memoryCache) unpin(url url.URL) (err error) {
+	delete(cache.pinned, url)
+	if resource, ok := cache.memory[url]; ok {
+		resource.saveTime = time.Now()
+	}
+	return nil
 }
 
-// getSize retrieves the current size of cache.
+// refreshDone clears the refreshing mark on url's resource, so that checkRefresh
+// passes it to onRefresh again.
+func (cache *memoryCache) refreshDone(url url.URL) {
+	if resource, ok := cache.memory[url]; ok {
+		resource.refreshing = false
+	}
+}
+
+// getSize retrieves the current size of cache, counting response bodies only.
 func (cache *memoryCache) getSize() (size int64) {
-	return cache.size
+	return cache.used.logical
+}
+
+// getStats retrieves a snapshot of the space used by cache.
+func (cache *memoryCache) getStats() (stats Stats) {
+	stats = Stats{
+		Entries:      len(cache.memory),
+		LogicalBytes: cache.used.logical,
+		MemoryBytes:  cache.used.memory,
+		DiskBytes:    cache.used.disk,
+		MaxBytes:     cache.capacity(),
+		Dimension:    cache.dimension,
+	}
+	stats.RejectedEntries = cache.rejected
+	stats.CorruptFiles, stats.ScrubbedFiles = cache.corrupt, cache.scrubbed
+	stats.CollectedFiles, stats.ReclaimedBytes = cache.collected, cache.reclaimed
+	stats.IOErrors = cache.ioErrors
+	if cache.stripes != nil {
+		stats.MountPathsDown = cache.stripes.Down()
+	}
+	if cache.minFree > 0 {
+		stats.FreeDiskBytes, stats.DiskBudget = cache.freeDisk, cache.diskBudget
+	}
+	for _, b := range cache.blobs {
+		stats.DedupedBytes += int64(b.refs-1) * b.footprint.logical
+		if b.file == nil {
+			stats.ColdBodies++
+		}
+	}
+	pinnedBlobs := make(map[[sha256.Size]byte]bool)
+	for url, resource := range cache.memory {
+		if resource.memoryOnly || cache.blobs[resource.sum].memoryOnly {
+			stats.MemoryOnlyEntries++
+		}
+		if cache.pinned[url] {
+			stats.PinnedEntries++
+			stats.PinnedBytes += resource.footprint.get(cache.dimension)
+			if !pinnedBlobs[resource.sum] {
+				// Count a shared body once, however many pinned urls share it.
+				pinnedBlobs[resource.sum] = true
+				stats.PinnedBytes += cache.blobs[resource.sum].footprint.get(cache.dimension)
+			}
+		}
+	}
+	return stats
+}
+
+// Config holds the settings used to construct a cache with NewWithConfig.
+type Config struct {
+	// Policy is the replacement policy, one of "LRU" or "LFU".
+	Policy string
+
+	// Size is the maximum size of the cache in MB, applied to both
+	// the memory cache and the disk cache.
+	Size int
+
+	// Dimension is the measure of usage that Size is enforced against.
+	// The zero value, DimensionMemory, counts headers and bookkeeping too.
+	Dimension Dimension
+
+	// Expiration is how long an item may sit unused before it expires.
+	Expiration time.Duration
+
+	// RefreshAhead, if set, is how long before a resource with an explicit
+	// expiry (see SaveOptions.TTL) expires that retrieving it passes it to
+	// OnRefreshAhead with its headers, so that it can be fetched again and saved
+	// before it expires.  Each resource is passed once, until it is saved again.
+	// OnRefreshAhead is called from its own goroutine.
+	RefreshAhead   time.Duration
+	OnRefreshAhead func(url url.URL, h http.Header)
+
+	// StaleGrace is how long expired items are kept after they expire, and
+	// until purged, can still be retrieved with Cache.GetStale.  By default,
+	// items are purged as soon as they expire.  NoExpiry keeps them until
+	// they are evicted, and keeps expired parts (see SavePart) likewise.
+	StaleGrace time.Duration
+
+	// MountPath is the directory in which cached items are persisted.
+	MountPath string
+
+	// MountPaths, if set, are used instead of MountPath: cached items are spread
+	// over all of them (see StripedStore), each taking a share in proportion to
+	// its weight, and Size is shared out between them the same way.  If one
+	// fails, the cache carries on without it, and without its share of Size,
+	// until it works again; see StripeProbeInterval.
+	// Everything said about MountPath below applies to each of MountPaths.
+	MountPaths []MountPoint
+
+	// Store, if set, is where cached items are persisted instead of as
+	// one file per header and body in MountPath; see NewLogStore and NewMemoryStore.
+	Store Store
+
+	// Pinned lists urls that are pinned from the start; see Cache.Pin.
+	Pinned []url.URL
+
+	// Compression is how compressible bodies (text, scripts, stylesheets and
+	// structured data) are stored, in memory and on disk.  Compressed bodies
+	// count against the cache size at their compressed size.
+	Compression Compression
+
+	// Keyring, if set, encrypts every body and header file written to
+	// MountPath with AES-GCM.  Files that fail to authenticate are not loaded.
+	Keyring *Keyring
+
+	// ScrubInterval, if set, is how often the cache checks every file at
+	// MountPath against its checksum in the background.  Corrupt files are
+	// quarantined, and rewritten from memory if the cache has a good copy.
+	ScrubInterval time.Duration
+
+	// Lazy, if set, makes startup only read the header files at MountPath.
+	// Bodies are left on disk, counted against the cache size as though they
+	// were in memory, and read (and checked) the first time they are asked for.
+	Lazy bool
+
+	// Warm, if set along with Lazy, reads every body into memory in the
+	// background after startup: pinned resources first, then the bodies
+	// shared by the most urls.  Cache.Ready reports when it is done.
+	Warm bool
+
+	// ReadOnly opens the cache without writing anything to MountPath or Store,
+	// for tools that inspect a cache another process is using.  Saves fail with
+	// ErrReadOnly.  Unless ReadOnly is set, a cache locks MountPath against use
+	// by any other cache, in this process or another, until it is closed, and
+	// fails with ErrLocked if it can't.
+	ReadOnly bool
+
+	// OnIOError, if set, is called with an *IOError whenever saving a file to
+	// MountPath or deleting one fails.  Resources whose files couldn't be saved
+	// stay in the cache, but only in memory.  It is also called when one of
+	// MountPaths fails.  It is called from its own goroutine.
+	OnIOError func(err error)
+
+	// MinFreeDisk, if set, is how many MB to keep free on the filesystem holding
+	// MountPath.  Free space is measured every DiskCheckInterval (10 seconds by
+	// default); whenever it falls short, the cache evicts resources to make up
+	// the difference, and takes no more disk than it has left.  Mount paths on
+	// the same device share its free space.  It is ignored if there is no mount
+	// path, only a Store, and free space can't be measured on Windows, where
+	// setting it is an error (ErrNoFreeSpace).
+	MinFreeDisk       int
+	DiskCheckInterval time.Duration
+
+	// StripeProbeInterval is how often mount paths that have failed are tried
+	// again (30 seconds by default), and put back to use if they work.  A mount
+	// path that fails at startup is left out, and tried again like any other,
+	// as long as another one works.
+	StripeProbeInterval time.Duration
+
+	// Workers is how many goroutines write files to MountPath in the background
+	// (4 by default), and QueueDepth is how many writes each may have waiting
+	// (256 by default) before saving has to wait for the disk.  Writes to the
+	// same file are always done in the order they were made.
+	Workers    int
+	QueueDepth int
+
+	// SyncBatch, if more than 1, lets each worker write up to SyncBatch files
+	// before flushing them to disk together, if the Store is a Syncer.  It's
+	// faster, but a crash can lose more of the latest writes.  By default,
+	// every file is flushed to disk as it is written.
+	SyncBatch int
+}
+
+// MountPoint is one of the directories in Config.MountPaths, with its
+// weight.  A Weight of 0 counts as 1.
+type MountPoint struct {
+	Path   string
+	Weight int
 }
 
 // New returns a new cache with policy policy, max size size, and item expiration time
 // expiration.
 func New(policy string, size int, expiration time.Duration, mountPath string) (cache Cache, err error) {
+	return NewWithConfig(Config{
+		Policy:     policy,
+		Size:       size,
+		Expiration: expiration,
+		MountPath:  mountPath,
+	})
+}
+
+// NewWithConfig returns a new cache configured by config.
+func NewWithConfig(config Config) (cache Cache, err error) {
+	policy, mounts := config.Policy, config.MountPaths
+	if len(mounts) == 0 && config.MountPath != "" {
+		mounts = []MountPoint{{Path: config.MountPath}}
+	}
 	memCache := &memoryCache{
-		maxSize:    int64(size * 1000000),
-		expiration: expiration,
-		memory:     make(map[url.URL]*resource),
-		mountPath:  mountPath,
+		maxSize:     int64(config.Size * 1000000),
+		dimension:   config.Dimension,
+		expiration:  config.Expiration,
+		staleGrace:  config.StaleGrace,
+		memory:      make(map[url.URL]*resource),
+		blobs:       make(map[[sha256.Size]byte]*blob),
+		pinned:      make(map[url.URL]bool),
+		partials:    make(map[url.URL]*partial),
+		compression: config.Compression,
+		keyring:     config.Keyring,
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		readOnly:    config.ReadOnly,
+		onIOError:   config.OnIOError,
+		refresh:     config.RefreshAhead,
+		onRefresh:   config.OnRefreshAhead,
+		minFree:     int64(config.MinFreeDisk * 1000000),
+	}
+	for _, u := range config.Pinned {
+		memCache.pinned[u] = true
 	}
 
 	switch policy {
 	case "LRU":
 		cache = &lru{memoryCache: memCache}
+		memCache.nextToGo = getLRU
 	case "LFU":
 		cache = &lfu{memoryCache: memCache}
+		memCache.nextToGo = getLFU
 	default:
 		// Incorrect cache replacement policy; return an error.
 		err = ErrBadReplacementPolicy
@@ -391,90 +861,329 @@ func New(policy string, size int, expiration time.Duration, mountPath string) (c
 
 	// Load up anything we can find on disk into memory.
 	// Load into memory up to size.  If there are more files
-	// at the mount point than there is room in size, some files
-	// will not be loaded into memory.  If the mount path doesn't exist already,
-	// create it and return the cache, no loading necessary.
-	stat, err := os.Stat(mountPath)
-	if os.IsNotExist(err) {
-		// Mount path doesn't exist, make it.
-		if err = os.Mkdir(mountPath, os.ModePerm); err != nil {
-			return nil, err
+	// in the store than there is room in size, some files
+	// will not be loaded into memory.
+	// Lock the mount paths, so that no other cache writes to them under us,
+	// unless our store has locked them for us.  If we don't make it, let them go.
+	// Striped across several mount paths, we can do without any that have failed,
+	// as long as one works; they are tried again later.  Don't take over one
+	// that's in use, though.
+	defer func() {
+		if cache == nil {
+			memCache.unlock()
 		}
-	} else {
-		// Mount path exists.
-		if stat.IsDir() {
-			// Mount path is a directory, load files from it into the in-memory cache.
-			files, err := ioutil.ReadDir(mountPath)
+	}()
+	striped := config.Store == nil && len(mounts) > 1
+	failed := make(map[int]error)
+	for i, mount := range mounts {
+		memCache.mountPaths = append(memCache.mountPaths, mount.Path)
+		if err = makeDir(mount.Path); err != nil {
+			if !striped || err == ErrNotADirectory {
+				return nil, err
+			}
+			failed[i] = err
+			continue
+		}
+		if l, ok := config.Store.(locker); !ok || !l.locks(mount.Path) {
+			lock, err := lockMountPath(mount.Path, config.ReadOnly)
 			if err != nil {
-				// At this point, the cache is usable, it just couldn't load from disk.
-				// We can return it here safely in case of error.
-				// That doesn't mean callers shouldn't check for errors, they should.
-				return cache, err
+				if !striped || err == ErrLocked {
+					return nil, err
+				}
+				failed[i] = err
+				continue
 			}
-			fmt.Println("Loading the cache from disk at", mountPath, "...")
-			for _, file := range files {
-				size := file.Size()
-				name := file.Name()
-
-				// Only worry about files in the mount path here.
-				// Also only worry about response body files, not header files.
-				if !file.IsDir() && !strings.HasPrefix(name, headerPrefix) {
-					fi, err := os.Open(filepath.Join(mountPath, name))
-					if err != nil {
-						continue
-					}
+			memCache.locks = append(memCache.locks, lock)
+		}
+	}
+	if len(failed) == len(mounts) && len(mounts) > 0 {
+		return nil, failed[0]
+	}
 
-					hfi, err := os.Open(filepath.Join(mountPath, headerPrefix+name))
-					if err != nil {
-						continue
-					}
+	store := config.Store
+	if striped {
+		// No store given, keep files in the mount paths, striped across them.
+		// A mount path that failed gets a store all the same, to try again later.
+		stripes := make([]Stripe, len(mounts))
+		for i, mount := range mounts {
+			if stripes[i].Store, err = NewDirStore(mount.Path); err != nil {
+				if _, ok := failed[i]; !ok {
+					failed[i] = err
+				}
+				stripes[i].Store = &DirStore{dir: mount.Path, unsynced: make(map[string]bool)}
+			}
+			stripes[i].Weight = mount.Weight
+		}
+		if store, err = NewStripedStore(stripes); err != nil {
+			return nil, err
+		}
+	} else if store == nil {
+		// No store given, keep files in the mount path as usual.
+		mountPath := config.MountPath
+		if len(mounts) > 0 {
+			mountPath = mounts[0].Path
+		}
+		if store, err = NewDirStore(mountPath); err != nil {
+			return nil, err
+		}
+	}
+	if stripes, ok := store.(*StripedStore); ok {
+		// Carry on without any stripe that fails; see stripeDown.
+		memCache.stripes = stripes
+		stripes.onDown = func(stripe int, err error) {
+			go memCache.stripeDown(stripe, err)
+		}
+		for stripe, err := range failed {
+			stripes.markDown(stripe, err)
+		}
+	}
+	kind := storeKind(store)
+	if config.ReadOnly {
+		store = readOnlyStore{store}
+	}
+	memCache.store = store
+
+	// Files are written in the background, by a fixed set of workers.
+	workers, depth := config.Workers, config.QueueDepth
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	if depth <= 0 {
+		depth = defaultQueueDepth
+	}
+	memCache.queue = newWriteQueue(memCache, workers, depth, config.SyncBatch)
+
+	// Make sure we can read what's there, migrating it if it's in an older format.
+	if len(mounts) > 0 {
+		if err = memCache.checkFormat(kind, config.ReadOnly); err != nil {
+			return nil, err
+		}
+		if memCache.stripes != nil && len(memCache.stripes.downStripes()) == len(memCache.stripes.stripes) {
+			return nil, ErrNoStripes
+		}
+	}
+
+	// Work out how much disk we may use, if we're to leave some free.
+	// A store of the caller's own, with no mount path, has no disk we know of.
+	if memCache.minFree > 0 && len(memCache.mountPaths) == 0 {
+		fmt.Println("No mount path to keep disk space free on, not checking free space")
+		memCache.minFree = 0
+	}
+	if memCache.minFree > 0 {
+		if err = memCache.checkDisk(); err != nil {
+			return nil, err
+		}
+	}
+
+	names, err := store.List()
+	if err != nil {
+		// At this point, the cache is usable, it just couldn't load from disk.
+		// We can return it here safely in case of error.
+		// That doesn't mean callers shouldn't check for errors, they should.
+		close(memCache.ready)
+		return cache, err
+	}
+	if !config.ReadOnly {
+		memCache.removeTemp(names)
+	}
+	fmt.Println("Loading the cache from disk at", strings.Join(memCache.mountPaths, ", "), "...")
+	skipped := &unloaded{names: make(map[string]bool)}
+	for _, name := range names {
+		// Walk the header files; each names the blob file holding its body.
+		if strings.HasPrefix(name, headerPrefix) {
+			// Re-build headers and expiry from header file.  Hold on to the
+			// encoded form, it counts towards the size of the cache.
+			// Refuse anything that fails authentication.
+			encodedHeaders, headerStale, err := memCache.load(name)
+			if err == ErrAuthenticationFailed {
+				fmt.Println("Refusing to load", name, "as it failed authentication")
+				memCache.rejected++
+			} else if err != nil && !os.IsNotExist(err) {
+				skipped.keep(name)
+				skipped.unreadable = true
+			}
+			if err != nil {
+				continue
+			}
+			meta, err := decodeMetadata(encodedHeaders)
+			if err != nil {
+				memCache.corrupt++
+				memCache.quarantine(name)
+				continue
+			}
 
-					// Re-build the url for this file.
-					// See FromDiskString for unhash rules.
-					url := FromDiskString(name)
+			// Re-build the url for this file, from its metadata or, for older
+			// files, its name.  A url already loaded, under another name, is
+			// left for collect.  Files that aren't under the name the cache
+			// would give them now, or don't record their url, are re-written.
+			url, err := headerURL(name, meta)
+			if err != nil {
+				memCache.corrupt++
+				memCache.quarantine(name)
+				continue
+			}
+			if _, ok := memCache.memory[url]; ok {
+				continue
+			}
+			headerName := memCache.headerName(url)
+			if meta.URL == "" {
+				meta.URL = url.String()
+				if encodedHeaders, err = encodeMetadata(meta); err != nil {
+					continue
+				}
+				headerStale = true
+			}
 
-					// Re-build headers from header file too.
-					dec := gob.NewDecoder(hfi)
-					var h http.Header
-					err = dec.Decode(&h)
-					if err != nil {
-						continue
+			// Read the body, unless another url has already found it,
+			// and check it against its checksum.  Lazy caches only check
+			// that the body is there, and leave reading it until it is
+			// first asked for; see fetchBlob.  A body that isn't under
+			// the name the cache would give it now is read anyway, to be re-written.
+			var body []byte
+			var storedSize int64
+			var bodyStale bool
+			bodyName := memCache.blobName(meta.Sum)
+			_, known := memCache.blobs[meta.Sum]
+			lazy := config.Lazy && !known
+			if lazy {
+				if storedSize, bodyName, err = memCache.statBlob(meta.Sum); err != nil {
+					// Keep it, unless its body has gone for good.
+					if !os.IsNotExist(err) {
+						skipped.keep(name, bodyName)
+					}
+					continue
+				}
+				if memCache.keyring != nil {
+					storedSize -= memCache.keyring.overhead()
+				}
+				lazy = bodyName == memCache.blobName(meta.Sum)
+			}
+			if !known && !lazy {
+				body, bodyName, bodyStale, err = memCache.loadBlob(meta.Sum, meta.Encoding)
+				switch err {
+				case ErrAuthenticationFailed:
+					fmt.Println("Refusing to load", bodyName, "as it failed authentication")
+					memCache.rejected++
+				case ErrChecksumMismatch:
+					memCache.corrupt++
+					memCache.quarantine(bodyName)
+				default:
+					if err != nil && !os.IsNotExist(err) {
+						skipped.keep(name, bodyName)
 					}
+				}
+				if err != nil {
+					continue
+				}
+				storedSize = int64(len(body))
+			}
 
-					// Make sure that the file will fit in the cache.
-					// If it does, create a resource and save it in the cache;
-					// then, move on to the next file.  If it doesn't,
-					// simply move on.  This has the effect of the cache trying to load
-					// files into memory in the same order of the files that are
-					// returned from ioutil.Readdir.
-					needSize := memCache.size + size
-					if needSize <= memCache.maxSize {
-						var buf bytes.Buffer
-						if _, err := io.Copy(&buf, fi); err != nil {
-							continue
-						}
-						memCache.memory[url] = &resource{
-							file:            &buf,
-							saveTime:        time.Now(),
-							accessCount:     1,
-							originalHeaders: h,
-						}
-						memCache.size = needSize
-						fmt.Printf("Loaded %s into memory\n", url.String())
+			// Make sure that the file will fit in the cache.
+			// If it does, create a resource and save it in the cache;
+			// then, move on to the next file.  If it doesn't,
+			// simply move on.  This has the effect of the cache trying to load
+			// files into memory in the same order of the files that are
+			// returned from the store.
+			fiSize := measureEntry(url, int64(len(encodedHeaders)))
+			bodySize := storedSize
+			if meta.Encoding != encodingIdentity {
+				bodySize = meta.Size
+			}
+			blobSize := measureBody(bodySize, storedSize)
+			needSize := memCache.used.add(fiSize)
+			if _, ok := memCache.blobs[meta.Sum]; !ok {
+				needSize = needSize.add(blobSize)
+			}
+			if memCache.fits(needSize) {
+				b, ok := memCache.blobs[meta.Sum]
+				if ok {
+					b.refs++
+				} else {
+					b = &blob{encoding: meta.Encoding, refs: 1, footprint: blobSize}
+					if body != nil {
+						b.file = bytes.NewBuffer(body)
 					}
-					fi.Close()
-					hfi.Close()
+					memCache.blobs[meta.Sum] = b
+					memCache.used = memCache.used.add(blobSize)
+				}
+				memCache.memory[url] = &resource{
+					sum:             meta.Sum,
+					saveTime:        time.Now(),
+					accessCount:     1,
+					originalHeaders: meta.Header,
+					expires:         meta.Expires,
+					noExpiry:        meta.NoExpiry,
+					status:          meta.Status,
+					fetched:         meta.Fetched,
+					encodedHeaders:  encodedHeaders,
+					footprint:       fiSize,
+				}
+				memCache.used = memCache.used.add(fiSize)
+				fmt.Printf("Loaded %s into memory\n", url.String())
+
+				// Files sealed under an old key are re-sealed under the current
+				// one.  Files under another name are written under the new name
+				// before anything else happens, as collect removes the old one;
+				// if that fails, the old one is kept until next time.
+				if bodyStale {
+					memCache.rename(bodyName, memCache.blobName(meta.Sum), body, skipped)
 				}
+				if headerStale || name != headerName {
+					memCache.rename(name, headerName, encodedHeaders, skipped)
+				}
+			} else {
+				// Leave it on disk, in case the cache is made bigger.
+				skipped.keep(name, bodyName)
 			}
+		} else if isPartIndex(name) {
+			// Partly cached resources have an index file naming their pieces.
+			memCache.loadPartial(name, skipped)
+		}
+	}
+	fmt.Println("Done loading files from cache")
+
+	// Clear out anything on disk nothing refers to.
+	if !config.ReadOnly {
+		memCache.collect(skipped)
+	}
+
+	// Warm up in the background, if asked to.  Otherwise, we're ready.
+	if config.Lazy && config.Warm {
+		go memCache.warm()
+	} else {
+		close(memCache.ready)
+	}
+
+	// Keep an eye on free space, if asked to.
+	if memCache.minFree > 0 {
+		interval := config.DiskCheckInterval
+		if interval <= 0 {
+			interval = defaultDiskCheckInterval
+		}
+		go memCache.monitorDisk(interval)
+	}
+
+	// Try failed mount paths again every so often.
+	if memCache.stripes != nil {
+		interval := config.StripeProbeInterval
+		if interval <= 0 {
+			interval = defaultStripeProbeInterval
 		}
-		fmt.Println("Done loading files from cache")
+		go memCache.monitorStripes(interval)
+	}
+
+	// Spin up a low priority goroutine to check files on disk, if asked to.
+	if config.ScrubInterval > 0 {
+		go memCache.scrubEvery(config.ScrubInterval)
 	}
 
-	// Spin up a gouroutine to purge expired items every 10ms.
+	// Spin up a gouroutine to purge expired items every 10ms, until the cache is closed.
 	// This is concurrency safe.
 	go func() {
 		for {
 			select {
+			case <-memCache.done:
+				return
 			case <-time.After(10 * time.Millisecond):
 				memCache.Lock()
 				memCache.purgeExpired()
@@ -503,12 +1212,29 @@ func (cache *lru) GetWithHeaders(url url.URL) (fi *bytes.Buffer, h http.Header,
 	return
 }
 
+// GetStale implements Cache.GetStale for an LRU cache.
+func (cache *lru) GetStale(url url.URL) (fi *bytes.Buffer, h http.Header, stale time.Duration, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	fi, h, _, stale, err = cache.getStale(url, true)
+	return fi, h, stale, err
+}
+
+// GetResponse implements Cache.GetResponse for an LRU cache.
+func (cache *lru) GetResponse(url url.URL) (fi *bytes.Buffer, h http.Header, status int, stale time.Duration, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getStale(url, true)
+}
+
 // Save implements Cache.Save for an LRU cache.
 func (cache *lru) Save(url url.URL, fi *bytes.Buffer) (err error) {
 	cache.Lock()
 	defer cache.Unlock()
 
-	err = cache.saveResource(url, fi, getLRU, nil)
+	err = cache.saveResource(url, fi, getLRU, SaveOptions{})
 	return
 }
 
@@ -517,10 +1243,45 @@ func (cache *lru) SaveWithHeaders(url url.URL, fi *bytes.Buffer, h http.Header)
 	cache.Lock()
 	defer cache.Unlock()
 
-	err = cache.saveResource(url, fi, getLRU, h)
+	err = cache.saveResource(url, fi, getLRU, SaveOptions{Header: h})
+	return
+}
+
+// SaveWithTTL implements Cache.SaveWithTTL for an LRU cache.
+func (cache *lru) SaveWithTTL(url url.URL, fi *bytes.Buffer, h http.Header, ttl time.Duration) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.saveResource(url, fi, getLRU, SaveOptions{Header: h, TTL: ttl})
+	return
+}
+
+// SaveWithOptions implements Cache.SaveWithOptions for an LRU cache.
+func (cache *lru) SaveWithOptions(url url.URL, fi *bytes.Buffer, opts SaveOptions) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.saveResource(url, fi, getLRU, opts)
 	return
 }
 
+// SavePart implements Cache.SavePart for an LRU cache.
+func (cache *lru) SavePart(url url.URL, offset int64, data []byte, size int64, opts SaveOptions) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.savePart(url, offset, data, size, opts, getLRU)
+	return
+}
+
+// GetPart implements Cache.GetPart for an LRU cache.
+func (cache *lru) GetPart(url url.URL, r Range) (data []byte, h http.Header, size int64, missing []Range, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getPart(url, r)
+}
+
 // Size gets the current size of the LRU cache (not max size).
 func (cache *lru) Size() (size int) {
 	cache.Lock()
@@ -529,6 +1290,85 @@ func (cache *lru) Size() (size int) {
 	return int(cache.getSize())
 }
 
+// Stats implements Cache.Stats for an LRU cache.
+func (cache *lru) Stats() (stats Stats) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getStats()
+}
+
+// Pin implements Cache.Pin for an LRU cache.
+func (cache *lru) Pin(url url.URL) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.pin(url)
+}
+
+// Unpin implements Cache.Unpin for an LRU cache.
+func (cache *lru) Unpin(url url.URL) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.unpin(url)
+}
+
+// RefreshDone implements Cache.RefreshDone for an LRU cache.
+func (cache *lru) RefreshDone(url url.URL) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.refreshDone(url)
+}
+
+// Collect implements Cache.Collect for an LRU cache.
+// collect locks the cache itself, a file at a time.
+func (cache *lru) Collect() (reclaimed int64, err error) {
+	return cache.collect(nil)
+}
+
+// Ready implements Cache.Ready for an LRU cache.
+func (cache *lru) Ready() (ready <-chan struct{}) {
+	return cache.ready
+}
+
+// Flush implements Cache.Flush for an LRU cache.
+// It mustn't lock the cache, which the queue may be waiting on.
+func (cache *lru) Flush() (err error) {
+	return cache.queue.flush()
+}
+
+// Export implements Cache.Export for an LRU cache.
+// export locks the cache itself, a resource at a time.
+func (cache *lru) Export(w io.Writer) (err error) {
+	return cache.export(w)
+}
+
+// Import implements Cache.Import for an LRU cache.
+// importFrom locks the cache itself, a resource at a time.
+func (cache *lru) Import(r io.Reader) (err error) {
+	return cache.importFrom(r)
+}
+
+// ExportWARC implements Cache.ExportWARC for an LRU cache.
+// exportWARC locks the cache itself, a resource at a time.
+func (cache *lru) ExportWARC(w io.Writer) (err error) {
+	return cache.exportWARC(w)
+}
+
+// ImportWARC implements Cache.ImportWARC for an LRU cache.
+// importWARC locks the cache itself, a resource at a time.
+func (cache *lru) ImportWARC(r io.Reader) (err error) {
+	return cache.importWARC(r)
+}
+
+// Close implements Cache.Close for an LRU cache.
+// close locks the cache itself, as it mustn't be locked while the queue is flushed.
+func (cache *lru) Close() (err error) {
+	return cache.close()
+}
+
 // Get implements Cache.Get for an LFU cache.
 func (cache *lfu) Get(url url.URL) (fi *bytes.Buffer, err error) {
 	cache.Lock()
@@ -547,12 +1387,29 @@ func (cache *lfu) GetWithHeaders(url url.URL) (fi *bytes.Buffer, h http.Header,
 	return
 }
 
+// GetStale implements Cache.GetStale for an LFU cache.
+func (cache *lfu) GetStale(url url.URL) (fi *bytes.Buffer, h http.Header, stale time.Duration, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	fi, h, _, stale, err = cache.getStale(url, true)
+	return fi, h, stale, err
+}
+
+// GetResponse implements Cache.GetResponse for an LFU cache.
+func (cache *lfu) GetResponse(url url.URL) (fi *bytes.Buffer, h http.Header, status int, stale time.Duration, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getStale(url, true)
+}
+
 // Save implements Cache.Save for an LFU cache.
 func (cache *lfu) Save(url url.URL, fi *bytes.Buffer) (err error) {
 	cache.Lock()
 	defer cache.Unlock()
 
-	err = cache.saveResource(url, fi, getLFU, nil)
+	err = cache.saveResource(url, fi, getLFU, SaveOptions{})
 	return
 }
 
@@ -561,10 +1418,45 @@ func (cache *lfu) SaveWithHeaders(url url.URL, fi *bytes.Buffer, h http.Header)
 	cache.Lock()
 	defer cache.Unlock()
 
-	err = cache.saveResource(url, fi, getLFU, h)
+	err = cache.saveResource(url, fi, getLFU, SaveOptions{Header: h})
+	return
+}
+
+// SaveWithTTL implements Cache.SaveWithTTL for an LFU cache.
+func (cache *lfu) SaveWithTTL(url url.URL, fi *bytes.Buffer, h http.Header, ttl time.Duration) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.saveResource(url, fi, getLFU, SaveOptions{Header: h, TTL: ttl})
 	return
 }
 
+// SaveWithOptions implements Cache.SaveWithOptions for an LFU cache.
+func (cache *lfu) SaveWithOptions(url url.URL, fi *bytes.Buffer, opts SaveOptions) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.saveResource(url, fi, getLFU, opts)
+	return
+}
+
+// SavePart implements Cache.SavePart for an LFU cache.
+func (cache *lfu) SavePart(url url.URL, offset int64, data []byte, size int64, opts SaveOptions) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.savePart(url, offset, data, size, opts, getLFU)
+	return
+}
+
+// GetPart implements Cache.GetPart for an LFU cache.
+func (cache *lfu) GetPart(url url.URL, r Range) (data []byte, h http.Header, size int64, missing []Range, err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getPart(url, r)
+}
+
 // Size gets the current size of the LFU cache (not max size).
 func (cache *lfu) Size() (size int) {
 	cache.Lock()
@@ -572,3 +1464,82 @@ func (cache *lfu) Size() (size int) {
 
 	return int(cache.getSize())
 }
+
+// Stats implements Cache.Stats for an LFU cache.
+func (cache *lfu) Stats() (stats Stats) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.getStats()
+}
+
+// Pin implements Cache.Pin for an LFU cache.
+func (cache *lfu) Pin(url url.URL) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.pin(url)
+}
+
+// Unpin implements Cache.Unpin for an LFU cache.
+func (cache *lfu) Unpin(url url.URL) (err error) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	return cache.unpin(url)
+}
+
+// RefreshDone implements Cache.RefreshDone for an LFU cache.
+func (cache *lfu) RefreshDone(url url.URL) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	cache.refreshDone(url)
+}
+
+// Collect implements Cache.Collect for an LFU cache.
+// collect locks the cache itself, a file at a time.
+func (cache *lfu) Collect() (reclaimed int64, err error) {
+	return cache.collect(nil)
+}
+
+// Ready implements Cache.Ready for an LFU cache.
+func (cache *lfu) Ready() (ready <-chan struct{}) {
+	return cache.ready
+}
+
+// Flush implements Cache.Flush for an LFU cache.
+// It mustn't lock the cache, which the queue may be waiting on.
+func (cache *lfu) Flush() (err error) {
+	return cache.queue.flush()
+}
+
+// Export implements Cache.Export for an LFU cache.
+// export locks the cache itself, a resource at a time.
+func (cache *lfu) Export(w io.Writer) (err error) {
+	return cache.export(w)
+}
+
+// Import implements Cache.Import for an LFU cache.
+// importFrom locks the cache itself, a resource at a time.
+func (cache *lfu) Import(r io.Reader) (err error) {
+	return cache.importFrom(r)
+}
+
+// ExportWARC implements Cache.ExportWARC for an LFU cache.
+// exportWARC locks the cache itself, a resource at a time.
+func (cache *lfu) ExportWARC(w io.Writer) (err error) {
+	return cache.exportWARC(w)
+}
+
+// ImportWARC implements Cache.ImportWARC for an LFU cache.
+// importWARC locks the cache itself, a resource at a time.
+func (cache *lfu) ImportWARC(r io.Reader) (err error) {
+	return cache.importWARC(r)
+}
+
+// Close implements Cache.Close for an LFU cache.
+// close locks the cache itself, as it mustn't be locked while the queue is flushed.
+func (cache *lfu) Close() (err error) {
+	return cache.close()
+}
@@ -3,11 +3,19 @@ package cache_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -37,7 +45,8 @@ func checkError(err error) (duplErr error) {
 	return err
 }
 
-// dirEmpty returns whether or not a given directory (name) is empty.
+// dirEmpty returns whether or not a given directory (name) is empty
+// of cached files.  The cache's lock file and manifest don't count.
 func dirEmpty(name string) (empty bool, err error) {
 	f, err := os.Open(name)
 	if err != nil {
@@ -45,14 +54,46 @@ func dirEmpty(name string) (empty bool, err error) {
 	}
 	defer f.Close()
 
-	// Try and read at max 1 file.
-	_, err = f.Readdirnames(1)
-	if err == io.EOF {
-		// The directory is empty.
-		return true, nil
+	names, err := f.Readdirnames(0)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if name != ".lock" && name != "manifest.json" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// newTestCache instantiates a cache with config, failing the test straight away
+// if it can't.  Unset, the policy is LRU, the size 1MB and the expiration an hour
+// (so nothing expires - testing purposes), and the cache is mounted in a fresh
+// temporary directory, removed once the test is done.  The cache is closed then too,
+// if it hasn't been already.  The config the cache was instantiated with is returned
+// too, to reload the cache from the same mount path once it is closed.
+func newTestCache(t *testing.T, config cache.Config) (c cache.Cache, used cache.Config) {
+	t.Helper()
+	if config.Policy == "" {
+		config.Policy = "LRU"
+	}
+	if config.Size == 0 {
+		config.Size = 1
 	}
-	// Either not empty or error, suits both cases.
-	return false, err
+	if config.Expiration == 0 {
+		config.Expiration = time.Hour
+	}
+	if config.MountPath == "" && len(config.MountPaths) == 0 && config.Store == nil {
+		config.MountPath = t.TempDir()
+	}
+
+	c, err := cache.NewWithConfig(config)
+	if err != nil {
+		t.Fatalf("Couldn't instantiate cache: %v", err)
+	}
+	// Close the cache before the mount path is removed.
+	t.Cleanup(func() { c.Close() })
+	return c, config
 }
 
 // Initialize our test files here.
@@ -149,9 +190,9 @@ func TestCache(t *testing.T) {
 		// Sleep a bit to allow the disk save to run.
 		time.Sleep(100 * time.Millisecond)
 
-		fipath := filepath.Join(mountPath, cache.ToDiskString(testURL200))
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer200.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL200))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer200.Bytes()))
 		}
 	})
 
@@ -183,14 +224,14 @@ func TestCache(t *testing.T) {
 			t.Errorf("Size mismatch: cache should have size 700 bytes but has size %d", testCache.Size())
 		}
 
-		fipath := filepath.Join(mountPath, cache.ToDiskString(testURL200))
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer200.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL200))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer200.Bytes()))
 		}
 
-		fipath = filepath.Join(mountPath, cache.ToDiskString(testURL500))
+		fipath = filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer500.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL500))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer500.Bytes()))
 		}
 	})
 
@@ -320,14 +361,14 @@ func TestLRU(t *testing.T) {
 		// Sleep to allow disk saves to normalize.
 		time.Sleep(1 * time.Second)
 
-		fipath := filepath.Join(mountPath, cache.ToDiskString(testURL200))
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer200.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL200))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer200.Bytes()))
 		}
 
-		fipath = filepath.Join(mountPath, cache.ToDiskString(testURL700))
+		fipath = filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer700.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL700))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer700.Bytes()))
 		}
 	})
 
@@ -354,19 +395,19 @@ func TestLRU(t *testing.T) {
 		// Sleep to allow disk saves to normalize.
 		time.Sleep(2 * time.Second)
 
-		fipath := filepath.Join(mountPath, cache.ToDiskString(testURL900))
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer900.Bytes()))
 		if _, err = os.Stat(fipath); os.IsNotExist(err) {
-			t.Errorf("%s was not found on disk", cache.ToDiskString(testURL900))
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(testBuffer900.Bytes()))
 		}
 
-		fipath = filepath.Join(mountPath, cache.ToDiskString(testURL500))
+		fipath = filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer500.Bytes()))
 		if _, err = os.Stat(fipath); !os.IsNotExist(err) {
-			t.Errorf("%s was found on disk, but should have been deleted", cache.ToDiskString(testURL500))
+			t.Errorf("%s was found on disk, but should have been deleted", cache.ToBlobDiskString(testBuffer500.Bytes()))
 		}
 
-		fipath = filepath.Join(mountPath, cache.ToDiskString(testURL700))
+		fipath = filepath.Join(mountPath, cache.ToBlobDiskString(testBuffer700.Bytes()))
 		if _, err = os.Stat(fipath); !os.IsNotExist(err) {
-			t.Errorf("%s was found on disk, but should have been deleted", cache.ToDiskString(testURL700))
+			t.Errorf("%s was found on disk, but should have been deleted", cache.ToBlobDiskString(testBuffer700.Bytes()))
 		}
 	})
 
@@ -603,3 +644,1954 @@ func TestReversibleHash(t *testing.T) {
 		})
 	}
 }
+
+func TestStats(t *testing.T) {
+	// Instantiate an LRU cache capped at 1MB on disk, with item expiry of an hour (so nothing expires -
+	// testing purposes).
+	diskCache, _ := newTestCache(t, cache.Config{Dimension: cache.DimensionDisk})
+	var err error
+
+	t.Run("Headers and block rounding are counted separately from body bytes", func(t *testing.T) {
+		h := http.Header{}
+		h.Set("Content-Type", "text/plain")
+		if err = diskCache.SaveWithHeaders(testURL200, bytes.NewBufferString("hello"), h); err != nil {
+			t.Errorf("Couldn't save %s to the cache", testURL200.String())
+		}
+
+		stats := diskCache.Stats()
+		if stats.Entries != 1 {
+			t.Errorf("Cache should have 1 entry but has %d", stats.Entries)
+		}
+		if stats.LogicalBytes != 5 || diskCache.Size() != 5 {
+			t.Errorf("Size mismatch: cache should have 5 logical bytes but has %d", stats.LogicalBytes)
+		}
+		if stats.MemoryBytes <= stats.LogicalBytes {
+			t.Errorf("Memory bytes (%d) should include headers on top of logical bytes", stats.MemoryBytes)
+		}
+		// One block for the body and one for the header file.
+		if stats.DiskBytes != 2*4096 {
+			t.Errorf("Size mismatch: cache should use 8192 bytes on disk but uses %d", stats.DiskBytes)
+		}
+	})
+
+	t.Run("The cap is enforced against the configured dimension", func(t *testing.T) {
+		// Each tiny item costs two blocks on disk, so far fewer than 200 of them fit in 1MB.
+		for i := 0; i < 200; i++ {
+			u := url.URL{Path: "/tiny/" + strconv.Itoa(i)}
+			if err = diskCache.Save(u, bytes.NewBufferString("tiny "+strconv.Itoa(i))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+
+		stats := diskCache.Stats()
+		if stats.DiskBytes > stats.MaxBytes {
+			t.Errorf("Overfilled cache on disk.  Disk bytes: %d", stats.DiskBytes)
+		}
+		if stats.Entries >= 200 {
+			t.Errorf("Cache should have evicted entries, but has %d", stats.Entries)
+		}
+	})
+
+	t.Run("A resource bigger than the whole cache is refused", func(t *testing.T) {
+		if err = diskCache.Save(testURL200, &testBuffer200); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saving %s should have failed with %v, got %v", testURL200.String(), cache.ErrCacheSizeExceeded, err)
+		}
+	})
+}
+
+func TestPin(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage counting body bytes only, and item expiry of a second.
+	pinnedURL := url.URL{Path: "/corporate.css"}
+	otherURL := url.URL{Path: "/other.js"}
+	pinCache, _ := newTestCache(t, cache.Config{
+		Dimension:  cache.DimensionLogical,
+		Expiration: time.Duration(time.Second * 1),
+		Pinned:     []url.URL{pinnedURL},
+	})
+	var err error
+
+	t.Run("Pinned items are never chosen for eviction", func(t *testing.T) {
+		if err = pinCache.Save(pinnedURL, bytes.NewBuffer(bytes.Repeat([]byte("p"), 400*1000))); err != nil {
+			t.Errorf("Couldn't save %s to the cache", pinnedURL.String())
+		}
+		if err = pinCache.Save(otherURL, bytes.NewBuffer(bytes.Repeat([]byte("o"), 400*1000))); err != nil {
+			t.Errorf("Couldn't save %s to the cache", otherURL.String())
+		}
+
+		// This should evict otherURL even though pinnedURL is less recently used.
+		if err = pinCache.Save(testURL200, bytes.NewBuffer(bytes.Repeat([]byte("t"), 400*1000))); err != nil {
+			t.Errorf("Couldn't save %s to the cache", testURL200.String())
+		}
+
+		if _, err = pinCache.Get(pinnedURL); err != nil {
+			t.Errorf("Pinned resource %s was evicted", pinnedURL.String())
+		}
+		if _, err = pinCache.Get(otherURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found unexpected resource in cache")
+		}
+
+		stats := pinCache.Stats()
+		if stats.PinnedEntries != 1 || stats.PinnedBytes != 400*1000 {
+			t.Errorf("Cache should have 1 pinned entry of 400000 bytes but has %d of %d bytes", stats.PinnedEntries, stats.PinnedBytes)
+		}
+	})
+
+	t.Run("Pinned bytes count against capacity", func(t *testing.T) {
+		if err = pinCache.Pin(testURL200); err != nil {
+			t.Errorf("Couldn't pin %s", testURL200.String())
+		}
+		if err = pinCache.Save(otherURL, bytes.NewBuffer(bytes.Repeat([]byte("o"), 400*1000))); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saving %s should have failed with %v, got %v", otherURL.String(), cache.ErrCacheSizeExceeded, err)
+		}
+	})
+
+	t.Run("Pinned items never expire, unpinned items do", func(t *testing.T) {
+		if err = pinCache.Unpin(testURL200); err != nil {
+			t.Errorf("Couldn't unpin %s", testURL200.String())
+		}
+
+		// Wait until testURL200 expires.
+		time.Sleep(2 * time.Second)
+		if _, err = pinCache.Get(testURL200); err != cache.ErrResourceNotInCache {
+			t.Error("Found resource in cache when it should have expired")
+		}
+		if _, err = pinCache.Get(pinnedURL); err != nil {
+			t.Errorf("Pinned resource %s expired", pinnedURL.String())
+		}
+	})
+}
+
+func TestTTL(t *testing.T) {
+	// Instantiate an LFU cache, with 1MB of storage, and item expiry of a second.
+	ttlCache, config := newTestCache(t, cache.Config{Policy: "LFU", Expiration: time.Duration(time.Second * 1)})
+	var err error
+
+	shortURL := url.URL{Path: "/short"}
+	foreverURL := url.URL{Path: "/forever"}
+
+	t.Run("An explicit TTL expires a resource even while it is being used", func(t *testing.T) {
+		if err = ttlCache.SaveWithTTL(shortURL, bytes.NewBufferString("short"), nil, 500*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", shortURL.String())
+		}
+		if err = ttlCache.SaveWithTTL(foreverURL, bytes.NewBufferString("forever"), nil, cache.NoExpiry); err != nil {
+			t.Errorf("Couldn't save %s to the cache", foreverURL.String())
+		}
+
+		time.Sleep(250 * time.Millisecond)
+		if _, err = ttlCache.Get(shortURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", shortURL.String())
+		}
+
+		time.Sleep(500 * time.Millisecond)
+		if _, err = ttlCache.Get(shortURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found resource in cache when it should have expired")
+		}
+	})
+
+	t.Run("NoExpiry outlives the cache expiration, and survives a restart", func(t *testing.T) {
+		// Wait until anything using the default expiration would have expired.
+		time.Sleep(1500 * time.Millisecond)
+
+		buf, err := ttlCache.Get(foreverURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", foreverURL.String())
+		} else if buf.String() != "forever" {
+			t.Errorf("Failed to retrieve %s from the cache", foreverURL.String())
+		}
+
+		ttlCache.Close()
+		reloaded, _ := newTestCache(t, config)
+		time.Sleep(1500 * time.Millisecond)
+		if _, err = reloaded.Get(foreverURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the reloaded cache", foreverURL.String())
+		}
+	})
+}
+
+func TestDedup(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage counting body bytes only, and item expiry of an hour
+	// (so nothing expires - testing purposes).
+	dedupCache, config := newTestCache(t, cache.Config{Dimension: cache.DimensionLogical})
+	mountPath := config.MountPath
+	var err error
+
+	body := bytes.Repeat([]byte("jquery"), 100*1000)
+	mirrors := []url.URL{
+		{Scheme: "http", Host: "cdn1.example.com", Path: "/jquery.js"},
+		{Scheme: "http", Host: "cdn2.example.com", Path: "/jquery.js"},
+		{Scheme: "http", Host: "cdn1.example.com", Path: "/jquery.js", RawQuery: "v=2"},
+	}
+
+	t.Run("Urls with identical bodies share their space", func(t *testing.T) {
+		for _, u := range mirrors {
+			h := http.Header{}
+			h.Set("X-Mirror", u.Host)
+			if err = dedupCache.SaveWithHeaders(u, bytes.NewBuffer(body), h); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+
+		stats := dedupCache.Stats()
+		if stats.Entries != len(mirrors) {
+			t.Errorf("Cache should have %d entries but has %d", len(mirrors), stats.Entries)
+		}
+		if stats.LogicalBytes != int64(len(body)) {
+			t.Errorf("Size mismatch: cache should have size %d bytes but has size %d", len(body), stats.LogicalBytes)
+		}
+		if stats.DedupedBytes != int64(2*len(body)) {
+			t.Errorf("Cache should have saved %d bytes by sharing but saved %d", 2*len(body), stats.DedupedBytes)
+		}
+
+		// Each url keeps its own headers.
+		for _, u := range mirrors {
+			buf, h, err := dedupCache.GetWithHeaders(u)
+			if err != nil {
+				t.Errorf("Couldn't retrieve %s from the cache", u.String())
+				continue
+			}
+			if !bytes.Equal(buf.Bytes(), body) || h.Get("X-Mirror") != u.Host {
+				t.Errorf("Failed to retrieve %s from the cache", u.String())
+			}
+		}
+
+		// Wait for the disk save to run.
+		dedupCache.Flush()
+
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(body))
+		if _, err = os.Stat(fipath); os.IsNotExist(err) {
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(body))
+		}
+	})
+
+	t.Run("A shared body is only deleted with its last url", func(t *testing.T) {
+		// Overwriting two of the mirrors with other content drops their references.
+		for i, u := range mirrors[:2] {
+			if err = dedupCache.Save(u, bytes.NewBufferString("changed "+strconv.Itoa(i))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+
+		buf, err := dedupCache.Get(mirrors[2])
+		if err != nil || !bytes.Equal(buf.Bytes(), body) {
+			t.Errorf("Failed to retrieve %s from the cache", mirrors[2].String())
+		}
+
+		// Evicting the last url to share the body frees its space.
+		if err = dedupCache.Save(mirrors[2], bytes.NewBuffer(make([]byte, 900*1000))); err != nil {
+			t.Errorf("Couldn't save %s to the cache", mirrors[2].String())
+		}
+		if dedupCache.Stats().DedupedBytes != 0 {
+			t.Error("Cache should no longer share any bodies")
+		}
+
+		// Wait for the disk delete to run.
+		dedupCache.Flush()
+
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(body))
+		if _, err = os.Stat(fipath); !os.IsNotExist(err) {
+			t.Errorf("%s was found on disk, but should have been deleted", cache.ToBlobDiskString(body))
+		}
+	})
+}
+
+func TestLoadLegacyLayout(t *testing.T) {
+	// Lay out a mount point the way the cache used to: a body file named after the url,
+	// and a header file holding a bare gob-encoded http.Header.
+	mountPath := t.TempDir()
+
+	legacyURL := url.URL{Scheme: "http", Host: "example.com", Path: "/legacy.css"}
+	body := []byte("body { color: red; }")
+	h := http.Header{}
+	h.Set("Content-Type", "text/css")
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(h); err != nil {
+		t.Error("Couldn't encode headers")
+	}
+	if err := ioutil.WriteFile(filepath.Join(mountPath, cache.ToDiskString(legacyURL)), body, 0644); err != nil {
+		t.Error("Couldn't write legacy body file")
+	}
+	if err := ioutil.WriteFile(filepath.Join(mountPath, cache.ToHeaderDiskString(legacyURL)), encoded.Bytes(), 0644); err != nil {
+		t.Error("Couldn't write legacy header file")
+	}
+
+	legacyCache, _ := newTestCache(t, cache.Config{MountPath: mountPath})
+
+	t.Run("Legacy entries load, and move into blob files", func(t *testing.T) {
+		buf, h, err := legacyCache.GetWithHeaders(legacyURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", legacyURL.String())
+		} else if !bytes.Equal(buf.Bytes(), body) || h.Get("Content-Type") != "text/css" {
+			t.Errorf("Failed to retrieve %s from the cache", legacyURL.String())
+		}
+
+		// Wait for the disk save to run.
+		legacyCache.Flush()
+
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(body))
+		if _, err = os.Stat(fipath); os.IsNotExist(err) {
+			t.Errorf("%s was not found on disk", cache.ToBlobDiskString(body))
+		}
+		fipath = filepath.Join(mountPath, cache.ToDiskString(legacyURL))
+		if _, err = os.Stat(fipath); !os.IsNotExist(err) {
+			t.Errorf("%s was found on disk, but should have been moved", cache.ToDiskString(legacyURL))
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage, gzip compression and item expiry of an hour
+	// (so nothing expires - testing purposes).
+	gzipCache, config := newTestCache(t, cache.Config{Compression: cache.CompressionGzip})
+	var err error
+
+	cssURL := url.URL{Scheme: "http", Host: "example.com", Path: "/site.css"}
+	css := bytes.Repeat([]byte(".button { color: blue; }\n"), 100*1000)
+	cssHeader := http.Header{}
+	cssHeader.Set("Content-Type", "text/css; charset=utf-8")
+
+	t.Run("Compressible resources fit in the cache at their compressed size", func(t *testing.T) {
+		// 2.5MB of css would never fit in 1MB uncompressed.
+		if err = gzipCache.SaveWithHeaders(cssURL, bytes.NewBuffer(css), cssHeader); err != nil {
+			t.Errorf("Couldn't save %s to the cache", cssURL.String())
+		}
+
+		stats := gzipCache.Stats()
+		if stats.LogicalBytes != int64(len(css)) {
+			t.Errorf("Size mismatch: cache should have size %d bytes but has size %d", len(css), stats.LogicalBytes)
+		}
+		if stats.MemoryBytes >= stats.MaxBytes {
+			t.Errorf("Compressed resource should be far smaller in memory, but uses %d bytes", stats.MemoryBytes)
+		}
+
+		buf, h, err := gzipCache.GetWithHeaders(cssURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", cssURL.String())
+		} else if !bytes.Equal(buf.Bytes(), css) || h.Get("Content-Encoding") != "" {
+			t.Errorf("Failed to retrieve %s from the cache", cssURL.String())
+		}
+	})
+
+	t.Run("Other resources are stored as is", func(t *testing.T) {
+		pngHeader := http.Header{}
+		pngHeader.Set("Content-Type", "image/png")
+		png := bytes.NewBuffer(bytes.Repeat([]byte("png"), 1000))
+		if err = gzipCache.SaveWithHeaders(testURL200, png, pngHeader); err != nil {
+			t.Errorf("Couldn't save %s to the cache", testURL200.String())
+		}
+
+		buf, err := gzipCache.Get(testURL200)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", testURL200.String())
+		}
+		if buf != png {
+			t.Errorf("Failed to retrieve %s from the cache", testURL200.String())
+		}
+	})
+
+	t.Run("Compressed resources reload from disk", func(t *testing.T) {
+		// Close the cache, letting the disk save run, to reload it.
+		gzipCache.Close()
+
+		reloaded, _ := newTestCache(t, config)
+		buf, err := reloaded.Get(cssURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the reloaded cache", cssURL.String())
+		} else if !bytes.Equal(buf.Bytes(), css) {
+			t.Errorf("Failed to retrieve %s from the reloaded cache", cssURL.String())
+		}
+		if reloaded.Stats().LogicalBytes != gzipCache.Stats().LogicalBytes {
+			t.Errorf("Size mismatch: reloaded cache has size %d", reloaded.Stats().LogicalBytes)
+		}
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage encrypted at rest, item expiry of an hour
+	// (so nothing expires - testing purposes), all mounted at the same mount path.
+	mountPath := t.TempDir()
+	oldKey := "000102030405060708090a0b0c0d0e0f"
+	newKey := "101112131415161718191a1b1c1d1e1f101112131415161718191a1b1c1d1e1f"
+	otherKey := "f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff"
+	newCache := func(t *testing.T, keys string) (c cache.Cache) {
+		keyring, err := cache.ParseKeyring(keys)
+		if err != nil {
+			t.Fatalf("Couldn't parse keys: %v", err)
+		}
+		c, _ = newTestCache(t, cache.Config{MountPath: mountPath, Keyring: keyring})
+		return c
+	}
+
+	secretURL := url.URL{Scheme: "http", Host: "example.com", Path: "/account"}
+	secret := []byte("account number 1234")
+	h := http.Header{}
+	h.Set("Set-Cookie", "session=hunter2")
+
+	t.Run("Nothing is written to disk in plaintext", func(t *testing.T) {
+		encryptedCache := newCache(t, oldKey)
+		if err := encryptedCache.SaveWithHeaders(secretURL, bytes.NewBuffer(secret), h); err != nil {
+			t.Errorf("Couldn't save %s to the cache", secretURL.String())
+		}
+
+		// Wait for the disk save to run.
+		encryptedCache.Flush()
+
+		files, err := ioutil.ReadDir(mountPath)
+		if err != nil || len(files) == 0 {
+			t.Error("Found nothing on disk")
+		}
+		for _, file := range files {
+			contents, err := ioutil.ReadFile(filepath.Join(mountPath, file.Name()))
+			if err != nil {
+				t.Errorf("Couldn't read %s", file.Name())
+			}
+			if bytes.Contains(contents, secret) || bytes.Contains(contents, []byte("hunter2")) {
+				t.Errorf("%s holds plaintext", file.Name())
+			}
+			if strings.Contains(file.Name(), "account") || file.Name() == cache.ToBlobDiskString(secret) {
+				t.Errorf("%s names what it holds", file.Name())
+			}
+		}
+	})
+
+	t.Run("Rotated keys still load, and re-seal under the new key", func(t *testing.T) {
+		rotatedCache := newCache(t, newKey+","+oldKey)
+		buf, h, err := rotatedCache.GetWithHeaders(secretURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", secretURL.String())
+		} else if !bytes.Equal(buf.Bytes(), secret) || h.Get("Set-Cookie") != "session=hunter2" {
+			t.Errorf("Failed to retrieve %s from the cache", secretURL.String())
+		}
+
+		// Close the cache, letting the re-sealing run, then drop the old key.
+		rotatedCache.Close()
+
+		newKeyCache := newCache(t, newKey)
+		if _, err = newKeyCache.Get(secretURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache with the new key only", secretURL.String())
+		}
+
+		// The files under the names keyed with the old key are gone.
+		files, _ := ioutil.ReadDir(mountPath)
+		headers := 0
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), "-h-e-a-d-e-r-") {
+				headers++
+			}
+		}
+		if headers != 1 {
+			t.Errorf("Found %d header files on disk, instead of 1", headers)
+		}
+	})
+
+	t.Run("Entries that fail authentication are refused", func(t *testing.T) {
+		otherCache := newCache(t, otherKey)
+		if _, err := otherCache.Get(secretURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found resource in cache that should have failed authentication")
+		}
+		if otherCache.Stats().RejectedEntries == 0 {
+			t.Error("Cache should have counted rejected entries")
+		}
+	})
+}
+
+// corruptFile flips a byte in the middle of the file at path.
+func corruptFile(path string) (err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	contents[len(contents)/2] ^= 0xff
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+func TestScrub(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes), all mounted at the same mount path.
+	mountPath := t.TempDir()
+	config := cache.Config{MountPath: mountPath}
+	firstURL := url.URL{Path: "/first"}
+	firstBody := bytes.Repeat([]byte("first"), 1000)
+	secondURL := url.URL{Path: "/second"}
+	secondBody := bytes.Repeat([]byte("second"), 1000)
+
+	t.Run("Corrupt bodies are quarantined instead of loaded", func(t *testing.T) {
+		firstCache, _ := newTestCache(t, config)
+		if err := firstCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", firstURL.String())
+		}
+
+		// Close the cache, letting the disk save run, then corrupt what it saved.
+		firstCache.Close()
+		if err := corruptFile(filepath.Join(mountPath, cache.ToBlobDiskString(firstBody))); err != nil {
+			t.Error("Couldn't corrupt blob file")
+		}
+
+		reloaded, _ := newTestCache(t, config)
+		if _, err := reloaded.Get(firstURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found corrupt resource in cache")
+		}
+		if reloaded.Stats().CorruptFiles != 1 {
+			t.Errorf("Cache should have found 1 corrupt file but found %d", reloaded.Stats().CorruptFiles)
+		}
+
+		// Wait for the quarantine to be written.
+		reloaded.Flush()
+		fipath := filepath.Join(mountPath, "quarantine", cache.ToBlobDiskString(firstBody))
+		if _, err := os.Stat(fipath); os.IsNotExist(err) {
+			t.Errorf("%s was not quarantined", cache.ToBlobDiskString(firstBody))
+		}
+	})
+
+	t.Run("The scrubber quarantines corrupt files and repairs them from memory", func(t *testing.T) {
+		scrubConfig := config
+		scrubConfig.ScrubInterval = 100 * time.Millisecond
+		scrubCache, _ := newTestCache(t, scrubConfig)
+		if err := scrubCache.Save(secondURL, bytes.NewBuffer(secondBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", secondURL.String())
+		}
+
+		// Wait for the disk save to run, then corrupt it and give the scrubber time to notice.
+		scrubCache.Flush()
+		blobPath := filepath.Join(mountPath, cache.ToBlobDiskString(secondBody))
+		if err := corruptFile(blobPath); err != nil {
+			t.Error("Couldn't corrupt blob file")
+		}
+		time.Sleep(time.Second)
+		scrubCache.Flush()
+
+		stats := scrubCache.Stats()
+		if stats.ScrubbedFiles == 0 || stats.CorruptFiles != 1 {
+			t.Errorf("Scrubber should have found 1 corrupt file but found %d in %d files", stats.CorruptFiles, stats.ScrubbedFiles)
+		}
+		fipath := filepath.Join(mountPath, "quarantine", cache.ToBlobDiskString(secondBody))
+		if _, err := os.Stat(fipath); os.IsNotExist(err) {
+			t.Errorf("%s was not quarantined", cache.ToBlobDiskString(secondBody))
+		}
+		if contents, err := ioutil.ReadFile(blobPath); err != nil || !bytes.Equal(contents, secondBody) {
+			t.Errorf("%s was not repaired", cache.ToBlobDiskString(secondBody))
+		}
+	})
+}
+
+func TestStore(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{MountPath: mountPath}
+	firstURL := url.URL{Path: "/first"}
+	firstBody := bytes.Repeat([]byte("first"), 1000)
+	secondURL := url.URL{Path: "/second"}
+	secondBody := bytes.Repeat([]byte("second"), 1000)
+
+	// saveAndReload saves both urls to a cache persisting to firstStore, then
+	// checks that a new cache loads both from the store returned by reopen.
+	saveAndReload := func(t *testing.T, firstStore cache.Store, reopen func() cache.Store) {
+		storeConfig := config
+		storeConfig.Store = firstStore
+		firstCache, _ := newTestCache(t, storeConfig)
+		if err = firstCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", firstURL.String())
+		}
+		if err = firstCache.Save(secondURL, bytes.NewBuffer(secondBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", secondURL.String())
+		}
+
+		// Wait for the disk save to run.
+		firstCache.Flush()
+		for _, name := range []string{cache.ToHeaderDiskString(firstURL), cache.ToBlobDiskString(firstBody), cache.ToBlobDiskString(secondBody)} {
+			if _, err = firstStore.Stat(name); err != nil {
+				t.Errorf("%s was not saved to the store", name)
+			}
+		}
+
+		firstCache.Close()
+		storeConfig.Store = reopen()
+		reloaded, _ := newTestCache(t, storeConfig)
+		for _, u := range []url.URL{firstURL, secondURL} {
+			if _, err = reloaded.Get(u); err != nil {
+				t.Errorf("Couldn't load %s from the store", u.String())
+			}
+		}
+	}
+
+	t.Run("Caches persist to and load from an in-memory store", func(t *testing.T) {
+		store := cache.NewMemoryStore()
+		saveAndReload(t, store, func() cache.Store { return store })
+	})
+
+	t.Run("Caches persist to and load from a log store", func(t *testing.T) {
+		store, err := cache.NewLogStore(mountPath)
+		if err != nil {
+			t.Error("Couldn't open log store")
+		}
+		saveAndReload(t, store, func() cache.Store {
+			if err = store.Close(); err != nil {
+				t.Error("Couldn't close log store")
+			}
+			reopened, err := cache.NewLogStore(mountPath)
+			if err != nil {
+				t.Error("Couldn't reopen log store")
+			}
+			return reopened
+		})
+		if _, err = os.Stat(filepath.Join(mountPath, cache.ToHeaderDiskString(firstURL))); !os.IsNotExist(err) {
+			t.Error("Log store wrote a file per header")
+		}
+	})
+
+	t.Run("A log store survives a torn write", func(t *testing.T) {
+		logPath := filepath.Join(mountPath, "torn")
+		store, err := cache.NewLogStore(logPath)
+		if err != nil {
+			t.Error("Couldn't open log store")
+		}
+		if err = store.Put("first", firstBody); err != nil {
+			t.Error("Couldn't put to log store")
+		}
+		if err = store.Put("second", secondBody); err != nil {
+			t.Error("Couldn't put to log store")
+		}
+		if err = store.Delete("first"); err != nil {
+			t.Error("Couldn't delete from log store")
+		}
+		store.Close()
+
+		// Chop the end off the log, as if we crashed while appending the delete.
+		fipath := filepath.Join(logPath, "segment-00000001.log")
+		stat, err := os.Stat(fipath)
+		if err != nil {
+			t.Error("Couldn't find log file")
+		}
+		if err = os.Truncate(fipath, stat.Size()-2); err != nil {
+			t.Error("Couldn't truncate log file")
+		}
+
+		reopened, err := cache.NewLogStore(logPath)
+		if err != nil {
+			t.Error("Couldn't reopen log store")
+		}
+		defer reopened.Close()
+		if contents, err := reopened.Get("first"); err != nil || !bytes.Equal(contents, firstBody) {
+			t.Error("Lost a file logged before the torn write")
+		}
+		if contents, err := reopened.Get("second"); err != nil || !bytes.Equal(contents, secondBody) {
+			t.Error("Lost a file logged before the torn write")
+		}
+		if err = reopened.Delete("second"); err != nil {
+			t.Error("Couldn't delete from log store after a torn write")
+		}
+		if names, _ := reopened.List(); len(names) != 1 || names[0] != "first" {
+			t.Errorf("Log store should hold only first but holds %v", names)
+		}
+	})
+
+	t.Run("Compaction reclaims overwritten and deleted records", func(t *testing.T) {
+		logPath := filepath.Join(mountPath, "compact")
+		store, err := cache.NewLogStoreWithConfig(logPath, cache.LogConfig{SegmentSize: 20000})
+		if err != nil {
+			t.Error("Couldn't open log store")
+		}
+
+		// Overwrite first over and over, spilling into new segments, and delete second.
+		if err = store.Put("second", secondBody); err != nil {
+			t.Error("Couldn't put to log store")
+		}
+		for i := 0; i < 20; i++ {
+			if err = store.Put("first", append(firstBody, byte(i))); err != nil {
+				t.Error("Couldn't put to log store")
+			}
+		}
+		if err = store.Delete("second"); err != nil {
+			t.Error("Couldn't delete from log store")
+		}
+		for i := 0; i < 5; i++ {
+			if err = store.Put("first", firstBody); err != nil {
+				t.Error("Couldn't put to log store")
+			}
+		}
+		segments, _ := filepath.Glob(filepath.Join(logPath, "segment-*.log"))
+
+		reclaimed, err := store.Compact()
+		if err != nil {
+			t.Error("Couldn't compact log store")
+		}
+		compacted, _ := filepath.Glob(filepath.Join(logPath, "segment-*.log"))
+		if reclaimed == 0 || len(compacted) >= len(segments) {
+			t.Errorf("Compaction reclaimed %d bytes and left %d of %d segments", reclaimed, len(compacted), len(segments))
+		}
+		store.Close()
+
+		// The index should come back from the hint files just the same.
+		reopened, err := cache.NewLogStoreWithConfig(logPath, cache.LogConfig{SegmentSize: 20000})
+		if err != nil {
+			t.Error("Couldn't reopen log store")
+		}
+		defer reopened.Close()
+		if contents, err := reopened.Get("first"); err != nil || !bytes.Equal(contents, firstBody) {
+			t.Error("Lost a live file to compaction")
+		}
+		if _, err = reopened.Get("second"); !os.IsNotExist(err) {
+			t.Error("A deleted file came back after compaction")
+		}
+	})
+}
+
+func TestLazy(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{MountPath: mountPath}
+	firstURL := url.URL{Path: "/first"}
+	firstBody := bytes.Repeat([]byte("first"), 1000)
+	secondURL := url.URL{Path: "/second"}
+	secondBody := bytes.Repeat([]byte("second"), 1000)
+
+	firstCache, _ := newTestCache(t, config)
+	if err = firstCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+		t.Errorf("Couldn't save %s to the cache", firstURL.String())
+	}
+	if err = firstCache.Save(secondURL, bytes.NewBuffer(secondBody)); err != nil {
+		t.Errorf("Couldn't save %s to the cache", secondURL.String())
+	}
+
+	// Close the cache, letting the disk save run, to reload it.
+	firstCache.Close()
+
+	t.Run("Lazy caches leave bodies on disk until they are asked for", func(t *testing.T) {
+		lazyConfig := config
+		lazyConfig.Lazy = true
+		lazyCache, _ := newTestCache(t, lazyConfig)
+		select {
+		case <-lazyCache.Ready():
+		default:
+			t.Error("Cache that doesn't warm up wasn't ready straight away")
+		}
+		stats := lazyCache.Stats()
+		if stats.Entries != 2 || stats.ColdBodies != 2 {
+			t.Errorf("Cache should have 2 entries with 2 cold bodies but has %d with %d", stats.Entries, stats.ColdBodies)
+		}
+		if stats.MemoryBytes != firstCache.Stats().MemoryBytes {
+			t.Errorf("Cold bodies should count as %d bytes but count as %d", firstCache.Stats().MemoryBytes, stats.MemoryBytes)
+		}
+
+		fi, err := lazyCache.Get(firstURL)
+		if err != nil || !bytes.Equal(fi.Bytes(), firstBody) {
+			t.Errorf("Couldn't get %s from the cache", firstURL.String())
+		}
+		if lazyCache.Stats().ColdBodies != 1 {
+			t.Errorf("Cache should have 1 cold body but has %d", lazyCache.Stats().ColdBodies)
+		}
+	})
+
+	t.Run("Lazy caches drop resources whose bodies turn out to be corrupt", func(t *testing.T) {
+		lazyConfig := config
+		lazyConfig.Lazy = true
+		lazyCache, _ := newTestCache(t, lazyConfig)
+		if err = corruptFile(filepath.Join(mountPath, cache.ToBlobDiskString(secondBody))); err != nil {
+			t.Error("Couldn't corrupt blob file")
+		}
+		if _, err = lazyCache.Get(secondURL); err != cache.ErrResourceNotInCache {
+			t.Error("Got a corrupt resource from the cache")
+		}
+		if stats := lazyCache.Stats(); stats.Entries != 1 || stats.CorruptFiles != 1 {
+			t.Errorf("Cache should have 1 entry and 1 corrupt file but has %d and %d", stats.Entries, stats.CorruptFiles)
+		}
+	})
+
+	t.Run("Warm caches read bodies in the background and report when they're done", func(t *testing.T) {
+		warmConfig := config
+		warmConfig.Lazy, warmConfig.Warm = true, true
+		warmCache, _ := newTestCache(t, warmConfig)
+		select {
+		case <-warmCache.Ready():
+		case <-time.After(time.Second):
+			t.Error("Cache didn't warm up")
+		}
+		if stats := warmCache.Stats(); stats.ColdBodies != 0 {
+			t.Errorf("Warm cache should have no cold bodies but has %d", stats.ColdBodies)
+		}
+	})
+}
+
+func TestManifest(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{
+		Policy:     "LRU",
+		Size:       1,
+		Expiration: time.Duration(time.Hour * 1),
+		MountPath:  mountPath,
+	}
+	manifestPath := filepath.Join(mountPath, "manifest.json")
+
+	t.Run("New mount paths get a manifest", func(t *testing.T) {
+		newTestCache(t, config)
+		contents, err := ioutil.ReadFile(manifestPath)
+		if err != nil || string(contents) != `{"version":2,"store":"dir"}` {
+			t.Errorf("Found manifest %q", contents)
+		}
+	})
+
+	t.Run("Mount paths in a newer or unknown format are refused", func(t *testing.T) {
+		if err = ioutil.WriteFile(manifestPath, []byte(`{"version":99}`), 0644); err != nil {
+			t.Error("Couldn't write manifest")
+		}
+		if _, err = cache.NewWithConfig(config); err != cache.ErrNewerFormat {
+			t.Error("Opened a mount path in a newer format")
+		}
+		if err = ioutil.WriteFile(manifestPath, []byte("garbage"), 0644); err != nil {
+			t.Error("Couldn't write manifest")
+		}
+		if _, err = cache.NewWithConfig(config); err != cache.ErrBadManifest {
+			t.Error("Opened a mount path with a garbled manifest")
+		}
+	})
+
+	t.Run("Mount paths written through another store are refused", func(t *testing.T) {
+		if err = ioutil.WriteFile(manifestPath, []byte(`{"version":2,"store":"log"}`), 0644); err != nil {
+			t.Error("Couldn't write manifest")
+		}
+		if _, err = cache.NewWithConfig(config); err != cache.ErrWrongStore {
+			t.Error("Opened a log store mount path as a directory")
+		}
+	})
+
+	t.Run("Mount paths from before manifests are migrated", func(t *testing.T) {
+		// Lay out a version 1 entry: a bare gob-encoded http.Header and a body file named after the url.
+		legacyURL := url.URL{Path: "/legacy"}
+		body := []byte("legacy")
+		var encoded bytes.Buffer
+		if err = gob.NewEncoder(&encoded).Encode(http.Header{}); err != nil {
+			t.Error("Couldn't encode headers")
+		}
+		if err = os.Remove(manifestPath); err != nil {
+			t.Error("Couldn't remove manifest")
+		}
+		if err = ioutil.WriteFile(filepath.Join(mountPath, cache.ToDiskString(legacyURL)), body, 0644); err != nil {
+			t.Error("Couldn't write legacy body file")
+		}
+		if err = ioutil.WriteFile(filepath.Join(mountPath, cache.ToHeaderDiskString(legacyURL)), encoded.Bytes(), 0644); err != nil {
+			t.Error("Couldn't write legacy header file")
+		}
+
+		readOnlyConfig := config
+		readOnlyConfig.ReadOnly = true
+		if _, err = cache.NewWithConfig(readOnlyConfig); err != cache.ErrNeedsMigration {
+			t.Error("Opened a mount path needing migration read-only")
+		}
+
+		migrated, _ := newTestCache(t, config)
+		if fi, err := migrated.Get(legacyURL); err != nil || !bytes.Equal(fi.Bytes(), body) {
+			t.Errorf("Couldn't get %s from the cache", legacyURL.String())
+		}
+		if _, err = os.Stat(filepath.Join(mountPath, cache.ToDiskString(legacyURL))); !os.IsNotExist(err) {
+			t.Errorf("%s was found on disk, but should have been migrated", cache.ToDiskString(legacyURL))
+		}
+		contents, err := ioutil.ReadFile(manifestPath)
+		if err != nil || string(contents) != `{"version":2,"store":"dir"}` {
+			t.Errorf("Found manifest %q", contents)
+		}
+	})
+}
+
+func TestCollect(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{MountPath: mountPath}
+	firstURL := url.URL{Path: "/first"}
+	firstBody := bytes.Repeat([]byte("first"), 1000)
+	orphanURL := url.URL{Path: "/orphan"}
+	orphanBody := bytes.Repeat([]byte("orphan"), 1000)
+
+	firstCache, _ := newTestCache(t, config)
+	if err = firstCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+		t.Errorf("Couldn't save %s to the cache", firstURL.String())
+	}
+	if err = firstCache.Save(orphanURL, bytes.NewBuffer(orphanBody)); err != nil {
+		t.Errorf("Couldn't save %s to the cache", orphanURL.String())
+	}
+
+	// Close the cache, letting the disk save run, to reload it.
+	firstCache.Close()
+
+	t.Run("Stray files are removed at startup", func(t *testing.T) {
+		// Leave a half written file, and a header file whose body has gone missing.
+		if err = ioutil.WriteFile(filepath.Join(mountPath, "-t-m-p-123"), []byte("half written"), 0644); err != nil {
+			t.Error("Couldn't write temporary file")
+		}
+		if err = os.Remove(filepath.Join(mountPath, cache.ToBlobDiskString(orphanBody))); err != nil {
+			t.Error("Couldn't remove blob file")
+		}
+		header, err := os.Stat(filepath.Join(mountPath, cache.ToHeaderDiskString(orphanURL)))
+		if err != nil {
+			t.Error("Couldn't find header file")
+		}
+
+		reloaded, _ := newTestCache(t, config)
+		stats := reloaded.Stats()
+		if stats.CollectedFiles != 2 || stats.ReclaimedBytes != header.Size()+int64(len("half written")) {
+			t.Errorf("Cache should have collected 2 files of %d bytes but collected %d of %d",
+				header.Size()+int64(len("half written")), stats.CollectedFiles, stats.ReclaimedBytes)
+		}
+		for _, name := range []string{"-t-m-p-123", cache.ToHeaderDiskString(orphanURL)} {
+			if _, err = os.Stat(filepath.Join(mountPath, name)); !os.IsNotExist(err) {
+				t.Errorf("%s was not removed", name)
+			}
+		}
+		if _, err = reloaded.Get(firstURL); err != nil {
+			t.Errorf("Couldn't get %s from the cache", firstURL.String())
+		}
+	})
+
+	t.Run("Collect removes bodies nothing refers to", func(t *testing.T) {
+		collectCache, _ := newTestCache(t, config)
+		fipath := filepath.Join(mountPath, cache.ToBlobDiskString(orphanBody))
+		if err = ioutil.WriteFile(fipath, orphanBody, 0644); err != nil {
+			t.Error("Couldn't write blob file")
+		}
+		reclaimed, err := collectCache.Collect()
+		if err != nil || reclaimed != int64(len(orphanBody)) {
+			t.Errorf("Collect should have reclaimed %d bytes but reclaimed %d", len(orphanBody), reclaimed)
+		}
+		if _, err = os.Stat(fipath); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", cache.ToBlobDiskString(orphanBody))
+		}
+		for _, name := range []string{cache.ToHeaderDiskString(firstURL), cache.ToBlobDiskString(firstBody)} {
+			if _, err = os.Stat(filepath.Join(mountPath, name)); err != nil {
+				t.Errorf("%s was removed, but is still in the cache", name)
+			}
+		}
+	})
+
+	t.Run("Resources that don't fit are kept on disk at startup", func(t *testing.T) {
+		bigConfig := cache.Config{Size: 2, MountPath: t.TempDir()}
+		bigCache, _ := newTestCache(t, bigConfig)
+		var bigURLs []url.URL
+		for i := 0; i < 3; i++ {
+			bigURL := url.URL{Path: "/big" + strconv.Itoa(i)}
+			if err = bigCache.Save(bigURL, bytes.NewBuffer(bytes.Repeat([]byte{byte(i)}, 400000))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", bigURL.String())
+			}
+			bigURLs = append(bigURLs, bigURL)
+		}
+		bigCache.Close()
+
+		// Only two of them fit in 1MB.
+		smallConfig := bigConfig
+		smallConfig.Size = 1
+		smallCache, _ := newTestCache(t, smallConfig)
+		if stats := smallCache.Stats(); stats.CollectedFiles != 0 {
+			t.Errorf("Cache collected %d files it had no room for", stats.CollectedFiles)
+		}
+		smallCache.Close()
+
+		bigCache, _ = newTestCache(t, bigConfig)
+		for _, bigURL := range bigURLs {
+			if _, err = bigCache.Get(bigURL); err != nil {
+				t.Errorf("%s was removed from disk", bigURL.String())
+			}
+		}
+	})
+}
+
+// failingStore is a store that fails to save bodies, as if the disk were full.
+type failingStore struct {
+	cache.Store
+}
+
+// Put implements cache.Store.Put for a failingStore.
+func (store failingStore) Put(name string, contents []byte) (err error) {
+	if strings.HasPrefix(name, "-b-l-o-b-") {
+		return errors.New("No space left on device")
+	}
+	return store.Store.Put(name, contents)
+}
+
+func TestIOErrors(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{MountPath: mountPath}
+	firstURL := url.URL{Path: "/first"}
+	firstBody := bytes.Repeat([]byte("first"), 1000)
+
+	t.Run("Failed saves are reported, and leave resources in memory only", func(t *testing.T) {
+		ioErrors := make(chan error, 1)
+		failingConfig := config
+		failingConfig.Store = failingStore{cache.NewMemoryStore()}
+		failingConfig.OnIOError = func(err error) { ioErrors <- err }
+		failingCache, _ := newTestCache(t, failingConfig)
+		if err = failingCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", firstURL.String())
+		}
+
+		select {
+		case err := <-ioErrors:
+			if ioErr, ok := err.(*cache.IOError); !ok || ioErr.Op != "write" || ioErr.Name != cache.ToBlobDiskString(firstBody) {
+				t.Errorf("Got unexpected error %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Failed save wasn't reported")
+		}
+		if stats := failingCache.Stats(); stats.IOErrors != 1 || stats.MemoryOnlyEntries != 1 {
+			t.Errorf("Cache should have 1 I/O error and 1 memory only entry but has %d and %d", stats.IOErrors, stats.MemoryOnlyEntries)
+		}
+		if _, err = failingCache.Get(firstURL); err != nil {
+			t.Errorf("Couldn't get %s from the cache", firstURL.String())
+		}
+	})
+
+	t.Run("Caches keep clear of a filesystem that's running low", func(t *testing.T) {
+		firstCache, _ := newTestCache(t, config)
+		if err = firstCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != nil {
+			t.Errorf("Couldn't save %s to the cache", firstURL.String())
+		}
+
+		// Close the cache, letting the disk save run, to reload it.
+		firstCache.Close()
+
+		// Ask for more free space than any disk has, so there's no room at all.
+		lowConfig := config
+		lowConfig.MinFreeDisk = 1 << 30
+		lowConfig.DiskCheckInterval = 10 * time.Millisecond
+		lowCache, _ := newTestCache(t, lowConfig)
+		stats := lowCache.Stats()
+		if stats.Entries != 0 || stats.DiskBudget != 0 || stats.FreeDiskBytes == 0 {
+			t.Errorf("Cache should be empty with no disk budget but has %d entries and a budget of %d", stats.Entries, stats.DiskBudget)
+		}
+		if err = lowCache.Save(firstURL, bytes.NewBuffer(firstBody)); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saved %s to a cache with no disk budget", firstURL.String())
+		}
+	})
+
+	t.Run("Mount paths on the same disk share its free space", func(t *testing.T) {
+		singleCache, _ := newTestCache(t, cache.Config{MinFreeDisk: 1})
+		single := singleCache.Stats().FreeDiskBytes
+		sharedDir := t.TempDir()
+		sharedConfig := cache.Config{
+			MinFreeDisk: 1,
+			MountPaths:  []cache.MountPoint{{Path: filepath.Join(sharedDir, "a")}, {Path: filepath.Join(sharedDir, "b")}},
+		}
+		sharedCache, _ := newTestCache(t, sharedConfig)
+		if shared := sharedCache.Stats().FreeDiskBytes; shared > single+single/2 {
+			t.Errorf("Cache counted its disk's %d free bytes twice, making %d", single, shared)
+		}
+	})
+
+	t.Run("Free space isn't checked without a mount path", func(t *testing.T) {
+		newTestCache(t, cache.Config{Store: cache.NewMemoryStore(), MinFreeDisk: 1})
+	})
+}
+
+func TestWriteQueue(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	// Queues are kept short and writes batched, to give both a workout.
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{
+		Workers:    2,
+		QueueDepth: 1,
+		SyncBatch:  8,
+	}
+	firstURL := url.URL{Path: "/first"}
+
+	// flushAndReload saves a bunch of urls, then the same url over and over, and
+	// checks that once Flush returns, everything is on disk and the last save won.
+	flushAndReload := func(t *testing.T, config cache.Config, store cache.Store, reopen func() cache.Store) {
+		config.Store = store
+		firstCache, _ := newTestCache(t, config)
+		var urls []url.URL
+		for i := 0; i < 50; i++ {
+			u := url.URL{Path: "/" + strconv.Itoa(i)}
+			if err = firstCache.Save(u, bytes.NewBuffer([]byte(u.Path))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+			urls = append(urls, u)
+		}
+		var lastBody []byte
+		for i := 0; i < 20; i++ {
+			lastBody = bytes.Repeat([]byte{byte('a' + i)}, 1000)
+			if err = firstCache.Save(firstURL, bytes.NewBuffer(lastBody)); err != nil {
+				t.Errorf("Couldn't save %s to the cache", firstURL.String())
+			}
+		}
+
+		// No sleeping: once Flush returns, it's all on disk.
+		if err = firstCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+		for _, u := range urls {
+			if _, err = store.Stat(cache.ToHeaderDiskString(u)); err != nil {
+				t.Errorf("Header of %s wasn't on disk after a flush", u.String())
+			}
+			if _, err = store.Stat(cache.ToBlobDiskString([]byte(u.Path))); err != nil {
+				t.Errorf("Body of %s wasn't on disk after a flush", u.String())
+			}
+		}
+
+		firstCache.Close()
+		config.Store = reopen()
+		secondCache, _ := newTestCache(t, config)
+		if stats := secondCache.Stats(); stats.Entries != len(urls)+1 {
+			t.Errorf("Cache should have loaded %d entries but has %d", len(urls)+1, stats.Entries)
+		}
+		if fi, err := secondCache.Get(firstURL); err != nil || !bytes.Equal(fi.Bytes(), lastBody) {
+			t.Errorf("Cache should have loaded the last body saved at %s", firstURL.String())
+		}
+	}
+
+	t.Run("Flush waits for everything to reach a directory store", func(t *testing.T) {
+		dirConfig := config
+		dirConfig.MountPath = filepath.Join(mountPath, "dir")
+		if err = os.MkdirAll(dirConfig.MountPath, os.ModePerm); err != nil {
+			t.Error("Couldn't create directory store directory")
+		}
+		store, err := cache.NewDirStore(dirConfig.MountPath)
+		if err != nil {
+			t.Error("Couldn't open directory store")
+		}
+		flushAndReload(t, dirConfig, store, func() cache.Store { return store })
+	})
+
+	t.Run("Flush waits for everything to reach a log store", func(t *testing.T) {
+		logConfig := config
+		logConfig.MountPath = filepath.Join(mountPath, "log")
+		if err = os.MkdirAll(logConfig.MountPath, os.ModePerm); err != nil {
+			t.Error("Couldn't create log store directory")
+		}
+		store, err := cache.NewLogStore(logConfig.MountPath)
+		if err != nil {
+			t.Error("Couldn't open log store")
+		}
+		flushAndReload(t, logConfig, store, func() cache.Store {
+			if err = store.Close(); err != nil {
+				t.Error("Couldn't close log store")
+			}
+			reopened, err := cache.NewLogStore(logConfig.MountPath)
+			if err != nil {
+				t.Error("Couldn't reopen log store")
+			}
+			return reopened
+		})
+	})
+}
+
+// brokenStore is a store that fails at everything once broken is set,
+// as if its disk had been pulled out.
+type brokenStore struct {
+	cache.Store
+	broken *bool
+}
+
+// errBroken is what a broken brokenStore fails with.
+var errBroken = errors.New("Input/output error")
+
+// Put implements cache.Store.Put for a brokenStore.
+func (store brokenStore) Put(name string, contents []byte) (err error) {
+	if *store.broken {
+		return errBroken
+	}
+	return store.Store.Put(name, contents)
+}
+
+// Get implements cache.Store.Get for a brokenStore.
+func (store brokenStore) Get(name string) (contents []byte, err error) {
+	if *store.broken {
+		return nil, errBroken
+	}
+	return store.Store.Get(name)
+}
+
+// Delete implements cache.Store.Delete for a brokenStore.
+func (store brokenStore) Delete(name string) (err error) {
+	if *store.broken {
+		return errBroken
+	}
+	return store.Store.Delete(name)
+}
+
+// List implements cache.Store.List for a brokenStore.
+func (store brokenStore) List() (names []string, err error) {
+	if *store.broken {
+		return nil, errBroken
+	}
+	return store.Store.List()
+}
+
+// Stat implements cache.Store.Stat for a brokenStore.
+func (store brokenStore) Stat(name string) (size int64, err error) {
+	if *store.broken {
+		return 0, errBroken
+	}
+	return store.Store.Stat(name)
+}
+
+func TestStripes(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	var urls []url.URL
+	for i := 0; i < 100; i++ {
+		urls = append(urls, url.URL{Path: "/" + strconv.Itoa(i)})
+	}
+
+	t.Run("Files are spread across mount paths by weight", func(t *testing.T) {
+		light, heavy := filepath.Join(mountPath, "light"), filepath.Join(mountPath, "heavy")
+		stripedConfig := cache.Config{MountPaths: []cache.MountPoint{{Path: light, Weight: 1}, {Path: heavy, Weight: 3}}}
+		firstCache, _ := newTestCache(t, stripedConfig)
+		for _, u := range urls {
+			if err = firstCache.Save(u, bytes.NewBuffer([]byte(u.Path))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+		if err = firstCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+
+		inLight, inHeavy := 0, 0
+		for _, u := range urls {
+			if _, err = os.Stat(filepath.Join(light, cache.ToHeaderDiskString(u))); err == nil {
+				inLight++
+			}
+			if _, err = os.Stat(filepath.Join(heavy, cache.ToHeaderDiskString(u))); err == nil {
+				inHeavy++
+			}
+		}
+		if inLight+inHeavy != len(urls) || inLight == 0 || inHeavy <= inLight {
+			t.Errorf("Header files should be spread about 1:3 but %d and %d were", inLight, inHeavy)
+		}
+
+		firstCache.Close()
+		secondCache, _ := newTestCache(t, stripedConfig)
+
+		if stats := secondCache.Stats(); stats.Entries != len(urls) {
+			t.Errorf("Cache should have loaded %d entries but has %d", len(urls), stats.Entries)
+		}
+	})
+
+	t.Run("Caches carry on without a mount path that fails", func(t *testing.T) {
+		broken := false
+		store, err := cache.NewStripedStore([]cache.Stripe{
+			{Store: cache.NewMemoryStore()},
+			{Store: brokenStore{cache.NewMemoryStore(), &broken}},
+		})
+		if err != nil {
+			t.Error("Couldn't open striped store")
+		}
+		ioErrors := make(chan error, 10)
+		stripedCache, _ := newTestCache(t, cache.Config{
+			Store:               store,
+			OnIOError:           func(err error) { ioErrors <- err },
+			StripeProbeInterval: 50 * time.Millisecond,
+		})
+		for _, u := range urls[:50] {
+			if err = stripedCache.Save(u, bytes.NewBuffer([]byte(u.Path))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+		if err = stripedCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+
+		// Pull the second disk out; saves carry on, onto the first.
+		broken = true
+		for _, u := range urls[50:] {
+			if err = stripedCache.Save(u, bytes.NewBuffer([]byte(u.Path))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+		if err = stripedCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+		select {
+		case err := <-ioErrors:
+			if ioErr, ok := err.(*cache.IOError); !ok || ioErr.Op != "mount" || ioErr.Err != errBroken {
+				t.Errorf("Got unexpected error %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Error("Failed mount path wasn't reported")
+		}
+		for _, u := range urls[50:] {
+			if _, err = store.Stat(cache.ToHeaderDiskString(u)); err != nil {
+				t.Errorf("Header of %s wasn't saved to the mount path that's left", u.String())
+			}
+		}
+
+		// Half the cache went with the disk.
+		stats := stripedCache.Stats()
+		if stats.MountPathsDown != 1 || stats.MaxBytes != 500000 {
+			t.Errorf("Cache should have 1 mount path down and a max size of 500000 but has %d and %d", stats.MountPathsDown, stats.MaxBytes)
+		}
+		if fi, err := stripedCache.Get(urls[0]); err != nil || fi.String() != urls[0].Path {
+			t.Errorf("Couldn't get %s from the cache", urls[0].String())
+		}
+		bigURL := url.URL{Path: "/big"}
+		if err = stripedCache.Save(bigURL, bytes.NewBuffer(make([]byte, 600000))); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saved %s to a cache that lost half its size", bigURL.String())
+		}
+		if stats.MemoryOnlyEntries == 0 {
+			t.Error("Entries on the failed mount path weren't marked memory only")
+		}
+
+		// Plug it back in; it's put back to use, and what was only in memory is saved again.
+		broken = false
+		time.Sleep(200 * time.Millisecond)
+		if err = stripedCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+		stats = stripedCache.Stats()
+		if stats.MountPathsDown != 0 || stats.MaxBytes != 1000000 || stats.MemoryOnlyEntries != 0 {
+			t.Errorf("Cache should have no mount paths down, a max size of 1000000 and no memory only entries but has %d, %d and %d",
+				stats.MountPathsDown, stats.MaxBytes, stats.MemoryOnlyEntries)
+		}
+		for _, u := range urls {
+			if _, err = stripedCache.Get(u); err != nil {
+				// Evicted to fit in half the size.
+				continue
+			}
+			if _, err = store.Stat(cache.ToHeaderDiskString(u)); err != nil {
+				t.Errorf("Header of %s isn't on disk", u.String())
+			}
+		}
+	})
+
+	t.Run("Caches start without a mount path that fails", func(t *testing.T) {
+		// A mount path that can't be made, as a file is in the way of its parent.
+		blocked := filepath.Join(mountPath, "blocked")
+		if err = ioutil.WriteFile(blocked, nil, 0644); err != nil {
+			t.Error("Couldn't write file")
+		}
+		good, bad := filepath.Join(mountPath, "good"), filepath.Join(blocked, "bad")
+		stripedCache, _ := newTestCache(t, cache.Config{
+			MountPaths:          []cache.MountPoint{{Path: good}, {Path: bad}},
+			StripeProbeInterval: 50 * time.Millisecond,
+		})
+		if stats := stripedCache.Stats(); stats.MountPathsDown != 1 || stats.MaxBytes != 500000 {
+			t.Errorf("Cache should have 1 mount path down and a max size of 500000 but has %d and %d", stats.MountPathsDown, stats.MaxBytes)
+		}
+		for _, u := range urls {
+			if err = stripedCache.Save(u, bytes.NewBuffer([]byte(u.Path))); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+
+		// Clear the way, and the mount path is picked up.
+		if err = os.Remove(blocked); err != nil {
+			t.Error("Couldn't remove file")
+		}
+		if err = os.Mkdir(blocked, os.ModePerm); err != nil {
+			t.Error("Couldn't make directory")
+		}
+		time.Sleep(200 * time.Millisecond)
+		if err = stripedCache.Flush(); err != nil {
+			t.Errorf("Couldn't flush the cache: %v", err)
+		}
+		if stats := stripedCache.Stats(); stats.MountPathsDown != 0 || stats.MemoryOnlyEntries != 0 {
+			t.Errorf("Cache should have no mount paths down and no memory only entries but has %d and %d", stats.MountPathsDown, stats.MemoryOnlyEntries)
+		}
+		if _, err = os.Stat(filepath.Join(bad, "manifest.json")); err != nil {
+			t.Error("Mount path that came back has no manifest")
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+	var err error
+
+	firstURL, secondURL, thirdURL := url.URL{Path: "/first"}, url.URL{Path: "/second"}, url.URL{Path: "/third"}
+	textBody := []byte(strings.Repeat("some text to squeeze ", 500))
+	h := http.Header{"Content-Type": {"text/plain"}}
+
+	t.Run("Imports restore everything that was exported", func(t *testing.T) {
+		firstCache, _ := newTestCache(t, cache.Config{
+			MountPath:   filepath.Join(mountPath, "first"),
+			Compression: cache.CompressionGzip,
+			Pinned:      []url.URL{thirdURL},
+		})
+		if err = firstCache.SaveWithHeaders(firstURL, bytes.NewBuffer(textBody), h); err != nil {
+			t.Errorf("Couldn't save %s to the cache", firstURL.String())
+		}
+		if err = firstCache.SaveWithTTL(secondURL, bytes.NewBuffer(textBody), h, time.Hour); err != nil {
+			t.Errorf("Couldn't save %s to the cache", secondURL.String())
+		}
+		if err = firstCache.Save(thirdURL, bytes.NewBufferString("third")); err != nil {
+			t.Errorf("Couldn't save %s to the cache", thirdURL.String())
+		}
+
+		var snapshot bytes.Buffer
+		if err = firstCache.Export(&snapshot); err != nil {
+			t.Errorf("Couldn't export the cache: %v", err)
+		}
+
+		// Import into a cache that stores things differently.
+		secondCache, secondConfig := newTestCache(t, cache.Config{MountPath: filepath.Join(mountPath, "second")})
+		if err = secondCache.Import(&snapshot); err != nil {
+			t.Errorf("Couldn't import the snapshot: %v", err)
+		}
+		stats := secondCache.Stats()
+		if stats.Entries != 3 || stats.PinnedEntries != 1 || stats.DedupedBytes != int64(len(textBody)) {
+			t.Errorf("Cache should have 3 entries, 1 pinned, sharing a body but has %d, %d pinned and %d bytes shared",
+				stats.Entries, stats.PinnedEntries, stats.DedupedBytes)
+		}
+		for _, u := range []url.URL{firstURL, secondURL} {
+			fi, header, err := secondCache.GetWithHeaders(u)
+			if err != nil || !bytes.Equal(fi.Bytes(), textBody) || header.Get("Content-Type") != "text/plain" {
+				t.Errorf("Couldn't get %s from the cache", u.String())
+			}
+		}
+
+		// It's all on disk, too.
+		if err = secondCache.Close(); err != nil {
+			t.Errorf("Couldn't close the cache: %v", err)
+		}
+		thirdCache, _ := newTestCache(t, secondConfig)
+		if fi, err := thirdCache.Get(thirdURL); err != nil || fi.String() != "third" {
+			t.Errorf("Couldn't get %s from the cache", thirdURL.String())
+		}
+	})
+
+	t.Run("Imports find bodies read earlier in the snapshot in the cache", func(t *testing.T) {
+		// Sorted by url, /b's body comes between the two uses of /a's.
+		aURL, bURL, cURL := url.URL{Path: "/a"}, url.URL{Path: "/b"}, url.URL{Path: "/c"}
+		exportCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		for u, body := range map[url.URL][]byte{aURL: textBody, bURL: []byte("b"), cURL: textBody} {
+			if err = exportCache.SaveWithHeaders(u, bytes.NewBuffer(body), h); err != nil {
+				t.Errorf("Couldn't save %s to the cache", u.String())
+			}
+		}
+		var snapshot bytes.Buffer
+		if err = exportCache.Export(&snapshot); err != nil {
+			t.Errorf("Couldn't export the cache: %v", err)
+		}
+
+		importCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		if err = importCache.Import(&snapshot); err != nil {
+			t.Errorf("Couldn't import the snapshot: %v", err)
+		}
+		if fi, err := importCache.Get(cURL); err != nil || !bytes.Equal(fi.Bytes(), textBody) {
+			t.Errorf("Couldn't get %s from the cache", cURL.String())
+		}
+		if entries := importCache.Stats().Entries; entries != 3 {
+			t.Errorf("Cache should have 3 entries but has %d", entries)
+		}
+	})
+
+	t.Run("Imports refuse anything that isn't a snapshot", func(t *testing.T) {
+		memoryCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+
+		if err = memoryCache.Import(bytes.NewBufferString("not a snapshot")); err != cache.ErrBadSnapshot {
+			t.Errorf("Imported something that isn't a snapshot: %v", err)
+		}
+	})
+}
+
+func TestWARC(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes), kept in memory.
+	firstURL := url.URL{Scheme: "http", Host: "example.com", Path: "/first"}
+	secondURL := url.URL{Scheme: "http", Host: "example.com", Path: "/second", RawQuery: "q=1"}
+	missingURL := url.URL{Scheme: "http", Host: "example.com", Path: "/missing"}
+	h := http.Header{"Content-Type": {"text/plain"}}
+
+	firstCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+	var err error
+	if err = firstCache.SaveWithHeaders(firstURL, bytes.NewBufferString("first"), h); err != nil {
+		t.Errorf("Couldn't save %s to the cache", firstURL.String())
+	}
+	if err = firstCache.SaveWithHeaders(secondURL, bytes.NewBufferString("second"), h); err != nil {
+		t.Errorf("Couldn't save %s to the cache", secondURL.String())
+	}
+	if err = firstCache.SaveWithOptions(missingURL, bytes.NewBufferString("not found"), cache.SaveOptions{Status: http.StatusNotFound}); err != nil {
+		t.Errorf("Couldn't save %s to the cache", missingURL.String())
+	}
+	var warc bytes.Buffer
+	if err = firstCache.ExportWARC(&warc); err != nil {
+		t.Errorf("Couldn't export the cache as WARC: %v", err)
+	}
+
+	t.Run("Exports are WARC files", func(t *testing.T) {
+		contents := warc.String()
+		if !strings.HasPrefix(contents, "WARC/1.1\r\nWARC-Type: warcinfo\r\n") {
+			t.Error("Export doesn't start with a warcinfo record")
+		}
+		for _, want := range []string{
+			"WARC-Target-URI: " + secondURL.String() + "\r\n",
+			"HTTP/1.1 200 OK\r\n",
+			"HTTP/1.1 404 Not Found\r\n",
+			"GET /second?q=1 HTTP/1.1\r\nHost: example.com\r\n",
+		} {
+			if !strings.Contains(contents, want) {
+				t.Errorf("Export is missing %q", want)
+			}
+		}
+		if n := strings.Count(contents, "WARC-Type: response\r\n"); n != 3 {
+			t.Errorf("Export should have 3 response records but has %d", n)
+		}
+	})
+
+	t.Run("Imports seed the cache with successful responses", func(t *testing.T) {
+		for _, compressed := range []bool{false, true} {
+			r := io.Reader(bytes.NewReader(warc.Bytes()))
+			if compressed {
+				var zipped bytes.Buffer
+				zw := gzip.NewWriter(&zipped)
+				zw.Write(warc.Bytes())
+				zw.Close()
+				r = &zipped
+			}
+
+			secondCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+
+			if err = secondCache.ImportWARC(r); err != nil {
+				t.Errorf("Couldn't import the WARC file: %v", err)
+			}
+			if stats := secondCache.Stats(); stats.Entries != 2 {
+				t.Errorf("Cache should have 2 entries but has %d", stats.Entries)
+			}
+			fi, header, err := secondCache.GetWithHeaders(secondURL)
+			if err != nil || fi.String() != "second" || header.Get("Content-Type") != "text/plain" {
+				t.Errorf("Couldn't get %s from the cache", secondURL.String())
+			}
+			if _, err = secondCache.Get(missingURL); err != cache.ErrResourceNotInCache {
+				t.Errorf("Imported %s, which wasn't found", missingURL.String())
+			}
+		}
+	})
+
+	t.Run("Imports refuse anything that isn't a WARC file", func(t *testing.T) {
+		if err = firstCache.ImportWARC(bytes.NewBufferString("not a WARC file")); err != cache.ErrBadWARC {
+			t.Errorf("Imported something that isn't a WARC file: %v", err)
+		}
+	})
+}
+
+func TestStaleGrace(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage, item expiry of a second
+	// and a second's grace for stale items.
+	staleCache, _ := newTestCache(t, cache.Config{
+		Expiration: time.Second,
+		StaleGrace: time.Second,
+	})
+	var err error
+
+	staleURL := url.URL{Path: "/stale"}
+	freshURL := url.URL{Path: "/fresh"}
+
+	t.Run("Fresh resources aren't stale", func(t *testing.T) {
+		if err = staleCache.SaveWithTTL(freshURL, bytes.NewBufferString("fresh"), nil, cache.NoExpiry); err != nil {
+			t.Errorf("Couldn't save %s to the cache", freshURL.String())
+		}
+		buf, _, stale, err := staleCache.GetStale(freshURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", freshURL.String())
+		} else if buf.String() != "fresh" || stale != 0 {
+			t.Errorf("Failed to retrieve %s from the cache as fresh", freshURL.String())
+		}
+	})
+
+	t.Run("Expired resources can still be retrieved stale during the grace period", func(t *testing.T) {
+		h := http.Header{"Content-Type": []string{"text/plain"}}
+		if err = staleCache.SaveWithTTL(staleURL, bytes.NewBufferString("stale"), h, 200*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", staleURL.String())
+		}
+
+		time.Sleep(400 * time.Millisecond)
+		if _, err = staleCache.Get(staleURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found resource in cache when it should have expired")
+		}
+		buf, header, stale, err := staleCache.GetStale(staleURL)
+		if err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", staleURL.String())
+		} else if buf.String() != "stale" || header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Failed to retrieve %s from the cache", staleURL.String())
+		} else if stale < 200*time.Millisecond || stale > time.Second {
+			t.Errorf("%s has been stale for %s, expected about 200ms", staleURL.String(), stale)
+		}
+	})
+
+	t.Run("Responses are retrieved with the status they were saved with", func(t *testing.T) {
+		missingURL := url.URL{Path: "/missing"}
+		if err = staleCache.SaveWithOptions(missingURL, bytes.NewBufferString("not found"), cache.SaveOptions{Status: http.StatusNotFound}); err != nil {
+			t.Errorf("Couldn't save %s to the cache", missingURL.String())
+		}
+		if _, _, status, _, err := staleCache.GetResponse(missingURL); err != nil || status != http.StatusNotFound {
+			t.Errorf("Retrieved %s with status %d instead of 404", missingURL.String(), status)
+		}
+		if _, _, status, _, err := staleCache.GetResponse(freshURL); err != nil || status != http.StatusOK {
+			t.Errorf("Retrieved %s with status %d instead of 200", freshURL.String(), status)
+		}
+	})
+
+	t.Run("Expired resources are purged once the grace period is over", func(t *testing.T) {
+		time.Sleep(1200 * time.Millisecond)
+		if _, _, _, err = staleCache.GetStale(staleURL); err != cache.ErrResourceNotInCache {
+			t.Error("Found resource in cache when it should have been purged")
+		}
+		if _, err = staleCache.Get(freshURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", freshURL.String())
+		}
+	})
+
+	t.Run("Expired resources are kept for good with a grace of NoExpiry", func(t *testing.T) {
+		keepingCache, _ := newTestCache(t, cache.Config{
+			Expiration: time.Second,
+			StaleGrace: cache.NoExpiry,
+		})
+		if err = keepingCache.SaveWithTTL(staleURL, bytes.NewBufferString("stale"), nil, 50*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", staleURL.String())
+		}
+		time.Sleep(200 * time.Millisecond)
+		if buf, _, stale, err := keepingCache.GetStale(staleURL); err != nil || buf.String() != "stale" || stale == 0 {
+			t.Errorf("Couldn't retrieve %s from the cache stale", staleURL.String())
+		}
+	})
+}
+
+func TestRefreshAhead(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage, item expiry of a second,
+	// refreshing resources used within 300ms of expiring.
+	refreshed := make(chan url.URL, 10)
+	refreshCache, _ := newTestCache(t, cache.Config{
+		Expiration:   time.Second,
+		RefreshAhead: 300 * time.Millisecond,
+		OnRefreshAhead: func(u url.URL, h http.Header) {
+			refreshed <- u
+		},
+	})
+	var err error
+
+	hotURL := url.URL{Path: "/hot"}
+	idleURL := url.URL{Path: "/idle"}
+
+	// countRefreshed returns how many urls were passed to OnRefreshAhead in the last little while.
+	countRefreshed := func() (n int) {
+		for {
+			select {
+			case <-refreshed:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	t.Run("Resources aren't refreshed until they are used close to expiring", func(t *testing.T) {
+		if err = refreshCache.SaveWithTTL(hotURL, bytes.NewBufferString("hot"), nil, 600*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", hotURL.String())
+		}
+		if err = refreshCache.Save(idleURL, bytes.NewBufferString("idle")); err != nil {
+			t.Errorf("Couldn't save %s to the cache", idleURL.String())
+		}
+		if _, err = refreshCache.Get(hotURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", hotURL.String())
+		}
+		if n := countRefreshed(); n != 0 {
+			t.Errorf("%d resources were refreshed, expected none", n)
+		}
+	})
+
+	t.Run("Resources used close to expiring are refreshed once", func(t *testing.T) {
+		time.Sleep(300 * time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if _, err = refreshCache.Get(hotURL); err != nil {
+				t.Errorf("Couldn't retrieve %s from the cache", hotURL.String())
+			}
+			if _, err = refreshCache.Get(idleURL); err != nil {
+				t.Errorf("Couldn't retrieve %s from the cache", idleURL.String())
+			}
+		}
+		select {
+		case u := <-refreshed:
+			if u != hotURL {
+				t.Errorf("Refreshed %s, expected %s", u.String(), hotURL.String())
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s wasn't refreshed", hotURL.String())
+		}
+		if n := countRefreshed(); n != 0 {
+			t.Errorf("%d more resources were refreshed, expected none", n)
+		}
+	})
+
+	t.Run("Saving a resource again lets it be refreshed again", func(t *testing.T) {
+		if err = refreshCache.SaveWithTTL(hotURL, bytes.NewBufferString("hot"), nil, 200*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", hotURL.String())
+		}
+		if _, err = refreshCache.Get(hotURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", hotURL.String())
+		}
+		if n := countRefreshed(); n != 1 {
+			t.Errorf("%d resources were refreshed, expected 1", n)
+		}
+	})
+
+	t.Run("Resources are refreshed again once the last refresh is done", func(t *testing.T) {
+		failedURL := url.URL{Path: "/failed"}
+		if err = refreshCache.SaveWithTTL(failedURL, bytes.NewBufferString("failed"), nil, 200*time.Millisecond); err != nil {
+			t.Errorf("Couldn't save %s to the cache", failedURL.String())
+		}
+		for i := 0; i < 2; i++ {
+			if _, err = refreshCache.Get(failedURL); err != nil {
+				t.Errorf("Couldn't retrieve %s from the cache", failedURL.String())
+			}
+		}
+		refreshCache.RefreshDone(failedURL)
+		if _, err = refreshCache.Get(failedURL); err != nil {
+			t.Errorf("Couldn't retrieve %s from the cache", failedURL.String())
+		}
+		if n := countRefreshed(); n != 2 {
+			t.Errorf("%d resources were refreshed, expected 2", n)
+		}
+	})
+}
+
+func TestSparse(t *testing.T) {
+	// Instantiate an LRU cache, with 1MB of storage, item expiry of an hour,.
+	mountPath := t.TempDir()
+	var err error
+
+	config := cache.Config{MountPath: mountPath}
+	sparseCache, _ := newTestCache(t, config)
+
+	videoURL := url.URL{Path: "/video"}
+	videoBody := bytes.Repeat([]byte("0123456789"), 100)
+	size := int64(len(videoBody))
+	firstVersion := cache.SaveOptions{Header: http.Header{"Etag": {`"first"`}}}
+	secondVersion := cache.SaveOptions{Header: http.Header{"Etag": {`"second"`}}}
+
+	t.Run("Parts saved out of order are merged", func(t *testing.T) {
+		if err = sparseCache.SavePart(videoURL, 600, videoBody[600:800], size, firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", videoURL.String())
+		}
+		if err = sparseCache.SavePart(videoURL, 100, videoBody[100:300], size, firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", videoURL.String())
+		}
+		if err = sparseCache.SavePart(videoURL, 200, videoBody[200:700], size, firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", videoURL.String())
+		}
+		data, h, gotSize, missing, err := sparseCache.GetPart(videoURL, cache.Range{Offset: 150, Length: 600})
+		if err != nil || len(missing) != 0 {
+			t.Errorf("Couldn't retrieve part of %s from the cache, missing %v", videoURL.String(), missing)
+		}
+		if !bytes.Equal(data, videoBody[150:750]) {
+			t.Errorf("Retrieved the wrong part of %s from the cache", videoURL.String())
+		}
+		if gotSize != size || h.Get("ETag") != `"first"` {
+			t.Errorf("Retrieved size %d and ETag %s, expected %d and %s", gotSize, h.Get("ETag"), size, `"first"`)
+		}
+		if _, err = sparseCache.Get(videoURL); err != cache.ErrResourceNotInCache {
+			t.Errorf("Retrieved %s whole from the cache while only parts of it are there", videoURL.String())
+		}
+	})
+
+	t.Run("Only the missing ranges are reported", func(t *testing.T) {
+		data, _, _, missing, err := sparseCache.GetPart(videoURL, cache.Range{Offset: 0, Length: size})
+		if err != nil {
+			t.Errorf("Couldn't retrieve part of %s from the cache", videoURL.String())
+		}
+		expected := []cache.Range{{Offset: 0, Length: 100}, {Offset: 800, Length: 200}}
+		if data != nil || !reflect.DeepEqual(missing, expected) {
+			t.Errorf("Missing %v, expected %v", missing, expected)
+		}
+		if _, _, _, _, err = sparseCache.GetPart(videoURL, cache.Range{Offset: 900, Length: 200}); err != cache.ErrBadRange {
+			t.Errorf("Retrieved a range past the end of %s", videoURL.String())
+		}
+	})
+
+	// Close the cache, letting the disk saves run, and carry on with it reloaded.
+	sparseCache.Close()
+	sparseCache, _ = newTestCache(t, config)
+
+	t.Run("Parts survive a reload", func(t *testing.T) {
+		data, _, _, missing, err := sparseCache.GetPart(videoURL, cache.Range{Offset: 100, Length: 700})
+
+		if err != nil || len(missing) != 0 || !bytes.Equal(data, videoBody[100:800]) {
+			t.Errorf("Couldn't retrieve part of %s from the reloaded cache, missing %v", videoURL.String(), missing)
+		}
+	})
+
+	t.Run("Parts of another version replace what was cached", func(t *testing.T) {
+		if err = sparseCache.SavePart(videoURL, 0, videoBody[0:100], size, secondVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", videoURL.String())
+		}
+		_, h, _, missing, err := sparseCache.GetPart(videoURL, cache.Range{Offset: 0, Length: size})
+		if err != nil || h.Get("ETag") != `"second"` {
+			t.Errorf("Couldn't retrieve the second version of %s from the cache", videoURL.String())
+		}
+		expected := []cache.Range{{Offset: 100, Length: 900}}
+		if !reflect.DeepEqual(missing, expected) {
+			t.Errorf("Missing %v, expected %v", missing, expected)
+		}
+	})
+
+	t.Run("Resources are saved whole once every part is cached", func(t *testing.T) {
+		if err = sparseCache.SavePart(videoURL, 100, videoBody[100:], size, secondVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", videoURL.String())
+		}
+		fi, h, err := sparseCache.GetWithHeaders(videoURL)
+		if err != nil || !bytes.Equal(fi.Bytes(), videoBody) || h.Get("ETag") != `"second"` {
+			t.Errorf("Couldn't retrieve %s whole from the cache", videoURL.String())
+		}
+		data, _, _, missing, err := sparseCache.GetPart(videoURL, cache.Range{Offset: 990, Length: 10})
+		if err != nil || len(missing) != 0 || !bytes.Equal(data, videoBody[990:]) {
+			t.Errorf("Couldn't retrieve part of %s from the cache", videoURL.String())
+		}
+	})
+
+	t.Run("Unused part files are collected", func(t *testing.T) {
+		// Wait for the disk deletes to run.
+		sparseCache.Flush()
+		if _, err = sparseCache.Collect(); err != nil {
+			t.Error("Couldn't collect unused files")
+		}
+		files, err := ioutil.ReadDir(mountPath)
+		if err != nil {
+			t.Error("Couldn't list the mount point")
+		}
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), "-p-a-r-t-") {
+				t.Errorf("Found part file %s left behind", file.Name())
+			}
+		}
+	})
+	t.Run("Parts without a strong validator aren't cached", func(t *testing.T) {
+		unvalidatedURL := url.URL{Path: "/unvalidated"}
+		for _, h := range []http.Header{
+			{},
+			{"Etag": {`W/"weak"`}},
+			{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}, "Date": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+		} {
+			opts := cache.SaveOptions{Header: h}
+			if err = sparseCache.SavePart(unvalidatedURL, 0, videoBody[:100], size, opts); err != cache.ErrNoValidator {
+				t.Errorf("Saved part of %s with headers %v, expected %v", unvalidatedURL.String(), h, cache.ErrNoValidator)
+			}
+		}
+		if _, _, _, _, err = sparseCache.GetPart(unvalidatedURL, cache.Range{}); err != cache.ErrResourceNotInCache {
+			t.Errorf("Retrieved part of %s from the cache", unvalidatedURL.String())
+		}
+	})
+
+	t.Run("Pinned parts aren't evicted", func(t *testing.T) {
+		pinnedCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		bigBody := bytes.Repeat([]byte("0123456789"), 60000)
+		pinnedURL, otherURL := url.URL{Path: "/pinned"}, url.URL{Path: "/other"}
+		bigSize := int64(2 * len(bigBody))
+		if err = pinnedCache.SavePart(pinnedURL, 0, bigBody, bigSize, firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", pinnedURL.String())
+		}
+		pinnedCache.Pin(pinnedURL)
+		if err = pinnedCache.SavePart(otherURL, 0, bigBody, bigSize, firstVersion); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saved part of %s in place of a pinned part, expected %v", otherURL.String(), cache.ErrCacheSizeExceeded)
+		}
+		if _, _, _, missing, err := pinnedCache.GetPart(pinnedURL, cache.Range{Length: int64(len(bigBody))}); err != nil || len(missing) != 0 {
+			t.Errorf("Pinned part of %s was evicted", pinnedURL.String())
+		}
+	})
+
+	t.Run("Parts are kept until the whole resource is saved in their place", func(t *testing.T) {
+		wholeCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		part := bytes.Repeat([]byte("0123456789"), 60000)
+		tooBigURL, wholeURL := url.URL{Path: "/toobig"}, url.URL{Path: "/whole"}
+		if err = wholeCache.SavePart(tooBigURL, 0, part, int64(2*len(part)), firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", tooBigURL.String())
+		}
+		if err = wholeCache.SaveWithOptions(tooBigURL, bytes.NewBuffer(bytes.Repeat(part, 2)), firstVersion); err != cache.ErrCacheSizeExceeded {
+			t.Errorf("Saved all of %s, bigger than the cache, expected %v", tooBigURL.String(), cache.ErrCacheSizeExceeded)
+		}
+		if _, _, _, missing, err := wholeCache.GetPart(tooBigURL, cache.Range{Length: int64(len(part))}); err != nil || len(missing) != 0 {
+			t.Errorf("Part of %s was dropped, though all of it didn't fit", tooBigURL.String())
+		}
+
+		// Only room for all of it once its parts are gone.
+		roomCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		wholeBody := append(part[:len(part):len(part)], part[:len(part)/2]...)
+		if err = roomCache.SavePart(wholeURL, 0, part[:len(part)/2], int64(len(wholeBody)), firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", wholeURL.String())
+		}
+		if err = roomCache.SaveWithOptions(wholeURL, bytes.NewBuffer(wholeBody), firstVersion); err != nil {
+			t.Errorf("Couldn't save all of %s in place of its parts: %v", wholeURL.String(), err)
+		}
+		if data, _, _, missing, err := roomCache.GetPart(wholeURL, cache.Range{Length: int64(len(wholeBody))}); err != nil || len(missing) != 0 || !bytes.Equal(data, wholeBody) {
+			t.Errorf("Couldn't retrieve all of %s from the cache", wholeURL.String())
+		}
+	})
+
+	t.Run("Parts next to each other are kept as one", func(t *testing.T) {
+		store := cache.NewMemoryStore()
+		mergingCache, _ := newTestCache(t, cache.Config{Store: store})
+		mergedURL := url.URL{Path: "/merged"}
+		for _, r := range []cache.Range{{Offset: 0, Length: 100}, {Offset: 200, Length: 100}, {Offset: 100, Length: 100}} {
+			if err = mergingCache.SavePart(mergedURL, r.Offset, videoBody[r.Offset:r.Offset+r.Length], size, firstVersion); err != nil {
+				t.Errorf("Couldn't save part of %s to the cache", mergedURL.String())
+			}
+		}
+		if data, _, _, missing, err := mergingCache.GetPart(mergedURL, cache.Range{Length: 300}); err != nil || len(missing) != 0 || !bytes.Equal(data, videoBody[:300]) {
+			t.Errorf("Couldn't retrieve the merged parts of %s from the cache", mergedURL.String())
+		}
+		mergingCache.Flush()
+		names, _ := store.List()
+		pieces := 0
+		for _, name := range names {
+			if prefix := "-p-a-r-t-"; strings.HasPrefix(name, prefix) && strings.Contains(name[len(prefix):], "-") {
+				pieces++
+			}
+		}
+		if pieces != 1 {
+			t.Errorf("%d files hold the parts of %s, expected 1", pieces, mergedURL.String())
+		}
+	})
+
+	t.Run("Parts' indexes count against the cache size", func(t *testing.T) {
+		fullCache, _ := newTestCache(t, cache.Config{Store: cache.NewMemoryStore()})
+		fillerURL, partURL := url.URL{Path: "/filler"}, url.URL{Path: "/part"}
+		if err = fullCache.Save(fillerURL, bytes.NewBuffer(bytes.Repeat([]byte("0123456789"), 50000))); err != nil {
+			t.Errorf("Couldn't save %s to the cache", fillerURL.String())
+		}
+		// Just enough room for the part, but not its index.
+		stats := fullCache.Stats()
+		room := stats.MaxBytes - stats.MemoryBytes
+		if err = fullCache.SavePart(partURL, 0, bytes.Repeat([]byte("x"), int(room)), 2*room, firstVersion); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache: %v", partURL.String(), err)
+		}
+		if stats = fullCache.Stats(); stats.MemoryBytes > stats.MaxBytes {
+			t.Errorf("Cache is using %d bytes, more than its %d", stats.MemoryBytes, stats.MaxBytes)
+		}
+		if _, err = fullCache.Get(fillerURL); err != cache.ErrResourceNotInCache {
+			t.Errorf("%s wasn't evicted to make room for the index of %s", fillerURL.String(), partURL.String())
+		}
+	})
+
+	t.Run("Parts expire as the origin says", func(t *testing.T) {
+		expiringURL := url.URL{Path: "/expiring"}
+		opts := cache.SaveOptions{Header: firstVersion.Header, TTL: 50 * time.Millisecond}
+		if err = sparseCache.SavePart(expiringURL, 0, videoBody[:100], size, opts); err != nil {
+			t.Errorf("Couldn't save part of %s to the cache", expiringURL.String())
+		}
+		if _, _, _, _, err = sparseCache.GetPart(expiringURL, cache.Range{Length: 100}); err != nil {
+			t.Errorf("Couldn't retrieve part of %s from the cache before it expired", expiringURL.String())
+		}
+		time.Sleep(100 * time.Millisecond)
+		if _, _, _, _, err = sparseCache.GetPart(expiringURL, cache.Range{Length: 100}); err != cache.ErrResourceNotInCache {
+			t.Errorf("Retrieved part of %s from the cache after it expired", expiringURL.String())
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// collect removes every file in the store that the cache doesn't reference:
+// header files for urls that aren't in the cache, blob files for bodies that
+// aren't in the cache, and the files of parts that aren't.  Anything else, like the manifest, is left alone.
+// Header files that fail authentication might belong to a key the cache was
+// started without, so they are kept, and so is every blob file if there are any.
+// At startup, skipped lists the files that weren't loaded but are still wanted,
+// and they are kept too; otherwise it is nil.
+// A LogStore is compacted too.  It returns how many bytes were reclaimed.
+// The cache is only locked a file at a time, so collect can run alongside everything else.
+func (cache *memoryCache) collect(skipped *unloaded) (reclaimed int64, err error) {
+	if cache.readOnly {
+		return 0, ErrReadOnly
+	}
+	names, err := cache.store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	// remove removes the file name, if unused still reports that the cache
+	// doesn't reference it.  The deletion is queued with the cache locked, so
+	// that it takes its turn after any write to name queued before it, and
+	// before any queued after; it is waited for with the cache unlocked.
+	remove := func(name string, unused func() bool) {
+		cache.Lock()
+		if cache.closed || !unused() {
+			cache.Unlock()
+			return
+		}
+		size, err := cache.store.Stat(name)
+		if err != nil {
+			cache.Unlock()
+			return
+		}
+		done := make(chan error, 1)
+		cache.queue.push(writeJob{name: name, remove: true, done: done})
+		cache.Unlock()
+
+		if <-done == nil {
+			reclaimed += size
+			cache.Lock()
+			cache.collected++
+			cache.Unlock()
+		}
+	}
+
+	// Header files first, so that we know whether any blob might belong to one
+	// we can't read.  Each one names its url; it is in use if that url is in
+	// the cache, under this name.  One that can't be decoded is in no use.
+	unreadable := false
+	for _, name := range names {
+		if !strings.HasPrefix(name, headerPrefix) {
+			continue
+		}
+		encodedHeaders, _, err := cache.load(name)
+		if err == ErrAuthenticationFailed {
+			unreadable = true
+			continue
+		} else if err != nil || skipped.kept(name) {
+			continue
+		}
+		meta, err := decodeMetadata(encodedHeaders)
+		url, urlErr := headerURL(name, meta)
+		remove(name, func() bool {
+			if err != nil || urlErr != nil {
+				return true
+			}
+			_, ok := cache.memory[url]
+			return !ok || cache.headerName(url) != name
+		})
+	}
+
+	// Blob names can't be turned back into sums if they are keyed, so the names
+	// of the blobs in use are worked out up front.  Blobs saved since are
+	// checked for again before anything is removed.
+	cache.Lock()
+	inUse := cache.blobNamesInUse()
+	cache.Unlock()
+	for _, name := range names {
+		if strings.HasPrefix(name, blobPrefix) && !unreadable && !inUse[name] && !skipped.kept(name) {
+			remove(name, func() bool {
+				return !cache.blobNamesInUse()[name]
+			})
+		}
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, partPrefix) && !skipped.kept(name) {
+			remove(name, func() bool {
+				return cache.partFileUnused(name)
+			})
+		}
+	}
+
+	// Log stores keep deleted files until they are compacted.
+	if store, ok := cache.store.(compacter); ok {
+		compacted, err := store.Compact()
+		reclaimed += compacted
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+
+	cache.Lock()
+	cache.reclaimed += reclaimed
+	cache.Unlock()
+	if reclaimed > 0 {
+		fmt.Println("Reclaimed", reclaimed, "bytes of unused files from", strings.Join(cache.mountPaths, ", "))
+	}
+	return reclaimed, nil
+}
+
+// blobNamesInUse returns the names of the blob files of every body in the cache.
+// The cache must be locked.
+func (cache *memoryCache) blobNamesInUse() (names map[string]bool) {
+	names = make(map[string]bool, len(cache.blobs))
+	for sum := range cache.blobs {
+		names[cache.blobName(sum)] = true
+	}
+	return names
+}
+
+// unloaded records the files that startup left on disk without loading, but
+// that mustn't be collected: resources and pieces that didn't fit in the cache,
+// or that couldn't be read just then, and their bodies.  If a header or index
+// file couldn't be read at all, there's no telling which files are its, so
+// unreadable is set and every body and piece is kept.
+type unloaded struct {
+	names      map[string]bool
+	unreadable bool
+}
+
+// keep adds names to the files to keep.
+func (skipped *unloaded) keep(names ...string) {
+	for _, name := range names {
+		skipped.names[name] = true
+	}
+}
+
+// kept reports whether the file name is to be kept.  Header files are only kept
+// if they were named; anything else is kept if any file was unreadable.
+func (skipped *unloaded) kept(name string) bool {
+	if skipped == nil {
+		return false
+	}
+	if skipped.unreadable && !strings.HasPrefix(name, headerPrefix) {
+		return true
+	}
+	return skipped.names[name]
+}
+
+// compacter is implemented by stores that keep deleted files until they are compacted,
+// like LogStore.
+type compacter interface {
+	Compact() (reclaimed int64, err error)
+}
+
+// removeTemp removes every file in names left half written by a crash (see tmpPrefix),
+// through the write queue.  Files are only written under a temporary name while they
+// are being saved, so this must only run at startup, before the cache saves anything.
+func (cache *memoryCache) removeTemp(names []string) (reclaimed int64) {
+	for _, name := range names {
+		if !strings.HasPrefix(name, tmpPrefix) {
+			continue
+		}
+		size, err := cache.store.Stat(name)
+		if err != nil {
+			continue
+		}
+		if cache.queue.do(writeJob{name: name, remove: true}) == nil {
+			reclaimed += size
+			cache.collected++
+		}
+	}
+	cache.reclaimed += reclaimed
+	return reclaimed
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Compression selects how compressible response bodies are stored.
+type Compression int
+
+const (
+	// CompressionNone stores every body exactly as it was saved.  This is the default.
+	CompressionNone Compression = iota
+
+	// CompressionGzip stores compressible bodies gzip compressed.
+	CompressionGzip
+
+	// CompressionFlate stores compressible bodies as raw DEFLATE data, which
+	// is a little smaller than gzip for small bodies.
+	CompressionFlate
+)
+
+// Encodings of stored bodies, as recorded in header files.
+const (
+	encodingIdentity = ""
+	encodingGzip     = "gzip"
+	encodingFlate    = "deflate"
+)
+
+// ErrUnknownEncoding means a stored body was encoded in a way this cache can't decode.
+var ErrUnknownEncoding = errors.New("Stored body has an unknown encoding")
+
+// compressible reports whether a body with headers h is worth compressing:
+// text, scripts, stylesheets and structured data, that the origin hasn't
+// already compressed.
+func compressible(h http.Header) bool {
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/javascript", "application/x-javascript", "application/ecmascript",
+		"application/json", "application/xml", "application/xhtml+xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compress encodes body as given by c.  If that doesn't make it any smaller,
+// body is returned as is with encodingIdentity.
+func compress(c Compression, body []byte) (encoded []byte, encoding string, err error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case CompressionGzip:
+		w, encoding = gzip.NewWriter(&buf), encodingGzip
+	case CompressionFlate:
+		if w, err = flate.NewWriter(&buf, flate.DefaultCompression); err != nil {
+			return nil, encodingIdentity, err
+		}
+		encoding = encodingFlate
+	default:
+		return body, encodingIdentity, nil
+	}
+
+	if _, err = w.Write(body); err != nil {
+		return nil, encodingIdentity, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, encodingIdentity, err
+	}
+	if buf.Len() >= len(body) {
+		return body, encodingIdentity, nil
+	}
+	return buf.Bytes(), encoding, nil
+}
+
+// decompress decodes a body stored with encoding.
+func decompress(encoding string, encoded []byte) (body []byte, err error) {
+	var r io.ReadCloser
+	switch encoding {
+	case encodingIdentity:
+		return encoded, nil
+	case encodingGzip:
+		if r, err = gzip.NewReader(bytes.NewReader(encoded)); err != nil {
+			return nil, err
+		}
+	case encodingFlate:
+		r = flate.NewReader(bytes.NewReader(encoded))
+	default:
+		return nil, ErrUnknownEncoding
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrNoKeys means a keyring was created without any keys.
+// ErrBadKey means a key was not a hex encoded 16, 24 or 32 byte AES key.
+// ErrAuthenticationFailed means a file on disk was not sealed by any key in the keyring,
+// or was tampered with after it was sealed.
+var (
+	ErrNoKeys               = errors.New("Keyring needs at least one key")
+	ErrBadKey               = errors.New("Bad key: must be a hex encoded 16, 24 or 32 byte AES key")
+	ErrAuthenticationFailed = errors.New("File on disk failed authentication")
+)
+
+// keyIDSize is the length of the key id that prefixes every sealed file.
+// The key id is the start of the SHA-256 of the key, and picks the key
+// to open the file with.
+const keyIDSize = 4
+
+// keyedMark follows the prefix of a file name keyed with a keyring, so that it
+// can't be mistaken for a name made from a url.
+const keyedMark = "="
+
+// Keyring holds the AES keys used to encrypt files on disk with AES-GCM.
+// The first key seals everything written from now on; every key can open
+// files.  To rotate keys, put the new key first and keep the old ones after
+// it until the cache has loaded (and so re-sealed) everything on disk.
+// Each key also has a key derived from it for naming files; see fileName.
+type Keyring struct {
+	ids   [][keyIDSize]byte
+	aeads []cipher.AEAD
+	names [][]byte
+}
+
+// NewKeyring returns a keyring holding keys, with keys[0] the current key.
+func NewKeyring(keys ...[]byte) (keyring *Keyring, err error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	keyring = &Keyring{}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrBadKey
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		var id [keyIDSize]byte
+		sum := sha256.Sum256(key)
+		copy(id[:], sum[:])
+		keyring.ids = append(keyring.ids, id)
+		keyring.aeads = append(keyring.aeads, aead)
+
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("file names"))
+		keyring.names = append(keyring.names, mac.Sum(nil))
+	}
+	return keyring, nil
+}
+
+// ParseKeyring returns a keyring holding the hex encoded keys in s, separated by
+// commas or newlines, with the first one the current key.  Blank lines and
+// lines starting with '#' are skipped.
+func ParseKeyring(s string) (keyring *Keyring, err error) {
+	var keys [][]byte
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, ErrBadKey
+		}
+		keys = append(keys, key)
+	}
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads a keyring from the file at path; see ParseKeyring.
+func LoadKeyring(path string) (keyring *Keyring, err error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(contents))
+}
+
+// KeyringFromEnv reads a keyring from the environment variable name; see ParseKeyring.
+func KeyringFromEnv(name string) (keyring *Keyring, err error) {
+	return ParseKeyring(os.Getenv(name))
+}
+
+// seal encrypts plain, to be written to the file name.  The name is authenticated
+// along with the contents, so a sealed file can't be passed off as another.
+// Sealed files are laid out as: key id | nonce | ciphertext and tag.
+func (keyring *Keyring) seal(name string, plain []byte) (sealed []byte, err error) {
+	aead := keyring.aeads[0]
+	sealed = make([]byte, keyIDSize+aead.NonceSize(), keyIDSize+aead.NonceSize()+len(plain)+aead.Overhead())
+	copy(sealed, keyring.ids[0][:])
+	nonce := sealed[keyIDSize:]
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, plain, []byte(name)), nil
+}
+
+// overhead returns how much larger sealing makes a file.
+func (keyring *Keyring) overhead() int64 {
+	aead := keyring.aeads[0]
+	return int64(keyIDSize + aead.NonceSize() + aead.Overhead())
+}
+
+// open decrypts the contents of the file name.  stale reports whether the file
+// was sealed with some key other than the current one, and should be re-sealed.
+func (keyring *Keyring) open(name string, sealed []byte) (plain []byte, stale bool, err error) {
+	if len(sealed) < keyIDSize {
+		return nil, false, ErrAuthenticationFailed
+	}
+	for i, id := range keyring.ids {
+		if !bytes.Equal(id[:], sealed[:keyIDSize]) {
+			continue
+		}
+		aead := keyring.aeads[i]
+		if len(sealed) < keyIDSize+aead.NonceSize() {
+			return nil, false, ErrAuthenticationFailed
+		}
+		nonce := sealed[keyIDSize : keyIDSize+aead.NonceSize()]
+		plain, err = aead.Open(nil, nonce, sealed[keyIDSize+aead.NonceSize():], []byte(name))
+		if err != nil {
+			return nil, false, ErrAuthenticationFailed
+		}
+		return plain, i != 0, nil
+	}
+	return nil, false, ErrAuthenticationFailed
+}
+
+// fileName returns the name to store the file plain, starting with prefix, under:
+// prefix, then an HMAC of plain under the naming key of the key numbered key,
+// so that the name gives away nothing about the url or body the file holds.
+func (keyring *Keyring) fileName(key int, prefix, plain string) string {
+	mac := hmac.New(sha256.New, keyring.names[key])
+	mac.Write([]byte(prefix + plain))
+	return prefix + keyedMark + hex.EncodeToString(mac.Sum(nil))
+}
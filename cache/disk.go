@@ -0,0 +1,258 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrNoFreeSpace means Config.MinFreeDisk was set where free disk space can't be
+// measured, as on Windows.
+var ErrNoFreeSpace = errors.New("Free disk space can't be measured on this platform: leave MinFreeDisk unset")
+
+// defaultDiskCheckInterval is how often free space is measured, unless Config says otherwise.
+const defaultDiskCheckInterval = 10 * time.Second
+
+// defaultStripeProbeInterval is how often failed mount paths are tried again,
+// unless Config says otherwise.
+const defaultStripeProbeInterval = 30 * time.Second
+
+// IOError is an error writing to or deleting from the cache's store.
+// Op is "write", "delete" or "move", and Name is the file, or "mount" and
+// Name is the mount path that failed.
+type IOError struct {
+	Op   string
+	Name string
+	Err  error
+}
+
+// Error implements error for an IOError.
+func (e *IOError) Error() string {
+	return fmt.Sprintf("Couldn't %s %s: %v", e.Op, e.Name, e.Err)
+}
+
+// ioError records that op on the file name failed with err, calls failed (if
+// not nil) with the cache locked, and passes the error on to the OnIOError
+// callback, if there is one.  The cache must not be locked.
+func (cache *memoryCache) ioError(op, name string, err error, failed func()) {
+	if err == ErrReadOnly {
+		// Not an error, the cache just isn't writing to disk.
+		return
+	}
+	ioErr := &IOError{Op: op, Name: name, Err: err}
+	fmt.Println(ioErr)
+
+	cache.Lock()
+	cache.ioErrors++
+	if failed != nil {
+		failed()
+	}
+	onIOError := cache.onIOError
+	cache.Unlock()
+
+	if onIOError != nil {
+		onIOError(ioErr)
+	}
+}
+
+// persistAsync queues a write of contents to the file name.
+// If that fails, failed is called with the cache locked; see ioError.
+// Once the cache is closed, nothing is written, as though it failed.
+// The cache must be locked.
+func (cache *memoryCache) persistAsync(name string, contents []byte, failed func()) {
+	if cache.closed {
+		if failed != nil {
+			failed()
+		}
+		return
+	}
+	cache.queue.push(writeJob{name: name, contents: contents, failed: failed})
+}
+
+// deleteAsync queues a deletion of the file name, unless the cache is closed.
+// The cache must be locked.
+func (cache *memoryCache) deleteAsync(name string) {
+	if cache.closed {
+		return
+	}
+	cache.queue.push(writeJob{name: name, remove: true})
+}
+
+// fits reports whether the cache has room for need: it has to fit in the cache's
+// size, measured along its dimension, and in the disk budget if there is one.
+func (cache *memoryCache) fits(need footprint) bool {
+	if need.get(cache.dimension) > cache.capacity() {
+		return false
+	}
+	return cache.minFree == 0 || need.disk <= cache.diskBudget
+}
+
+// capacity returns the cache's size, less the share of any stripes that have failed.
+func (cache *memoryCache) capacity() int64 {
+	if cache.stripes == nil {
+		return cache.maxSize
+	}
+	live, total := cache.stripes.Live()
+	return cache.maxSize * int64(live) / int64(total)
+}
+
+// stripeName names stripe of the cache's StripedStore, by its mount path if it has one.
+func (cache *memoryCache) stripeName(stripe int) string {
+	if stripe < len(cache.mountPaths) {
+		return cache.mountPaths[stripe]
+	}
+	return "stripe " + strconv.Itoa(stripe)
+}
+
+// stripeDown carries on without the stripe of the cache's StripedStore that
+// failed with err: it's reported like any other I/O error, and resources are
+// evicted until the cache fits in what is left.  Resources whose files were on
+// the stripe stay in memory, marked memory only, until it comes back; see stripeUp.
+func (cache *memoryCache) stripeDown(stripe int, err error) {
+	name := cache.stripeName(stripe)
+	fmt.Println("Mount path", name, "failed, carrying on without it")
+	cache.ioError("mount", name, err, func() {
+		for cache.used.get(cache.dimension) > cache.capacity() {
+			toRemove, ok := cache.nextToGo(cache)
+			if !ok {
+				break
+			}
+			cache.deleteResource(toRemove)
+		}
+		for url, resource := range cache.memory {
+			if cache.stripes.wouldHold(stripe, cache.headerName(url)) {
+				resource.memoryOnly = true
+			}
+		}
+		for sum, b := range cache.blobs {
+			if cache.stripes.wouldHold(stripe, cache.blobName(sum)) {
+				b.memoryOnly = true
+			}
+		}
+	})
+}
+
+// stripeUp carries on with the stripe of the cache's StripedStore that works
+// again: everything that only lives in memory is saved again, and bodies still
+// on disk, that were out of reach, are back.  The cache must be locked.
+func (cache *memoryCache) stripeUp(stripe int) {
+	fmt.Println("Mount path", cache.stripeName(stripe), "is back")
+	for url, resource := range cache.memory {
+		if !resource.memoryOnly {
+			continue
+		}
+		url, resource := url, resource
+		resource.memoryOnly = false
+		cache.persistAsync(cache.headerName(url), resource.encodedHeaders, func() {
+			if cache.memory[url] == resource {
+				resource.memoryOnly = true
+			}
+		})
+	}
+	for sum, b := range cache.blobs {
+		if !b.memoryOnly {
+			continue
+		}
+		b.memoryOnly = false
+		if b.file == nil {
+			continue
+		}
+		sum, b := sum, b
+		cache.persistAsync(cache.blobName(sum), b.file.Bytes(), func() {
+			if cache.blobs[sum] == b {
+				b.memoryOnly = true
+			}
+		})
+	}
+}
+
+// reviveStripes tries each of the cache's failed stripes again, bringing back any
+// that work; see reopenMount and StripedStore.revive.
+func (cache *memoryCache) reviveStripes() {
+	for _, stripe := range cache.stripes.downStripes() {
+		if cache.reopenMount(stripe) != nil || cache.stripes.revive(stripe) != nil {
+			continue
+		}
+		cache.Lock()
+		cache.stripeUp(stripe)
+		cache.Unlock()
+	}
+}
+
+// monitorStripes runs reviveStripes over and over, resting interval between
+// tries, until the cache is closed.
+func (cache *memoryCache) monitorStripes(interval time.Duration) {
+	for {
+		select {
+		case <-cache.done:
+			return
+		case <-time.After(interval):
+			cache.reviveStripes()
+		}
+	}
+}
+
+// checkDisk measures the free space on the mount paths' filesystems, and sets the
+// disk budget so that at least minFree of it stays free.  If the cache is over
+// its new budget, resources are evicted until it isn't.  The cache must be locked.
+// Mount paths that can't be measured, because they have failed, count as full.
+// Mount paths on the same device share its free space, so it is only counted once.
+func (cache *memoryCache) checkDisk() (err error) {
+	var free int64
+	measured := make(map[uint64]bool)
+	for _, mountPath := range cache.mountPaths {
+		space, device, spaceErr := freeSpace(mountPath)
+		if spaceErr != nil {
+			err = spaceErr
+			continue
+		}
+		if !measured[device] {
+			free += space
+			measured[device] = true
+		}
+	}
+	if err == ErrNoFreeSpace {
+		return err
+	}
+	if len(measured) == 0 {
+		if err == nil {
+			// No mount path to measure.
+			err = notExist("statfs", "")
+		}
+		return err
+	}
+	cache.freeDisk = free
+
+	budget := cache.used.disk + free - cache.minFree
+	if budget < 0 {
+		budget = 0
+	}
+	if budget < cache.used.disk {
+		fmt.Println("Disk is running low, shrinking the disk cache to", budget, "bytes")
+	}
+	cache.diskBudget = budget
+	for cache.used.disk > cache.diskBudget {
+		toRemove, ok := cache.nextToGo(cache)
+		if !ok {
+			break
+		}
+		cache.deleteResource(toRemove)
+	}
+	return nil
+}
+
+// monitorDisk runs checkDisk over and over, resting interval between checks,
+// until the cache is closed.
+func (cache *memoryCache) monitorDisk(interval time.Duration) {
+	for {
+		select {
+		case <-cache.done:
+			return
+		case <-time.After(interval):
+			cache.Lock()
+			cache.checkDisk()
+			cache.Unlock()
+		}
+	}
+}
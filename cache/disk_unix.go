@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"syscall"
+)
+
+// freeSpace returns how many bytes are free for us on the filesystem holding path,
+// and the device that filesystem is on.
+func freeSpace(path string) (free int64, device uint64, err error) {
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	var info syscall.Stat_t
+	if err = syscall.Stat(path, &info); err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), uint64(info.Dev), nil
+}
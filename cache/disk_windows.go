@@ -0,0 +1,8 @@
+package cache
+
+// freeSpace would return how many bytes are free on the filesystem holding path,
+// and the device it is on, but there is no statfs on Windows, so MinFreeDisk
+// isn't supported there.
+func freeSpace(path string) (free int64, device uint64, err error) {
+	return 0, 0, ErrNoFreeSpace
+}
@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrLocked means another cache, in this process or another, is using the mount path.
+// ErrReadOnly means a read-only cache or store was asked to write.
+var (
+	ErrLocked   = errors.New("Mount path is in use by another cache: stop or close it first, or open this cache read-only")
+	ErrReadOnly = errors.New("Cache was opened read-only")
+)
+
+// lockName is the lock file in the mount path.  A cache holds an exclusive
+// lock on it until it is closed; read-only caches hold a shared one.
+const lockName = ".lock"
+
+// mountLock is a lock this process holds on a mount path, through the lock file
+// at path, which was info when it was locked.  holders counts the read-only
+// caches and stores sharing a shared lock.
+type mountLock struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	shared  bool
+	holders int
+}
+
+// locks holds every mount path this process has locked, by the path of its
+// lock file.  Within the process, as between processes, only shared locks are
+// shared.  A lock file that has been removed since it was locked, along with
+// its mount path, no longer counts, even if the mount path has been made again.
+var (
+	locks   = make(map[string]*mountLock)
+	locksMu sync.Mutex
+)
+
+// lockMountPath locks the mount path dir, shared or exclusive, returning ErrLocked
+// straight away if anything else, in this process or another, holds a conflicting
+// lock.  The lock is held until it is unlocked.
+func lockMountPath(dir string, shared bool) (lock *mountLock, err error) {
+	path, err := filepath.Abs(filepath.Join(dir, lockName))
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if l, ok := locks[path]; ok && os.SameFile(l.info, info) {
+		// We hold it already.  Closing our second handle on the file leaves the lock be.
+		file.Close()
+		if !shared || !l.shared {
+			fmt.Println("Mount path", dir, "is already in use by this process")
+			return nil, ErrLocked
+		}
+		l.holders++
+		return l, nil
+	}
+
+	if err = flock(file, shared); err != nil {
+		file.Close()
+		if err == ErrLocked {
+			fmt.Println("Mount path", dir, "is locked by another process")
+		}
+		return nil, err
+	}
+	lock = &mountLock{path: path, file: file, info: info, shared: shared, holders: 1}
+	locks[path] = lock
+	return lock, nil
+}
+
+// unlock releases lock, once nothing else in the process is sharing it.
+func (lock *mountLock) unlock() (err error) {
+	locksMu.Lock()
+	defer locksMu.Unlock()
+
+	if lock.holders--; lock.holders > 0 {
+		return nil
+	}
+	if locks[lock.path] == lock {
+		delete(locks, lock.path)
+	}
+	return lock.file.Close()
+}
+
+// holds reports whether lock is the lock on the mount path dir.
+func (lock *mountLock) holds(dir string) bool {
+	path, err := filepath.Abs(filepath.Join(dir, lockName))
+	return err == nil && lock != nil && path == lock.path
+}
+
+// unlock releases the cache's locks on its mount paths.
+func (cache *memoryCache) unlock() (err error) {
+	for _, lock := range cache.locks {
+		if unlockErr := lock.unlock(); err == nil {
+			err = unlockErr
+		}
+	}
+	cache.locks = nil
+	return err
+}
+
+// close stops the cache's background goroutines, and lets everything queued
+// be written to disk before the queue's workers stop too.  Then the mount
+// paths are free to use.  Closing a closed cache does nothing.
+func (cache *memoryCache) close() (err error) {
+	cache.Lock()
+	if cache.closed {
+		cache.Unlock()
+		return nil
+	}
+	// Nothing more is queued once closed is set; see persistAsync.
+	cache.closed = true
+	close(cache.done)
+	cache.Unlock()
+
+	err = cache.queue.close()
+	if unlockErr := cache.unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// locker is implemented by stores that lock the directory they keep their
+// files in, like LogStore.  A cache doesn't lock a mount path its store
+// has already locked for it.
+type locker interface {
+	locks(dir string) bool
+}
+
+// readOnlyStore wraps a Store, refusing to write to it.
+type readOnlyStore struct {
+	Store
+}
+
+// Put implements Store.Put for a readOnlyStore.
+func (store readOnlyStore) Put(name string, contents []byte) (err error) {
+	return ErrReadOnly
+}
+
+// Delete implements Store.Delete for a readOnlyStore.
+func (store readOnlyStore) Delete(name string) (err error) {
+	return ErrReadOnly
+}
@@ -0,0 +1,107 @@
+//go:build !windows
+// +build !windows
+
+package cache_test
+
+import (
+	"bytes"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
+)
+
+func TestLock(t *testing.T) {
+	// Instantiate LRU caches, with 1MB of storage, item expiry of an hour
+	// (so nothing expires - testing purposes).
+	mountPath := t.TempDir()
+
+	config := cache.Config{
+		Policy:     "LRU",
+		Size:       1,
+		Expiration: time.Duration(time.Hour * 1),
+		MountPath:  mountPath,
+	}
+	firstURL := url.URL{Path: "/first"}
+
+	// Stand in for another process by locking the lock file ourselves.
+	other, err := os.OpenFile(filepath.Join(mountPath, ".lock"), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		t.Error("Couldn't open lock file")
+	}
+	defer other.Close()
+
+	t.Run("Caches refuse a mount path another process has locked", func(t *testing.T) {
+		if err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX); err != nil {
+			t.Error("Couldn't lock lock file")
+		}
+		if _, err = cache.NewWithConfig(config); err != cache.ErrLocked {
+			t.Error("Opened a cache on a locked mount path")
+		}
+		readOnlyConfig := config
+		readOnlyConfig.ReadOnly = true
+		if _, err = cache.NewWithConfig(readOnlyConfig); err != cache.ErrLocked {
+			t.Error("Opened a read-only cache on an exclusively locked mount path")
+		}
+	})
+
+	t.Run("Read-only caches share the mount path with readers", func(t *testing.T) {
+		if err = syscall.Flock(int(other.Fd()), syscall.LOCK_SH); err != nil {
+			t.Error("Couldn't lock lock file")
+		}
+		readOnlyConfig := config
+		readOnlyConfig.ReadOnly = true
+		readOnly, _ := newTestCache(t, readOnlyConfig)
+		if err = readOnly.Save(firstURL, bytes.NewBufferString("first")); err != cache.ErrReadOnly {
+			t.Error("Saved to a read-only cache")
+		}
+		if _, err = cache.NewWithConfig(config); err != cache.ErrLocked {
+			t.Error("Opened a cache on a mount path another process is reading")
+		}
+	})
+
+	t.Run("Caches take the mount path once it is free", func(t *testing.T) {
+		if err = syscall.Flock(int(other.Fd()), syscall.LOCK_UN); err != nil {
+			t.Error("Couldn't unlock lock file")
+		}
+		newTestCache(t, config)
+		if err = syscall.Flock(int(other.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+			t.Error("Cache didn't lock its mount path")
+		}
+	})
+
+	t.Run("Caches in the same process don't share a mount path until it is closed", func(t *testing.T) {
+		firstCache, _ := newTestCache(t, config)
+		if _, err = cache.NewWithConfig(config); err != cache.ErrLocked {
+			t.Error("Opened a second cache on a mount path in use by this process")
+		}
+		readOnlyConfig := config
+		readOnlyConfig.ReadOnly = true
+		if _, err = cache.NewWithConfig(readOnlyConfig); err != cache.ErrLocked {
+			t.Error("Opened a read-only cache on a mount path this process is writing to")
+		}
+
+		if err = firstCache.Close(); err != nil {
+			t.Errorf("Couldn't close the cache: %v", err)
+		}
+		if err = syscall.Flock(int(other.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			t.Error("Closing the cache didn't unlock its mount path")
+		}
+		syscall.Flock(int(other.Fd()), syscall.LOCK_UN)
+		newTestCache(t, config)
+	})
+
+	t.Run("A mount path that is removed and made again is free", func(t *testing.T) {
+		removedConfig := config
+		removedConfig.MountPath = filepath.Join(mountPath, "removed")
+		newTestCache(t, removedConfig)
+		if err = os.RemoveAll(removedConfig.MountPath); err != nil {
+			t.Error("Couldn't remove mount path")
+		}
+		newTestCache(t, removedConfig)
+	})
+}
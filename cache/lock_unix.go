@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package cache
+
+import (
+	"os"
+	"syscall"
+)
+
+// flock takes an advisory lock on file, shared or exclusive, without waiting for it.
+func flock(file *os.File, shared bool) (err error) {
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+	if err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
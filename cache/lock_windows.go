@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// procLockFileEx is LockFileEx, which package syscall doesn't have, from kernel32.dll.
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+// Flags to LockFileEx, and the error it fails with if another handle holds a
+// conflicting lock.
+const (
+	lockfileFailImmediately               = 0x00000001
+	lockfileExclusiveLock                 = 0x00000002
+	errorLockViolation      syscall.Errno = 33
+)
+
+// flock takes a lock on all of file, shared or exclusive, without waiting for it.
+// Windows has no flock, so this is LockFileEx; its locks are mandatory rather than
+// advisory, but nothing reads or writes the lock file anyway.  Closing file lets it go.
+func flock(file *os.File, shared bool) (err error) {
+	flags := uintptr(lockfileFailImmediately)
+	if !shared {
+		flags |= lockfileExclusiveLock
+	}
+	var overlapped syscall.Overlapped
+	ok, _, err := procLockFileEx.Call(file.Fd(), flags, 0, 0xFFFFFFFF, 0xFFFFFFFF, uintptr(unsafe.Pointer(&overlapped)))
+	if ok != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrLocked
+	}
+	return err
+}
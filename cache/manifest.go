@@ -0,0 +1,296 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNewerFormat means the mount path was written by a newer version of the cache.
+// ErrBadManifest means the manifest in the mount path couldn't be read.
+// ErrWrongStore means the mount path was written through a different kind of Store.
+// ErrNeedsMigration means a read-only cache was opened on a mount path in an older format.
+var (
+	ErrNewerFormat    = errors.New("Mount path was written by a newer version of the cache: upgrade the cache, or give it a different mount path")
+	ErrBadManifest    = errors.New("Mount path has an unreadable " + manifestName + ": fix or remove it (the cache will work out the format itself), or give the cache a different mount path")
+	ErrWrongStore     = errors.New("Mount path was written through a different store: open it with the store named in " + manifestName)
+	ErrNeedsMigration = errors.New("Mount path is in an older format: open it read-write once to migrate it, then open it read-only")
+)
+
+// manifestName is the manifest file in the mount path.  It records the version
+// of the on-disk format, so that a cache never misreads files written in another.
+const manifestName = "manifest.json"
+
+// formatVersion is the version of the on-disk format this cache writes.
+// Version 1: a header file holding a bare gob-encoded http.Header, and a body file
+// named after the url (see ToDiskString), per url.  There was no manifest.
+// Version 2: a header file holding gob-encoded metadata per url, and a blob file
+// per distinct body (see blobPrefix).  Compression and encryption are recorded
+// per file, and don't change the version.
+const formatVersion = 2
+
+// migrations upgrade a mount path from the version they are keyed by to the next one.
+var migrations = map[int]func(cache *memoryCache) error{
+	1: (*memoryCache).migrateV1,
+}
+
+// manifest is the contents of the manifest file.  Store names the kind of
+// Store the mount path was written through, if it is one of ours.
+type manifest struct {
+	Version int    `json:"version"`
+	Store   string `json:"store,omitempty"`
+}
+
+// storeKind names the kind of store, for the manifest.
+func storeKind(store Store) (kind string) {
+	switch store := store.(type) {
+	case *DirStore:
+		return "dir"
+	case *LogStore:
+		return "log"
+	case *StripedStore:
+		// Stripes are all the same kind, or the cache wouldn't know what to expect.
+		return storeKind(store.stripes[0].Store)
+	}
+	return ""
+}
+
+// checkFormat reads the manifest at each mount path and makes sure the cache can
+// read what is there, written through a store of kind kind.  Older formats are
+// migrated in place, unless readOnly is set.  Mount paths from before manifests
+// get one.  A stripe whose manifest can't be read or written, because its disk
+// has failed, is taken out of the cache's StripedStore, and the cache carries on
+// without it; see mountFailed.
+func (cache *memoryCache) checkFormat(kind string, readOnly bool) (err error) {
+	found := make([]manifest, len(cache.mountPaths))
+	written := make([]bool, len(cache.mountPaths))
+	version := formatVersion
+	for i, mountPath := range cache.mountPaths {
+		if cache.mountDown(i) {
+			continue
+		}
+		if found[i], written[i], err = cache.readManifest(mountPath, kind); err != nil {
+			if cache.mountFailed(i, err) {
+				continue
+			}
+			return err
+		}
+		if found[i].Version < version {
+			version = found[i].Version
+		}
+	}
+
+	// Mount paths are migrated together, as they share one store.
+	if version < formatVersion && readOnly {
+		return ErrNeedsMigration
+	}
+	for ; version < formatVersion; version++ {
+		fmt.Println("Migrating mount path", strings.Join(cache.mountPaths, ", "), "from format version", version, "to", version+1)
+		if err = migrations[version](cache); err != nil {
+			return err
+		}
+	}
+
+	for i, mountPath := range cache.mountPaths {
+		if readOnly || cache.mountDown(i) {
+			continue
+		}
+		if err = writeManifest(mountPath, found[i], written[i], kind); err != nil && !cache.mountFailed(i, err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeManifest writes the manifest for the current format at mountPath, written
+// through a store of kind kind, unless found, the manifest there, already says as much.
+// written reports whether there was a manifest.
+func writeManifest(mountPath string, found manifest, written bool, kind string) (err error) {
+	m := manifest{Version: formatVersion, Store: found.Store}
+	if m.Store == "" {
+		m.Store = kind
+	}
+	if m == found && written {
+		return nil
+	}
+	contents, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(mountPath, manifestName), contents, true)
+}
+
+// mountDown reports whether the stripe at the mount path numbered mount has failed.
+func (cache *memoryCache) mountDown(mount int) bool {
+	return cache.stripes != nil && cache.stripes.isDown(mount)
+}
+
+// mountFailed reports whether err, from the mount path numbered mount, means its
+// disk has failed rather than that it holds something the cache can't use.  If
+// so, and the cache stripes its files, the stripe is taken out of the store.
+func (cache *memoryCache) mountFailed(mount int, err error) bool {
+	switch err {
+	case ErrNewerFormat, ErrBadManifest, ErrWrongStore, ErrNeedsMigration, ErrLocked, ErrNotADirectory:
+		return false
+	}
+	if cache.stripes == nil || mount >= len(cache.stripes.stripes) {
+		return false
+	}
+	cache.stripes.markDown(mount, err)
+	return true
+}
+
+// reopenMount gets the mount path of the failed stripe ready to use again, as
+// NewWithConfig would: it's made if need be, locked, and its format checked.
+// A mount path in an older format is left out, as the others have moved on.
+// Stripes of a store of the caller's own, without mount paths, need nothing.
+func (cache *memoryCache) reopenMount(stripe int) (err error) {
+	if stripe >= len(cache.mountPaths) {
+		return nil
+	}
+	mountPath := cache.mountPaths[stripe]
+	if err = makeDir(mountPath); err != nil {
+		return err
+	}
+
+	cache.Lock()
+	held := cache.stripes.locks(mountPath)
+	for _, lock := range cache.locks {
+		held = held || lock.holds(mountPath)
+	}
+	cache.Unlock()
+	if !held {
+		lock, err := lockMountPath(mountPath, cache.readOnly)
+		if err != nil {
+			return err
+		}
+		cache.Lock()
+		if cache.closed {
+			cache.Unlock()
+			lock.unlock()
+			return ErrLocked
+		}
+		cache.locks = append(cache.locks, lock)
+		cache.Unlock()
+	}
+
+	kind := storeKind(cache.stripes)
+	found, written, err := cache.readManifest(mountPath, kind)
+	if err != nil {
+		return err
+	}
+	if found.Version < formatVersion {
+		fmt.Println("Mount path", mountPath, "is in format version", found.Version, "and can't be migrated alone, leaving it out")
+		return ErrNeedsMigration
+	}
+	if cache.readOnly {
+		return nil
+	}
+	return writeManifest(mountPath, found, written, kind)
+}
+
+// readManifest reads the manifest at mountPath, and checks that the cache can
+// read a mount path written through a store of kind kind in the format it records.
+// written reports whether there was a manifest; if not, the format is worked out.
+func (cache *memoryCache) readManifest(mountPath, kind string) (m manifest, written bool, err error) {
+	contents, err := ioutil.ReadFile(filepath.Join(mountPath, manifestName))
+	if os.IsNotExist(err) {
+		if m.Version, err = cache.detectVersion(); err != nil {
+			return m, false, err
+		}
+	} else if err != nil {
+		return m, false, err
+	} else if json.Unmarshal(contents, &m) != nil || m.Version < 1 {
+		return m, false, ErrBadManifest
+	}
+
+	if m.Version > formatVersion {
+		fmt.Println("Mount path", mountPath, "is in format version", m.Version, "but this cache only reads up to", formatVersion)
+		return m, false, ErrNewerFormat
+	}
+	if m.Store != "" && kind != "" && m.Store != kind {
+		fmt.Println("Mount path", mountPath, "was written through a", m.Store, "store, not a", kind, "store")
+		return m, false, ErrWrongStore
+	}
+	return m, contents != nil, nil
+}
+
+// detectVersion works out the format of a mount path from before manifests.
+// It's version 1 if a body file named after a url is still there, 2 otherwise.
+func (cache *memoryCache) detectVersion() (version int, err error) {
+	names, err := cache.store.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, headerPrefix) {
+			continue
+		}
+		if _, err = cache.store.Stat(ToDiskString(FromHeaderDiskString(name))); err == nil {
+			return 1, nil
+		}
+	}
+	return 2, nil
+}
+
+// migrateV1 moves every body file named after a url into a blob file named after its
+// SHA-256, and rewrites its header file to record the blob and the url, as metadata.
+// Version 1 files were never sealed, but the rewritten ones are, under the names the
+// cache gives them now, if the cache encrypts its files.
+// Everything is written through the write queue, waiting for each file in turn.
+func (cache *memoryCache) migrateV1() (err error) {
+	names, err := cache.store.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, headerPrefix) {
+			continue
+		}
+		url := FromHeaderDiskString(name)
+		bodyName := ToDiskString(url)
+		body, err := cache.store.Get(bodyName)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Leave anything unreadable for the loader to deal with.
+		encodedHeaders, err := cache.store.Get(name)
+		if err != nil {
+			continue
+		}
+		meta, err := decodeMetadata(encodedHeaders)
+		if err != nil {
+			continue
+		}
+		meta.Sum, meta.Size, meta.URL = sha256.Sum256(body), int64(len(body)), url.String()
+		if encodedHeaders, err = encodeMetadata(meta); err != nil {
+			return err
+		}
+
+		// Body first, then the header that points at it, and only then remove the old files.
+		if err = cache.queue.do(writeJob{name: cache.blobName(meta.Sum), contents: body}); err != nil {
+			return err
+		}
+		headerName := cache.headerName(url)
+		if err = cache.queue.do(writeJob{name: headerName, contents: encodedHeaders}); err != nil {
+			return err
+		}
+		if headerName != name {
+			if err = cache.queue.do(writeJob{name: name, remove: true}); err != nil {
+				return err
+			}
+		}
+		if err = cache.queue.do(writeJob{name: bodyName, remove: true}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"net/http"
+	"time"
+)
+
+// NoExpiry is a TTL meaning that a resource never expires;
+// it stays in the cache until it is evicted to make room for others.
+const NoExpiry time.Duration = -1
+
+// SaveOptions holds everything, other than the body, that may be saved
+// along with a resource.
+type SaveOptions struct {
+	// Header is the http.Header saved along with the resource.
+	Header http.Header
+
+	// TTL is how long the resource stays fresh after it is saved, regardless
+	// of how often it is accessed.  The zero value uses the cache's own
+	// expiration, which purges resources once they have gone unused for that
+	// long.  NoExpiry keeps the resource until it is evicted.
+	TTL time.Duration
+
+	// Status is the HTTP status the resource was served with; 0 means 200 OK.
+	// Fetched is when it was fetched from the origin; the zero value means now.
+	Status  int
+	Fetched time.Time
+}
+
+// metadata is everything about a resource, other than its body, that is
+// persisted in its header file.
+type metadata struct {
+	Header http.Header
+
+	// Expires is when the resource expires.  A zero Expires means the resource
+	// expires once it goes unused for the cache's expiration.
+	Expires time.Time
+
+	// NoExpiry means the resource never expires.
+	NoExpiry bool
+
+	// Sum is the SHA-256 of the body, which names the blob file it is stored in.
+	// Header files written before bodies were content addressed have no Sum;
+	// their body is in the file named by ToDiskString instead.
+	Sum [sha256.Size]byte
+
+	// Encoding is how the blob file is compressed, if at all,
+	// and Size is the length of the body before compression.
+	Encoding string
+	Size     int64
+
+	// Status and Fetched are as in SaveOptions.  Header files written before
+	// they were recorded have neither.
+	Status  int
+	Fetched time.Time
+
+	// URL is the url the resource was saved under.  Header files written before
+	// it was recorded have none; their url is in their name (see FromHeaderDiskString).
+	URL string
+}
+
+// newMetadata builds the metadata for a resource saved now with opts.
+func newMetadata(opts SaveOptions) (meta metadata) {
+	meta.Header = opts.Header
+	meta.Status, meta.Fetched = opts.Status, opts.Fetched
+	if meta.Status == 0 {
+		meta.Status = http.StatusOK
+	}
+	if meta.Fetched.IsZero() {
+		meta.Fetched = time.Now()
+	}
+	switch {
+	case opts.TTL == NoExpiry:
+		meta.NoExpiry = true
+	case opts.TTL > 0:
+		meta.Expires = time.Now().Add(opts.TTL)
+	}
+	return meta
+}
+
+// encodeMetadata gob-encodes meta, exactly as it is written to a header file on disk.
+func encodeMetadata(meta metadata) (encoded []byte, err error) {
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(meta); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeMetadata decodes the contents of a header file.  Header files written
+// before metadata was introduced hold a bare gob-encoded http.Header; those
+// decode to metadata with the default expiry.
+func decodeMetadata(encoded []byte) (meta metadata, err error) {
+	if err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&meta); err == nil {
+		return meta, nil
+	}
+
+	var h http.Header
+	if err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(&h); err != nil {
+		return metadata{}, err
+	}
+	return metadata{Header: h}, nil
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// Defaults for the write-behind queue; see Config.
+const (
+	defaultWorkers    = 4
+	defaultQueueDepth = 256
+)
+
+// Syncer is implemented by stores that can put off flushing writes to disk, so
+// that a batch of writes can share one flush.  See Config.SyncBatch.
+type Syncer interface {
+	// PutNoSync is like Store.Put, but contents needn't survive a crash until Sync returns.
+	PutNoSync(name string, contents []byte) error
+
+	// Sync flushes everything written by PutNoSync so far to disk.
+	Sync() error
+}
+
+// writeJob is one write of contents to the file name or, if remove is set,
+// one deletion of it, or, if moveTo is set, one move of it to moveTo, as it is.
+// failed is called if it fails; see ioError.  If done is set, the job's error
+// (or nil) is sent on it once the job is done.
+// A job with flushed set does nothing but close flushed once every job
+// queued before it is done.
+type writeJob struct {
+	name     string
+	contents []byte
+	remove   bool
+	moveTo   string
+	failed   func()
+	done     chan error
+	flushed  chan struct{}
+}
+
+// writeQueue is a write-behind queue in front of the cache's store.  Jobs are
+// spread over a fixed set of workers by file name, so that jobs on the same
+// file are done in the order they were queued.  Each worker's queue is bounded:
+// once it is full, queueing waits for the disk to catch up, rather than piling
+// up goroutines.  If the store is a Syncer and batch is more than 1, a worker
+// does up to batch queued writes at a time and flushes them to disk together.
+// err is the first error since the queue was last flushed.
+type writeQueue struct {
+	cache   *memoryCache
+	workers []chan writeJob
+	batch   int
+	err     error
+	sync.Mutex
+}
+
+// newWriteQueue starts a queue of workers workers, each queueing up to depth jobs,
+// writing to cache's store.
+func newWriteQueue(cache *memoryCache, workers, depth, batch int) (queue *writeQueue) {
+	queue = &writeQueue{cache: cache, batch: batch}
+	for i := 0; i < workers; i++ {
+		jobs := make(chan writeJob, depth)
+		queue.workers = append(queue.workers, jobs)
+		go queue.work(jobs)
+	}
+	return queue
+}
+
+// push queues job on the worker for its file, waiting if that worker's queue is full.
+func (queue *writeQueue) push(job writeJob) {
+	h := fnv.New32a()
+	h.Write([]byte(job.name))
+	queue.workers[h.Sum32()%uint32(len(queue.workers))] <- job
+}
+
+// work does the jobs in jobs, a batch at a time.
+func (queue *writeQueue) work(jobs chan writeJob) {
+	syncer, _ := queue.cache.store.(Syncer)
+	if queue.batch <= 1 {
+		syncer = nil
+	}
+	for job := range jobs {
+		batch := []writeJob{job}
+		if syncer != nil {
+			// Take whatever else is waiting, up to a batch.
+		drain:
+			for len(batch) < queue.batch {
+				select {
+				case next := <-jobs:
+					batch = append(batch, next)
+				default:
+					break drain
+				}
+			}
+		}
+		queue.run(batch, syncer)
+	}
+}
+
+// run does the jobs in batch, in order.  If syncer is set, writes aren't flushed
+// to disk one by one, but all together at the end.
+func (queue *writeQueue) run(batch []writeJob, syncer Syncer) {
+	errs := make([]error, len(batch))
+	var written []int
+	for i, job := range batch {
+		var err error
+		switch {
+		case job.flushed != nil:
+			continue
+		case job.remove:
+			// A file that was never written, because that failed, doesn't need deleting.
+			if err = queue.cache.store.Delete(job.name); os.IsNotExist(err) {
+				err = nil
+			}
+		case job.moveTo != "":
+			err = queue.cache.move(job.name, job.moveTo)
+		case syncer != nil:
+			if err = queue.cache.persistWith(syncer.PutNoSync, job.name, job.contents); err == nil {
+				written = append(written, i)
+			}
+		default:
+			err = queue.cache.persist(job.name, job.contents)
+		}
+		if err != nil {
+			errs[i] = err
+			queue.fail(job, err)
+		}
+	}
+	if syncer != nil && len(written) > 0 {
+		if err := syncer.Sync(); err != nil {
+			for _, i := range written {
+				errs[i] = err
+				queue.fail(batch[i], err)
+			}
+		}
+	}
+
+	for i, job := range batch {
+		if job.done != nil {
+			job.done <- errs[i]
+		}
+		if job.flushed != nil {
+			close(job.flushed)
+		}
+	}
+}
+
+// fail records that job failed with err, and dispatches a goroutine to report it.
+// Reporting locks the cache, which may be waiting on this queue, so it mustn't hold up the worker.
+func (queue *writeQueue) fail(job writeJob, err error) {
+	if err == ErrReadOnly {
+		// Not an error, the cache just isn't writing to disk.
+		return
+	}
+	queue.Lock()
+	if queue.err == nil {
+		queue.err = err
+	}
+	queue.Unlock()
+
+	op := "write"
+	if job.remove {
+		op = "delete"
+	} else if job.moveTo != "" {
+		op = "move"
+	}
+	go queue.cache.ioError(op, job.name, err, job.failed)
+}
+
+// do queues job, waits until it is done, and returns its error.  Jobs queued
+// before it on the same file are done first.
+func (queue *writeQueue) do(job writeJob) (err error) {
+	job.done = make(chan error, 1)
+	queue.push(job)
+	return <-job.done
+}
+
+// flush waits until every job queued so far is done, and returns the first
+// error since the queue was last flushed.
+func (queue *writeQueue) flush() (err error) {
+	var done []chan struct{}
+	for _, jobs := range queue.workers {
+		flushed := make(chan struct{})
+		jobs <- writeJob{flushed: flushed}
+		done = append(done, flushed)
+	}
+	for _, flushed := range done {
+		<-flushed
+	}
+
+	queue.Lock()
+	defer queue.Unlock()
+
+	err, queue.err = queue.err, nil
+	return err
+}
+
+// close waits until every job queued so far is done, then stops the workers.
+// Nothing may be queued afterwards.  It returns the first error since the queue
+// was last flushed.
+func (queue *writeQueue) close() (err error) {
+	err = queue.flush()
+	for _, jobs := range queue.workers {
+		close(jobs)
+	}
+	return err
+}
@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrChecksumMismatch means a body read from disk doesn't match the SHA-256
+// it was saved under: the file was truncated or corrupted.
+var ErrChecksumMismatch = errors.New("Stored body does not match its checksum")
+
+// quarantineDir is the folder, inside the store, that corrupt files are
+// moved into.  They are kept rather than deleted so that they can be inspected.
+const quarantineDir = "quarantine"
+
+// scrubPause is how long the scrubber rests between files, so that it never
+// competes with serving requests for the disk.
+const scrubPause = 10 * time.Millisecond
+
+// verify checks that stored, a body stored with encoding, is the body whose
+// SHA-256 is sum.
+func verify(sum [sha256.Size]byte, encoding string, stored []byte) (err error) {
+	body, err := decompress(encoding, stored)
+	if err != nil {
+		return ErrChecksumMismatch
+	}
+	if sha256.Sum256(body) != sum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// loadBlob reads the blob file for the body with SHA-256 sum, stored with
+// encoding, and verifies it.  It is looked for under each name it may have
+// (see blobNames), and name is the one it was found under.  stale reports
+// whether it should be written again under blobName: it was sealed under an
+// old key, or found under another name.
+func (cache *memoryCache) loadBlob(sum [sha256.Size]byte, encoding string) (stored []byte, name string, stale bool, err error) {
+	for i, tried := range cache.blobNames(sum) {
+		stored, stale, err = cache.load(tried)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, tried, false, err
+		}
+		if err = verify(sum, encoding, stored); err != nil {
+			return nil, tried, false, err
+		}
+		return stored, tried, stale || i > 0, nil
+	}
+	return nil, cache.blobName(sum), false, err
+}
+
+// statBlob returns the size of the blob file for the body with SHA-256 sum,
+// as stored, and the name it was found under; see loadBlob.
+func (cache *memoryCache) statBlob(sum [sha256.Size]byte) (size int64, name string, err error) {
+	for _, name = range cache.blobNames(sum) {
+		if size, err = cache.store.Stat(name); !os.IsNotExist(err) {
+			return size, name, err
+		}
+	}
+	return 0, cache.blobName(sum), err
+}
+
+// quarantine queues a move of the file name out of the way, into the quarantine
+// folder.  Like any other write, it is dropped once the cache is closed.
+// The cache must be locked.
+func (cache *memoryCache) quarantine(name string) {
+	if cache.closed {
+		return
+	}
+	fmt.Println("Quarantining corrupt file", name)
+	cache.queue.push(writeJob{name: name, moveTo: path.Join(quarantineDir, name)})
+}
+
+// move moves the file name to newName, as it is, without opening or sealing it.
+// It is only for the write queue; see quarantine.
+func (cache *memoryCache) move(name, newName string) (err error) {
+	contents, err := cache.store.Get(name)
+	if err != nil {
+		return err
+	}
+	if err = cache.store.Put(newName, contents); err != nil {
+		return err
+	}
+	return cache.store.Delete(name)
+}
+
+// scrub makes one pass over the cache's store, checking every header file and
+// every blob file a header file refers to.  Corrupt files are quarantined;
+// if the cache still holds a good copy in memory, it is written back to disk.
+// The cache is only locked briefly, to record results, so scrub can run
+// alongside everything else.
+func (cache *memoryCache) scrub() {
+	names, err := cache.store.List()
+	if err != nil {
+		return
+	}
+
+	// corrupt records that the file name failed its check, quarantines it,
+	// and, if the cache is holding a good copy of it in memory, writes that back.
+	// Both go through the write queue, in that order, after any write already
+	// queued for name.
+	corrupt := func(name string, goodCopy func() []byte) {
+		cache.Lock()
+		defer cache.Unlock()
+
+		cache.corrupt++
+		cache.quarantine(name)
+		if contents := goodCopy(); contents != nil {
+			cache.persistAsync(name, contents, nil)
+		}
+	}
+
+	// Header files first: they name each blob, and say how it is encoded.
+	type blobRef struct {
+		sum      [sha256.Size]byte
+		encoding string
+	}
+	blobs := make(map[string]blobRef)
+	for _, name := range names {
+		if !strings.HasPrefix(name, headerPrefix) {
+			continue
+		}
+		time.Sleep(scrubPause)
+
+		encoded, _, err := cache.load(name)
+		if os.IsNotExist(err) {
+			// Deleted since we listed the store.
+			continue
+		}
+		var meta metadata
+		if err == nil {
+			meta, err = decodeMetadata(encoded)
+		}
+		cache.Lock()
+		cache.scrubbed++
+		cache.Unlock()
+		if err != nil {
+			corrupt(name, func() []byte {
+				for url, resource := range cache.memory {
+					if cache.headerName(url) == name {
+						return resource.encodedHeaders
+					}
+				}
+				return nil
+			})
+			continue
+		}
+		blobs[cache.blobName(meta.Sum)] = blobRef{meta.Sum, meta.Encoding}
+	}
+
+	// Then every blob that a header file refers to.
+	for _, name := range names {
+		ref, ok := blobs[name]
+		if !ok {
+			continue
+		}
+		sum := ref.sum
+		time.Sleep(scrubPause)
+
+		stored, _, err := cache.load(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err == nil {
+			err = verify(sum, ref.encoding, stored)
+		}
+		cache.Lock()
+		cache.scrubbed++
+		cache.Unlock()
+		if err != nil {
+			corrupt(name, func() []byte {
+				if b, ok := cache.blobs[sum]; ok && b.file != nil {
+					return b.file.Bytes()
+				}
+				return nil
+			})
+		}
+	}
+}
+
+// scrubEvery runs scrub over and over, resting interval between passes,
+// until the cache is closed.
+func (cache *memoryCache) scrubEvery(interval time.Duration) {
+	for {
+		select {
+		case <-cache.done:
+			return
+		case <-time.After(interval):
+			cache.scrub()
+		}
+	}
+}
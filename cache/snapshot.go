@@ -0,0 +1,267 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrBadSnapshot means Import was given something other than a snapshot written by Export.
+// ErrNewerSnapshot means the snapshot was written by a newer version of the cache.
+var (
+	ErrBadSnapshot   = errors.New("Not a cache snapshot, or a damaged one")
+	ErrNewerSnapshot = errors.New("Snapshot was written by a newer version of the cache: upgrade the cache to import it")
+)
+
+// A snapshot is a tar archive.  It starts with snapshotName, recording its version,
+// then holds a file under bodiesDir per distinct body, named after the body's
+// SHA-256 in hex, and a file under resourcesDir per resource, as a snapshotEntry
+// in JSON.  Every body comes before the first resource that uses it.  Bodies are
+// stored as they were received, neither compressed nor encrypted, so that a
+// snapshot can be imported by any cache, however it is configured.
+const (
+	snapshotName    = "snapshot.json"
+	bodiesDir       = "bodies/"
+	resourcesDir    = "resources/"
+	snapshotVersion = 1
+)
+
+// snapshotManifest is the contents of snapshotName.
+type snapshotManifest struct {
+	Version int `json:"version"`
+}
+
+// snapshotEntry is everything about a resource in a snapshot but its body, which
+// is in the body file named by Body.
+type snapshotEntry struct {
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header,omitempty"`
+	Expires  time.Time   `json:"expires"`
+	NoExpiry bool        `json:"noExpiry,omitempty"`
+	Pinned   bool        `json:"pinned,omitempty"`
+	Status   int         `json:"status,omitempty"`
+	Fetched  time.Time   `json:"fetched"`
+	Body     string      `json:"body"`
+}
+
+// writeTarFile writes a file name holding contents to tw.
+func writeTarFile(tw *tar.Writer, name string, contents []byte) (err error) {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = tw.Write(contents)
+	return err
+}
+
+// export writes a snapshot of every resource in the cache to w.  The cache is
+// only locked a resource at a time, so it carries on serving meanwhile; resources
+// saved or deleted during the export may or may not make it in.  Exporting a
+// resource doesn't count as using it.
+func (cache *memoryCache) export(w io.Writer) (err error) {
+	tw := tar.NewWriter(w)
+	contents, err := json.Marshal(snapshotManifest{Version: snapshotVersion})
+	if err != nil {
+		return err
+	}
+	if err = writeTarFile(tw, snapshotName, contents); err != nil {
+		return err
+	}
+
+	cache.Lock()
+	urls := make([]url.URL, 0, len(cache.memory))
+	for u := range cache.memory {
+		urls = append(urls, u)
+	}
+	cache.Unlock()
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].String() < urls[j].String()
+	})
+
+	written := make(map[[sha256.Size]byte]bool)
+	for i, u := range urls {
+		entry, sum, body, ok := cache.exportResource(u)
+		if !ok {
+			continue
+		}
+		if !written[sum] {
+			if err = writeTarFile(tw, bodiesDir+entry.Body, body); err != nil {
+				return err
+			}
+			written[sum] = true
+		}
+		if contents, err = json.Marshal(entry); err != nil {
+			return err
+		}
+		if err = writeTarFile(tw, fmt.Sprintf("%s%08d.json", resourcesDir, i), contents); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// exportResource returns the resource at u as a snapshot entry, along with its
+// body and the body's SHA-256.  ok is false if it's gone, or its body can't be read.
+func (cache *memoryCache) exportResource(u url.URL) (entry snapshotEntry, sum [sha256.Size]byte, body []byte, ok bool) {
+	cache.Lock()
+	defer cache.Unlock()
+
+	resource, ok := cache.memory[u]
+	if !ok {
+		return entry, sum, nil, false
+	}
+	body, err := cache.blobBody(resource.sum)
+	if err != nil || cache.memory[u] != resource {
+		return entry, sum, nil, false
+	}
+
+	entry = snapshotEntry{
+		URL:      u.String(),
+		Header:   resource.originalHeaders,
+		Expires:  resource.expires,
+		NoExpiry: resource.noExpiry,
+		Pinned:   cache.pinned[u],
+		Status:   resource.status,
+		Fetched:  resource.fetched,
+		Body:     hex.EncodeToString(resource.sum[:]),
+	}
+	return entry, resource.sum, body, true
+}
+
+// blobBody returns a copy of the body with SHA-256 sum, as it was saved, reading
+// it from disk if need be.  The cache must be locked.
+func (cache *memoryCache) blobBody(sum [sha256.Size]byte) (body []byte, err error) {
+	b, err := cache.fetchBlob(sum)
+	if err != nil {
+		return nil, err
+	}
+	if b.encoding == encodingIdentity {
+		// Take a copy; the blob carries on being served once we unlock.
+		return append([]byte(nil), b.file.Bytes()...), nil
+	}
+	return decompress(b.encoding, b.file.Bytes())
+}
+
+// importFrom saves every resource in the snapshot read from r into the cache,
+// as though each had just been saved, replacing any already at the same url.
+// Resources that have expired since the snapshot was taken are left out, and
+// so are any that don't fit.  The cache is locked a resource at a time.
+// Only one body is held at a time: the last one read.  Resources sharing a body
+// read earlier get it from the cache, where the first of them saved it, and are
+// left out too if it didn't fit or has been evicted since.
+func (cache *memoryCache) importFrom(r io.Reader) (err error) {
+	tr := tar.NewReader(r)
+	seen := make(map[string]bool)
+	var last string
+	var lastBody []byte
+	for first := true; ; first = false {
+		header, err := tr.Next()
+		if err == io.EOF && !first {
+			return nil
+		} else if err != nil {
+			return ErrBadSnapshot
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return ErrBadSnapshot
+		}
+
+		switch {
+		case first:
+			var m snapshotManifest
+			if header.Name != snapshotName || json.Unmarshal(contents, &m) != nil || m.Version < 1 {
+				return ErrBadSnapshot
+			}
+			if m.Version > snapshotVersion {
+				return ErrNewerSnapshot
+			}
+		case strings.HasPrefix(header.Name, bodiesDir):
+			sum := sha256.Sum256(contents)
+			name := strings.TrimPrefix(header.Name, bodiesDir)
+			if name != hex.EncodeToString(sum[:]) {
+				return ErrBadSnapshot
+			}
+			seen[name] = true
+			last, lastBody = name, contents
+		case strings.HasPrefix(header.Name, resourcesDir):
+			var entry snapshotEntry
+			if json.Unmarshal(contents, &entry) != nil || !seen[entry.Body] {
+				return ErrBadSnapshot
+			}
+			body, ok := lastBody, true
+			if entry.Body != last {
+				if body, ok = cache.storedBody(entry.Body); !ok {
+					fmt.Println("Not importing", entry.URL, "as its body isn't in the cache")
+					continue
+				}
+			}
+			if err = cache.importResource(entry, body); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// storedBody returns the body in the cache named name, as in a snapshot.
+// ok is false if there isn't one.
+func (cache *memoryCache) storedBody(name string) (body []byte, ok bool) {
+	decoded, err := hex.DecodeString(name)
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, false
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], decoded)
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	body, err = cache.blobBody(sum)
+	return body, err == nil
+}
+
+// importResource saves entry, with body, into the cache.
+func (cache *memoryCache) importResource(entry snapshotEntry, body []byte) (err error) {
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return ErrBadSnapshot
+	}
+	opts := SaveOptions{Header: entry.Header, Status: entry.Status, Fetched: entry.Fetched}
+	if entry.NoExpiry {
+		opts.TTL = NoExpiry
+	} else if !entry.Expires.IsZero() {
+		if opts.TTL = time.Until(entry.Expires); opts.TTL <= 0 {
+			fmt.Println("Not importing", entry.URL, "as it has expired")
+			return nil
+		}
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	if entry.Pinned {
+		cache.pin(*u)
+	}
+	err = cache.saveResource(*u, bytes.NewBuffer(body), cache.nextToGo, opts)
+	if err == ErrCacheSizeExceeded {
+		fmt.Println("Not importing", entry.URL, "as it doesn't fit in the cache")
+		return nil
+	}
+	return err
+}
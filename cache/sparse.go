@@ -0,0 +1,536 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadRange means SavePart or GetPart was given a range that isn't in the resource.
+// ErrNoValidator means SavePart was given a part without a strong validator, so
+// there's no telling whether it's of the same version as the rest; see StrongValidator.
+var (
+	ErrBadRange    = errors.New("Byte range is outside the resource")
+	ErrNoValidator = errors.New("Parts can only be cached with a strong ETag or Last-Modified")
+)
+
+// partPrefix denotes the files of a resource that is only partly cached: its
+// index file, named after the SHA-256 of its url, and a file per piece of its
+// body, named after the index file and the piece's offset.
+// index file name: -p-a-r-t-<hex encoded SHA-256 of the url>
+// piece file name: -p-a-r-t-<hex encoded SHA-256 of the url>-<offset>
+var partPrefix = "-p-a-r-t-"
+
+// Range is Length bytes of a resource's body, starting at Offset.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// end returns the offset just past r.
+func (r Range) end() int64 {
+	return r.Offset + r.Length
+}
+
+// piece is a stored range of a partial resource's body.
+type piece struct {
+	Range
+	data      []byte
+	footprint footprint
+}
+
+// partial is a resource of which only some ranges of its body, size bytes in all,
+// are cached, as pieces sorted by offset that don't overlap or touch: whatever of a
+// new part is already cached is left out, and the rest merged with the pieces next to it.
+// opts are the options to save it with once it's whole.  The encoded index file
+// counts against the cache as footprint, and each piece as its own footprint.
+// saveTime is when it was last used, and expires and noExpiry when it expires,
+// as for a resource.
+type partial struct {
+	size         int64
+	opts         SaveOptions
+	pieces       []*piece
+	saveTime     time.Time
+	expires      time.Time
+	noExpiry     bool
+	encodedIndex []byte
+	footprint    footprint
+}
+
+// partIndex is what is persisted in a partial resource's index file.  Index
+// files written before Expires and NoExpiry were recorded expire once unused.
+type partIndex struct {
+	URL      string
+	Size     int64
+	Header   http.Header
+	Status   int
+	Pieces   []Range
+	Expires  time.Time
+	NoExpiry bool
+}
+
+// partIndexName returns the name of the index file of the partial resource at u.
+func partIndexName(u url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	return partPrefix + hex.EncodeToString(sum[:])
+}
+
+// partPieceName returns the name of the file of the piece at offset of the partial resource at u.
+func partPieceName(u url.URL, offset int64) string {
+	return partIndexName(u) + "-" + strconv.FormatInt(offset, 10)
+}
+
+// isPartIndex reports whether name is the name of a partial resource's index file.
+func isPartIndex(name string) bool {
+	return strings.HasPrefix(name, partPrefix) && !strings.Contains(name[len(partPrefix):], "-")
+}
+
+// total returns the space p takes up in the cache, its index and pieces together.
+func (p *partial) total() (total footprint) {
+	total = p.footprint
+	for _, piece := range p.pieces {
+		total = total.add(piece.footprint)
+	}
+	return total
+}
+
+// missing returns the ranges of r that p doesn't have, in order.
+func (p *partial) missing(r Range) (missing []Range) {
+	at := r.Offset
+	for _, piece := range p.pieces {
+		if piece.end() <= at {
+			continue
+		}
+		if piece.Offset >= r.end() {
+			break
+		}
+		if piece.Offset > at {
+			missing = append(missing, Range{Offset: at, Length: piece.Offset - at})
+		}
+		at = piece.end()
+	}
+	if at < r.end() {
+		missing = append(missing, Range{Offset: at, Length: r.end() - at})
+	}
+	return missing
+}
+
+// read returns the range r of p, which p must have all of.
+func (p *partial) read(r Range) (data []byte) {
+	data = make([]byte, 0, r.Length)
+	for _, piece := range p.pieces {
+		if piece.end() <= r.Offset || piece.Offset >= r.end() {
+			continue
+		}
+		from, to := r.Offset-piece.Offset, r.end()-piece.Offset
+		if from < 0 {
+			from = 0
+		}
+		if to > piece.Length {
+			to = piece.Length
+		}
+		data = append(data, piece.data[from:to]...)
+	}
+	return data
+}
+
+// expired reports whether p has expired: once past the expiry it was saved with,
+// or if it has none, once it has gone unused for idle.
+func (p *partial) expired(idle time.Duration) bool {
+	switch {
+	case p.noExpiry:
+		return false
+	case !p.expires.IsZero():
+		return time.Now().After(p.expires)
+	default:
+		return time.Since(p.saveTime) > idle
+	}
+}
+
+// StrongValidator returns the strong validator of a response with headers h, as
+// in RFC 7232: its ETag, unless it's weak, or else its Last-Modified date, if that
+// is at least a second before its Date.  It is empty if h has neither, in which
+// case ranges of the response can't be told apart from ranges of another version.
+func StrongValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return ""
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err != nil || date.Sub(modified) < time.Second {
+		return ""
+	}
+	return h.Get("Last-Modified")
+}
+
+// savePart saves data as the bytes starting at offset of the body of the resource
+// at u, size bytes in all, merging it into what's cached of it already.  Once all of
+// it is cached, it's saved whole with opts, and the parts dropped.  To make room,
+// other partial resources are evicted first, least recently used first, then
+// whatever resources nextToGo picks.  A resource already cached whole is left be.
+func (cache *memoryCache) savePart(u url.URL, offset int64, data []byte, size int64, opts SaveOptions, nextToGo func(cache *memoryCache) (url.URL, bool)) (err error) {
+	r := Range{Offset: offset, Length: int64(len(data))}
+	if offset < 0 || size <= 0 || r.end() > size {
+		return ErrBadRange
+	}
+	validator := StrongValidator(opts.Header)
+	if validator == "" {
+		return ErrNoValidator
+	}
+	if _, ok := cache.memory[u]; ok || r.Length == 0 {
+		return nil
+	}
+	if cache.readOnly {
+		return ErrReadOnly
+	}
+
+	// Parts of some other version of the resource are no use.
+	p, ok := cache.partials[u]
+	if ok && (p.size != size || StrongValidator(p.opts.Header) != validator) {
+		cache.dropPartial(u)
+		ok = false
+	}
+	if !ok {
+		p = &partial{size: size}
+		cache.partials[u] = p
+	}
+	// The origin has just said how long this version stays fresh, for all of it.
+	meta := newMetadata(opts)
+	p.opts, p.saveTime = opts, time.Now()
+	p.expires, p.noExpiry = meta.Expires, meta.NoExpiry
+
+	// New pieces are only written once they're merged with their neighbours.
+	unwritten := make(map[*piece]bool)
+	for _, gap := range p.missing(r) {
+		newPiece := &piece{
+			Range: gap,
+			data:  append([]byte(nil), data[gap.Offset-offset:gap.end()-offset]...),
+		}
+		newPiece.footprint = measureBody(gap.Length, gap.Length)
+		for !cache.fits(cache.used.add(newPiece.footprint)) {
+			if !cache.makeRoom(u, nextToGo) {
+				cache.dropPartial(u)
+				return ErrCacheSizeExceeded
+			}
+		}
+		i := sort.Search(len(p.pieces), func(i int) bool {
+			return p.pieces[i].Offset > gap.Offset
+		})
+		p.pieces = append(p.pieces, nil)
+		copy(p.pieces[i+1:], p.pieces[i:])
+		p.pieces[i] = newPiece
+		cache.used = cache.used.add(newPiece.footprint)
+		unwritten[newPiece] = true
+	}
+	cache.coalesce(u, p, unwritten)
+
+	// All there?  Then it isn't partial any more.
+	var saveErr error
+	if len(p.missing(Range{Length: size})) == 0 {
+		body := p.read(Range{Length: size})
+		fmt.Println("All of", u.String(), "is cached, saving it whole")
+		if saveErr = cache.saveResource(u, bytes.NewBuffer(body), nextToGo, opts); saveErr == nil {
+			return nil
+		}
+		// Its parts are kept, for what they're worth.
+	}
+	for _, piece := range p.pieces {
+		if unwritten[piece] {
+			cache.persistAsync(partPieceName(u, piece.Offset), piece.data, nil)
+		}
+	}
+	if err = cache.saveIndex(u, p, nextToGo); saveErr != nil {
+		return saveErr
+	}
+	return err
+}
+
+// coalesce merges each run of p's pieces that touch or overlap into the first of
+// them, so that a resource cached a range at a time isn't kept in ever more files.
+// Merged pieces that were written already have their files deleted, and those that
+// grew are added to unwritten, to be written again.  Merging never takes up more room.
+func (cache *memoryCache) coalesce(u url.URL, p *partial, unwritten map[*piece]bool) {
+	var pieces []*piece
+	for _, next := range p.pieces {
+		if len(pieces) == 0 || next.Offset > pieces[len(pieces)-1].end() {
+			pieces = append(pieces, next)
+			continue
+		}
+		last := pieces[len(pieces)-1]
+		cache.used = cache.used.sub(last.footprint).sub(next.footprint)
+		if next.end() > last.end() {
+			// A new slice, as the old one may still be queued to be written.
+			last.data = append(last.data[:last.Length:last.Length], next.data[last.end()-next.Offset:]...)
+			last.Length = int64(len(last.data))
+			last.footprint = measureBody(last.Length, last.Length)
+			unwritten[last] = true
+		}
+		cache.used = cache.used.add(last.footprint)
+		if !unwritten[next] && next.Offset != last.Offset {
+			cache.deleteAsync(partPieceName(u, next.Offset))
+		}
+		delete(unwritten, next)
+	}
+	p.pieces = pieces
+}
+
+// saveIndex is persistIndex for savePart: if the index doesn't fit, room is made for
+// it as for a piece, and if there's none, all of p is dropped.
+func (cache *memoryCache) saveIndex(u url.URL, p *partial, nextToGo func(cache *memoryCache) (url.URL, bool)) (err error) {
+	for err = cache.persistIndex(u, p); err == ErrCacheSizeExceeded; err = cache.persistIndex(u, p) {
+		if !cache.makeRoom(u, nextToGo) {
+			cache.dropPartial(u)
+			return err
+		}
+	}
+	return err
+}
+
+// persistIndex indexes the partial resource p at u and queues its index file to be written.
+func (cache *memoryCache) persistIndex(u url.URL, p *partial) (err error) {
+	if err = cache.indexPartial(u, p); err != nil {
+		return err
+	}
+	cache.persistAsync(partIndexName(u), p.encodedIndex, nil)
+	return nil
+}
+
+// indexPartial encodes the index of the partial resource p at u, and counts it
+// against the cache in place of its last one, if it fits; if not, p is left as it
+// was and the error is ErrCacheSizeExceeded.
+func (cache *memoryCache) indexPartial(u url.URL, p *partial) (err error) {
+	index := partIndex{URL: u.String(), Size: p.size, Header: p.opts.Header, Status: p.opts.Status, Expires: p.expires, NoExpiry: p.noExpiry}
+	for _, piece := range p.pieces {
+		index.Pieces = append(index.Pieces, piece.Range)
+	}
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(index); err != nil {
+		return err
+	}
+	newFootprint := measureEntry(u, int64(buf.Len()))
+	if !cache.fits(cache.used.sub(p.footprint).add(newFootprint)) {
+		return ErrCacheSizeExceeded
+	}
+	cache.used = cache.used.sub(p.footprint).add(newFootprint)
+	p.encodedIndex, p.footprint = buf.Bytes(), newFootprint
+	return nil
+}
+
+// makeRoom evicts the least recently used partial resource other than the one at
+// except, and other than pinned ones, or if there are none, whatever resource nextToGo picks.  It reports
+// whether there was anything to evict.
+func (cache *memoryCache) makeRoom(except url.URL, nextToGo func(cache *memoryCache) (url.URL, bool)) bool {
+	if cache.dropOldestPartial(except) {
+		return true
+	}
+	toRemove, ok := nextToGo(cache)
+	if !ok {
+		return false
+	}
+	cache.deleteResource(toRemove)
+	return true
+}
+
+// dropOldestPartial drops the least recently used partial resource other than
+// the one at except, and reports whether there was one.  Pinned ones are left be.
+func (cache *memoryCache) dropOldestPartial(except url.URL) bool {
+	var oldest url.URL
+	var oldestTime time.Time
+	found := false
+	for u, p := range cache.partials {
+		if u == except || cache.pinned[u] {
+			continue
+		}
+		if !found || p.saveTime.Before(oldestTime) {
+			oldest, oldestTime, found = u, p.saveTime, true
+		}
+	}
+	if found {
+		cache.dropPartial(oldest)
+	}
+	return found
+}
+
+// dropPartial drops what's cached of the partial resource at u, if anything,
+// and dispatches its files to be deleted from disk.
+func (cache *memoryCache) dropPartial(u url.URL) {
+	p, ok := cache.partials[u]
+	if !ok {
+		return
+	}
+	delete(cache.partials, u)
+	cache.used = cache.used.sub(p.footprint)
+	if p.encodedIndex != nil {
+		cache.deleteAsync(partIndexName(u))
+	}
+	for _, piece := range p.pieces {
+		cache.used = cache.used.sub(piece.footprint)
+		cache.deleteAsync(partPieceName(u, piece.Offset))
+	}
+}
+
+// getPart retrieves the range r of the body of the resource at u, cached whole
+// or in part, along with its headers and the size of its whole body.  If some of
+// r isn't cached, data is nil and missing lists what isn't.  Parts that have
+// expired are dropped, as there's no telling if they're still what the origin has.
+func (cache *memoryCache) getPart(u url.URL, r Range) (data []byte, h http.Header, size int64, missing []Range, err error) {
+	if fi, h, err := cache.getResource(u); err == nil {
+		size = int64(fi.Len())
+		if r.Offset < 0 || r.Length < 0 || r.end() > size {
+			return nil, h, size, nil, ErrBadRange
+		}
+		return append([]byte(nil), fi.Bytes()[r.Offset:r.end()]...), h, size, nil, nil
+	}
+
+	p, ok := cache.partials[u]
+	if ok && !cache.pinned[u] && p.expired(cache.expiration) {
+		if cache.staleGrace != NoExpiry {
+			cache.dropPartial(u)
+		}
+		ok = false
+	}
+	if !ok {
+		return nil, nil, 0, nil, ErrResourceNotInCache
+	}
+	if r.Offset < 0 || r.Length < 0 || r.end() > p.size {
+		return nil, p.opts.Header, p.size, nil, ErrBadRange
+	}
+	p.saveTime = time.Now()
+	if missing = p.missing(r); len(missing) > 0 {
+		return nil, p.opts.Header, p.size, missing, nil
+	}
+	return p.read(r), p.opts.Header, p.size, nil, nil
+}
+
+// purgeExpiredPartials drops partial resources that have expired, other than pinned
+// ones, unless the cache keeps what has expired for good; see Config.StaleGrace.
+func (cache *memoryCache) purgeExpiredPartials() {
+	if cache.staleGrace == NoExpiry {
+		return
+	}
+	for u, p := range cache.partials {
+		if !cache.pinned[u] && p.expired(cache.expiration) {
+			cache.dropPartial(u)
+		}
+	}
+}
+
+// loadPartial loads the partial resource whose index file is name, and as many
+// of its pieces as can be read and fit in the cache.  Pieces that can't are
+// left out, to be fetched again; those that didn't fit, or couldn't be read
+// just then, are added to skipped, to be kept on disk for next time.
+func (cache *memoryCache) loadPartial(name string, skipped *unloaded) {
+	encodedIndex, indexStale, err := cache.load(name)
+	if err == ErrAuthenticationFailed {
+		fmt.Println("Refusing to load", name, "as it failed authentication")
+		cache.rejected++
+	} else if err != nil && !os.IsNotExist(err) {
+		skipped.keep(name)
+		skipped.unreadable = true
+	}
+	if err != nil {
+		return
+	}
+	var index partIndex
+	if err = gob.NewDecoder(bytes.NewReader(encodedIndex)).Decode(&index); err != nil {
+		cache.corrupt++
+		cache.quarantine(name)
+		return
+	}
+	u, err := url.Parse(index.URL)
+	if err != nil || partIndexName(*u) != name {
+		cache.corrupt++
+		cache.quarantine(name)
+		return
+	}
+
+	p := &partial{
+		size:     index.Size,
+		opts:     SaveOptions{Header: index.Header, Status: index.Status},
+		saveTime: time.Now(),
+		expires:  index.Expires,
+		noExpiry: index.NoExpiry,
+	}
+	if p.expired(cache.expiration) {
+		// Its files are left for Collect to remove.
+		fmt.Println("Not loading", u.String(), "as its parts have expired")
+		return
+	}
+	changed := indexStale
+	for _, r := range index.Pieces {
+		name := partPieceName(*u, r.Offset)
+		data, pieceStale, err := cache.load(name)
+		if err != nil && err != ErrAuthenticationFailed && !os.IsNotExist(err) {
+			skipped.keep(name)
+			continue
+		}
+		if err != nil || int64(len(data)) != r.Length || r.Offset < 0 || r.end() > p.size {
+			changed = true
+			continue
+		}
+		newPiece := &piece{Range: r, data: data, footprint: measureBody(r.Length, r.Length)}
+		if !cache.fits(cache.used.add(newPiece.footprint)) {
+			skipped.keep(name)
+			continue
+		}
+		p.pieces = append(p.pieces, newPiece)
+		cache.used = cache.used.add(newPiece.footprint)
+		// Pieces sealed under an old key are re-sealed under the current one.
+		if pieceStale {
+			cache.persistAsync(name, data, nil)
+		}
+	}
+	sort.Slice(p.pieces, func(i, j int) bool {
+		return p.pieces[i].Offset < p.pieces[j].Offset
+	})
+
+	// Write the index back if it no longer says what's cached.
+	cache.partials[*u] = p
+	if changed && !cache.readOnly {
+		err = cache.persistIndex(*u, p)
+	} else {
+		err = cache.indexPartial(*u, p)
+	}
+	if err != nil {
+		cache.dropPartial(*u)
+		return
+	}
+	fmt.Printf("Loaded %d pieces of %s into memory\n", len(p.pieces), u.String())
+}
+
+// partFileUnused reports whether name, a partial resource's index or piece file,
+// belongs to no partial resource in the cache.
+func (cache *memoryCache) partFileUnused(name string) bool {
+	for u, p := range cache.partials {
+		index := partIndexName(u)
+		if name == index {
+			return false
+		}
+		if !strings.HasPrefix(name, index+"-") {
+			continue
+		}
+		offset, err := strconv.ParseInt(name[len(index)+1:], 10, 64)
+		if err != nil {
+			return true
+		}
+		for _, piece := range p.pieces {
+			if piece.Offset == offset {
+				return false
+			}
+		}
+		return true
+	}
+	return true
+}
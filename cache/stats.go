@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"net/url"
+)
+
+// Dimension selects which measure of cache usage is held to the configured
+// maximum size.  The same maximum size applies to both the memory cache and
+// the disk cache, but the two footprints differ: headers and bookkeeping live
+// in memory, and files on disk are rounded up to whole filesystem blocks.
+type Dimension int
+
+const (
+	// DimensionMemory caps the estimated in-memory footprint of the cache:
+	// response bodies, encoded headers and per-entry bookkeeping.
+	// This is the default.
+	DimensionMemory Dimension = iota
+
+	// DimensionLogical caps the sum of distinct response body sizes only.
+	// This was the only accounting the cache used to do.
+	DimensionLogical
+
+	// DimensionDisk caps the on-disk footprint of the cache: body and header
+	// files, each rounded up to a whole number of filesystem blocks.
+	DimensionDisk
+)
+
+// diskBlockSize is the allocation unit assumed for files at the mount path.
+// Most filesystems allocate 4kB blocks, so a 1 byte header file still costs
+// 4kB on disk.
+const diskBlockSize int64 = 4096
+
+// entryOverhead is an estimate, in bytes, of the memory used to track a single
+// cache entry beyond its body and headers: the resource struct, its map bucket
+// and the url.URL key.  It doesn't need to be exact, it just needs to stop a
+// cache full of tiny resources from pretending it uses no memory at all.
+const entryOverhead int64 = 256
+
+// Stats is a snapshot of how much space a cache is using.
+type Stats struct {
+	// Entries is the number of resources currently in the cache.
+	Entries int
+
+	// LogicalBytes is the sum of the sizes of all distinct response bodies in
+	// the cache, before any compression.  Resources with identical bodies share
+	// them, so DedupedBytes counts the body bytes that sharing saved.
+	LogicalBytes int64
+	DedupedBytes int64
+
+	// MemoryBytes is the estimated in-memory footprint of the cache, including
+	// headers and per-entry bookkeeping.
+	MemoryBytes int64
+
+	// DiskBytes is the on-disk footprint of the cache, including header files
+	// and filesystem block rounding.
+	DiskBytes int64
+
+	// PinnedEntries is the number of pinned resources in the cache, and
+	// PinnedBytes is the space they take up, measured along Dimension.
+	PinnedEntries int
+	PinnedBytes   int64
+
+	// RejectedEntries is the number of files that were refused when the cache
+	// was loaded from disk because they failed authentication.
+	RejectedEntries int
+
+	// CorruptFiles is the number of files found not to match their checksum,
+	// when the cache was loaded from disk or by the background scrubber.
+	// Corrupt files are moved into the quarantine folder at the mount path.
+	// ScrubbedFiles is the number of files the scrubber has checked so far.
+	CorruptFiles  int
+	ScrubbedFiles int
+
+	// ColdBodies is the number of response bodies that are still only on disk,
+	// and will be read the first time they are asked for; see Config.Lazy.
+	ColdBodies int
+
+	// CollectedFiles is the number of unused files removed from disk, at startup
+	// and by Cache.Collect, and ReclaimedBytes is how much space that freed.
+	CollectedFiles int
+	ReclaimedBytes int64
+
+	// IOErrors is the number of writes to and deletes from disk that have failed;
+	// see Config.OnIOError.  MemoryOnlyEntries is the number of resources in the
+	// cache that couldn't be saved to disk, and so won't survive a restart.
+	IOErrors          int
+	MemoryOnlyEntries int
+
+	// MountPathsDown is the number of Config.MountPaths (or stripes of a
+	// StripedStore) that have failed, and that the cache carries on without.
+	MountPathsDown int
+
+	// FreeDiskBytes is the free space on the mount path's filesystem when it was
+	// last measured, and DiskBudget is how much disk the cache may use so that
+	// Config.MinFreeDisk stays free.  Both are zero unless MinFreeDisk is set.
+	FreeDiskBytes int64
+	DiskBudget    int64
+
+	// MaxBytes is the configured maximum size of the cache, less the share of any
+	// failed mount paths, and Dimension is the measure that MaxBytes is enforced against.
+	MaxBytes  int64
+	Dimension Dimension
+}
+
+// footprint is the space used by a single resource, or by the whole cache,
+// measured along each Dimension.
+type footprint struct {
+	logical int64
+	memory  int64
+	disk    int64
+}
+
+// add returns the sum of f and g.
+func (f footprint) add(g footprint) footprint {
+	return footprint{
+		logical: f.logical + g.logical,
+		memory:  f.memory + g.memory,
+		disk:    f.disk + g.disk,
+	}
+}
+
+// sub returns f with g taken away.
+func (f footprint) sub(g footprint) footprint {
+	return footprint{
+		logical: f.logical - g.logical,
+		memory:  f.memory - g.memory,
+		disk:    f.disk - g.disk,
+	}
+}
+
+// get returns the measure of f along dimension d.
+func (f footprint) get(d Dimension) int64 {
+	switch d {
+	case DimensionLogical:
+		return f.logical
+	case DimensionDisk:
+		return f.disk
+	default:
+		return f.memory
+	}
+}
+
+// blocks rounds size up to a whole number of disk blocks.
+func blocks(size int64) int64 {
+	return (size + diskBlockSize - 1) / diskBlockSize * diskBlockSize
+}
+
+// measureBody returns the footprint of a response body of bodySize bytes,
+// stored in storedSize bytes once compressed.
+func measureBody(bodySize, storedSize int64) footprint {
+	return footprint{
+		logical: bodySize,
+		memory:  storedSize,
+		disk:    blocks(storedSize),
+	}
+}
+
+// measureEntry returns the footprint of a resource saved under url u with
+// a header file of headerSize bytes, not counting its (possibly shared) body.
+func measureEntry(u url.URL, headerSize int64) footprint {
+	return footprint{
+		memory: headerSize + entryOverhead + int64(len(u.String())),
+		disk:   blocks(headerSize),
+	}
+}
@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotADirectory means a store was asked to live somewhere that isn't a directory.
+var ErrNotADirectory = errors.New("Mount path exists but is not a directory")
+
+// Store is where a cache persists its files.  Files are named by flat
+// strings such as those returned by ToHeaderDiskString and ToBlobDiskString;
+// a store may hold files with other names too, and the cache ignores them.
+// All operations on Store should be thread safe.
+type Store interface {
+	// Put saves contents as the file name, replacing any previous contents.
+	// Once Put returns, contents must survive a restart.
+	Put(name string, contents []byte) error
+
+	// Get retrieves the contents of the file name.  If there is no such file,
+	// the error satisfies os.IsNotExist.
+	Get(name string) ([]byte, error)
+
+	// Delete removes the file name.  Deleting a file that doesn't exist
+	// returns an error satisfying os.IsNotExist.
+	Delete(name string) error
+
+	// List returns the names of all files in the store, in sorted order.
+	List() ([]string, error)
+
+	// Stat returns the size in bytes of the file name.
+	Stat(name string) (int64, error)
+}
+
+// notExist returns an error satisfying os.IsNotExist for the file name.
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// DirStore is a Store keeping one file per name in a single directory.
+// This is the cache's default store.  unsynced holds the paths written
+// by PutNoSync since the last Sync.
+type DirStore struct {
+	dir      string
+	unsynced map[string]bool
+	sync.Mutex
+}
+
+// NewDirStore returns a DirStore in dir, creating dir if it doesn't exist yet.
+func NewDirStore(dir string) (store *DirStore, err error) {
+	if err = makeDir(dir); err != nil {
+		return nil, err
+	}
+	return &DirStore{dir: dir, unsynced: make(map[string]bool)}, nil
+}
+
+// makeDir creates the directory dir if it doesn't exist yet.
+func makeDir(dir string) (err error) {
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		// Mount path doesn't exist, make it.
+		return os.Mkdir(dir, os.ModePerm)
+	} else if err != nil {
+		return err
+	} else if !stat.IsDir() {
+		return ErrNotADirectory
+	}
+	return nil
+}
+
+// Put implements Store.Put for a DirStore.  Names containing a '/' are
+// written into subdirectories, which List doesn't descend into.
+func (store *DirStore) Put(name string, contents []byte) (err error) {
+	path := filepath.Join(store.dir, name)
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	return writeFile(path, contents, true)
+}
+
+// PutNoSync implements Syncer.PutNoSync for a DirStore.
+func (store *DirStore) PutNoSync(name string, contents []byte) (err error) {
+	path := filepath.Join(store.dir, name)
+	if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err = writeFile(path, contents, false); err != nil {
+		return err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	store.unsynced[path] = true
+	return nil
+}
+
+// Sync implements Syncer.Sync for a DirStore.  It flushes every file written
+// by PutNoSync, then the directory, so that the renames stick too.  Files that
+// have been deleted since don't need flushing.
+func (store *DirStore) Sync() (err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for path := range store.unsynced {
+		if err = syncPath(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(store.unsynced, path)
+	}
+	return syncPath(store.dir)
+}
+
+// syncPath flushes the file or directory at path to disk.
+func syncPath(path string) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// Get implements Store.Get for a DirStore.
+func (store *DirStore) Get(name string) (contents []byte, err error) {
+	return ioutil.ReadFile(filepath.Join(store.dir, name))
+}
+
+// Delete implements Store.Delete for a DirStore.
+func (store *DirStore) Delete(name string) (err error) {
+	return os.Remove(filepath.Join(store.dir, name))
+}
+
+// List implements Store.List for a DirStore.  Only files directly in the
+// directory are listed.
+func (store *DirStore) List() (names []string, err error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+// Stat implements Store.Stat for a DirStore.
+func (store *DirStore) Stat(name string) (size int64, err error) {
+	stat, err := os.Stat(filepath.Join(store.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// writeFile creates the file at path, fills it with contents and, if sync is set,
+// flushes it to disk.  The file is written under a temporary name (see tmpPrefix)
+// and renamed into place once complete, so nothing ever reads a half written file.
+func writeFile(path string, contents []byte, sync bool) (err error) {
+	// Create the file.
+	toSave, err := ioutil.TempFile(filepath.Dir(path), tmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(toSave.Name())
+	defer toSave.Close()
+
+	// Copy contents over.  We dont wan't to drain an in-memory buffer,
+	// so contents should be a copy or a view of its bytes.
+	if _, err = toSave.Write(contents); err != nil {
+		return err
+	}
+
+	// Flush file contents to disk, and move the file into place.
+	if sync {
+		if err = toSave.Sync(); err != nil {
+			return err
+		}
+	}
+	return os.Rename(toSave.Name(), path)
+}
+
+// MemoryStore is a Store that keeps everything in memory.  Nothing survives
+// a restart, so it is only really useful for tests.
+type MemoryStore struct {
+	files map[string][]byte
+	sync.Mutex
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() (store *MemoryStore) {
+	return &MemoryStore{files: make(map[string][]byte)}
+}
+
+// Put implements Store.Put for a MemoryStore.
+func (store *MemoryStore) Put(name string, contents []byte) (err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	// Take a copy; the caller may reuse contents.
+	store.files[name] = append([]byte(nil), contents...)
+	return nil
+}
+
+// Get implements Store.Get for a MemoryStore.
+func (store *MemoryStore) Get(name string) (contents []byte, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	contents, ok := store.files[name]
+	if !ok {
+		return nil, notExist("get", name)
+	}
+	return append([]byte(nil), contents...), nil
+}
+
+// Delete implements Store.Delete for a MemoryStore.
+func (store *MemoryStore) Delete(name string) (err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.files[name]; !ok {
+		return notExist("delete", name)
+	}
+	delete(store.files, name)
+	return nil
+}
+
+// List implements Store.List for a MemoryStore.
+func (store *MemoryStore) List() (names []string, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for name := range store.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// PutNoSync implements Syncer.PutNoSync for a MemoryStore.
+func (store *MemoryStore) PutNoSync(name string, contents []byte) (err error) {
+	return store.Put(name, contents)
+}
+
+// Sync implements Syncer.Sync for a MemoryStore.  There is no disk to flush to.
+func (store *MemoryStore) Sync() (err error) {
+	return nil
+}
+
+// Stat implements Store.Stat for a MemoryStore.
+func (store *MemoryStore) Stat(name string) (size int64, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	contents, ok := store.files[name]
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return int64(len(contents)), nil
+}
@@ -0,0 +1,668 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNameTooLong means a file name doesn't fit in a log record.
+var ErrNameTooLong = errors.New("File name is too long for a log record")
+
+// A LogStore appends to segment files named segmentPrefix<id>segmentSuffix, and
+// indexes each sealed segment in a hint file named segmentPrefix<id>hintSuffix.
+// legacyLogName is the single log kept by LogStores before they were split into segments.
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".log"
+	hintSuffix    = ".hint"
+	legacyLogName = "cache.log"
+)
+
+// Every record in a segment is laid out as:
+// CRC-32 of the rest | op | name length (2 bytes) | data length (4 bytes) | name | data
+// A put record carries the new contents of name as its data; a delete record has none.
+const logHeaderSize = 4 + 1 + 2 + 4
+
+// Every record in a hint file is laid out as:
+// op | name length (2 bytes) | record offset in the segment (8 bytes) | data length (4 bytes) | name
+// and the hint file ends with the CRC-32 of everything before it.
+const hintHeaderSize = 1 + 2 + 8 + 4
+
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+// Defaults for LogConfig.
+const (
+	defaultSegmentSize     = 64 * 1000000
+	defaultGarbageRatio    = 0.5
+	defaultCompactInterval = time.Minute
+)
+
+// LogConfig holds the settings used to open a LogStore with NewLogStoreWithConfig.
+type LogConfig struct {
+	// SegmentSize is how large, in bytes, a segment may grow before the
+	// store moves on to a new one.  Defaults to 64MB.
+	SegmentSize int64
+
+	// GarbageRatio is the fraction of a sealed segment that must be overwritten
+	// or deleted records before compaction rewrites it.  Defaults to 0.5.
+	GarbageRatio float64
+
+	// CompactInterval, if set, is how often the store compacts its segments
+	// in the background.  See LogStore.Compact.
+	CompactInterval time.Duration
+
+	// ReadOnly opens the store without writing anything, for tools that inspect
+	// a store another process is using.  Puts and deletes fail with ErrReadOnly.
+	// Unless ReadOnly is set, the store locks its directory against use by any
+	// other process, and fails with ErrLocked if it can't.
+	ReadOnly bool
+}
+
+// segment is one file of a LogStore.  size is how many bytes of it are good
+// records, and live is how many of those the index still points to.
+// hints lists every record in the segment; it is only kept for the active
+// segment, and written out to a hint file when the segment is sealed.
+type segment struct {
+	id    uint64
+	file  *os.File
+	size  int64
+	live  int64
+	hints []hint
+}
+
+// hint locates one record in a segment.
+type hint struct {
+	op     byte
+	name   string
+	offset int64
+	size   int64
+}
+
+// recordSize returns the size of the record h locates.
+func (h hint) recordSize() int64 {
+	return logHeaderSize + int64(len(h.name)) + h.size
+}
+
+// logEntry locates the current contents of a file in a LogStore.
+type logEntry struct {
+	segment *segment
+	hint
+}
+
+// LogStore is a Store keeping every file in a handful of append-only segment files,
+// so that a cache of many small files doesn't need a directory entry (and an inode)
+// for each.  Puts and deletes are appended to the newest, active, segment as records;
+// once it grows past its size it is sealed, and indexed in a hint file.  An index of
+// where each file's latest contents sit is kept in memory.  On startup it is rebuilt
+// from the hint files, so only the active segment has to be read in full.
+// Overwritten and deleted records are garbage; compaction copies what is still live
+// out of sealed segments that are mostly garbage, and deletes them.
+// The store holds lock on dir until it is closed.
+type LogStore struct {
+	dir      string
+	config   LogConfig
+	segments []*segment
+	index    map[string]logEntry
+	lock     *mountLock
+	done     chan struct{}
+	sync.Mutex
+}
+
+// NewLogStore returns a LogStore in dir with the default LogConfig, compacting
+// in the background every minute.
+func NewLogStore(dir string) (store *LogStore, err error) {
+	return NewLogStoreWithConfig(dir, LogConfig{CompactInterval: defaultCompactInterval})
+}
+
+// NewLogStoreWithConfig returns a LogStore in dir configured by config, creating dir
+// if it doesn't exist yet.  Anything already logged there is indexed.
+func NewLogStoreWithConfig(dir string, config LogConfig) (store *LogStore, err error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = defaultSegmentSize
+	}
+	if config.GarbageRatio <= 0 {
+		config.GarbageRatio = defaultGarbageRatio
+	}
+	if err = makeDir(dir); err != nil {
+		return nil, err
+	}
+	lock, err := lockMountPath(dir, config.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+
+	store = &LogStore{
+		dir:    dir,
+		config: config,
+		index:  make(map[string]logEntry),
+		lock:   lock,
+		done:   make(chan struct{}),
+	}
+	if err = store.rebuild(); err != nil {
+		store.closeSegments()
+		lock.unlock()
+		return nil, err
+	}
+	if config.CompactInterval > 0 && !config.ReadOnly {
+		go store.compactEvery(config.CompactInterval)
+	}
+	return store, nil
+}
+
+// segmentPath returns the path of the segment file with id id.
+func (store *LogStore) segmentPath(id uint64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, segmentSuffix))
+}
+
+// hintPath returns the path of the hint file for the segment with id id.
+func (store *LogStore) hintPath(id uint64) string {
+	return filepath.Join(store.dir, fmt.Sprintf("%s%08d%s", segmentPrefix, id, hintSuffix))
+}
+
+// openSegment opens the segment file with id id, creating it if need be.
+func (store *LogStore) openSegment(id uint64) (seg *segment, err error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if store.config.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(store.segmentPath(id), flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{id: id, file: file}, nil
+}
+
+// rebuild opens every segment in the store's directory and rebuilds the index from
+// them, oldest first.  Sealed segments are indexed from their hint files where
+// possible; the active segment is always read in full.
+func (store *LogStore) rebuild() (err error) {
+	// A log from before segments is the first segment.
+	legacy := filepath.Join(store.dir, legacyLogName)
+	if _, err = os.Stat(legacy); err == nil {
+		if store.config.ReadOnly {
+			// It needs renaming, which we can't do.  Open it read-write once first.
+			return ErrReadOnly
+		}
+		if err = os.Rename(legacy, store.segmentPath(1)); err != nil {
+			return err
+		}
+	}
+
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) == 0 && !store.config.ReadOnly {
+		ids = append(ids, 1)
+	}
+
+	for i, id := range ids {
+		seg, err := store.openSegment(id)
+		if err != nil {
+			return err
+		}
+		store.segments = append(store.segments, seg)
+
+		active := i == len(ids)-1
+		var hints []hint
+		if !active {
+			hints, err = store.readHints(seg)
+		}
+		if active || err != nil {
+			if hints, err = store.scan(seg, active && !store.config.ReadOnly); err != nil {
+				return err
+			}
+		}
+		for _, h := range hints {
+			store.apply(seg, h)
+		}
+		if active {
+			seg.hints = hints
+		}
+	}
+	return nil
+}
+
+// scan reads every record in seg, returning hints for them and setting seg.size.
+// A record cut short or garbled by a crash while it was being appended ends
+// the segment; if truncate is set, it is cut off, so that the next record
+// appended follows the last good one.
+func (store *LogStore) scan(seg *segment, truncate bool) (hints []hint, err error) {
+	r := bufio.NewReader(io.NewSectionReader(seg.file, 0, 1<<62))
+	var offset int64
+	for {
+		var header [logHeaderSize]byte
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			break
+		}
+		nameLen := int64(binary.BigEndian.Uint16(header[5:7]))
+		dataLen := int64(binary.BigEndian.Uint32(header[7:11]))
+		rest := make([]byte, nameLen+dataLen)
+		if _, err = io.ReadFull(r, rest); err != nil {
+			break
+		}
+		sum := crc32.NewIEEE()
+		sum.Write(header[4:])
+		sum.Write(rest)
+		if sum.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+			break
+		}
+
+		h := hint{op: header[4], name: string(rest[:nameLen]), offset: offset, size: dataLen}
+		hints = append(hints, h)
+		offset += h.recordSize()
+	}
+	seg.size = offset
+	if truncate {
+		return hints, seg.file.Truncate(offset)
+	}
+	return hints, nil
+}
+
+// readHints reads the hint file for seg, and sets seg.size.
+func (store *LogStore) readHints(seg *segment) (hints []hint, err error) {
+	contents, err := ioutil.ReadFile(store.hintPath(seg.id))
+	if err != nil {
+		return nil, err
+	}
+	if len(contents) < 4 || crc32.ChecksumIEEE(contents[:len(contents)-4]) != binary.BigEndian.Uint32(contents[len(contents)-4:]) {
+		return nil, ErrChecksumMismatch
+	}
+	contents = contents[:len(contents)-4]
+
+	for len(contents) > 0 {
+		if len(contents) < hintHeaderSize {
+			return nil, ErrChecksumMismatch
+		}
+		nameLen := int(binary.BigEndian.Uint16(contents[1:3]))
+		if len(contents) < hintHeaderSize+nameLen {
+			return nil, ErrChecksumMismatch
+		}
+		h := hint{
+			op:     contents[0],
+			offset: int64(binary.BigEndian.Uint64(contents[3:11])),
+			size:   int64(binary.BigEndian.Uint32(contents[11:15])),
+			name:   string(contents[hintHeaderSize : hintHeaderSize+nameLen]),
+		}
+		hints = append(hints, h)
+		seg.size = h.offset + h.recordSize()
+		contents = contents[hintHeaderSize+nameLen:]
+	}
+	return hints, nil
+}
+
+// writeHints writes the hint file for seg, from seg.hints.
+func (store *LogStore) writeHints(seg *segment) (err error) {
+	var buf bytes.Buffer
+	for _, h := range seg.hints {
+		var header [hintHeaderSize]byte
+		header[0] = h.op
+		binary.BigEndian.PutUint16(header[1:3], uint16(len(h.name)))
+		binary.BigEndian.PutUint64(header[3:11], uint64(h.offset))
+		binary.BigEndian.PutUint32(header[11:15], uint32(h.size))
+		buf.Write(header[:])
+		buf.WriteString(h.name)
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+	return writeFile(store.hintPath(seg.id), buf.Bytes(), true)
+}
+
+// apply updates the index with the record h in seg.
+func (store *LogStore) apply(seg *segment, h hint) {
+	if old, ok := store.index[h.name]; ok {
+		old.segment.live -= old.recordSize()
+	}
+	switch h.op {
+	case opPut:
+		store.index[h.name] = logEntry{segment: seg, hint: h}
+		seg.live += h.recordSize()
+	case opDelete:
+		delete(store.index, h.name)
+	}
+}
+
+// active returns the segment being appended to.
+func (store *LogStore) active() (seg *segment) {
+	return store.segments[len(store.segments)-1]
+}
+
+// roll seals the active segment, flushing it and writing out its hint file, and starts a new one.
+func (store *LogStore) roll() (err error) {
+	seg := store.active()
+	if err = seg.file.Sync(); err != nil {
+		return err
+	}
+	if err = store.writeHints(seg); err != nil {
+		return err
+	}
+	next, err := store.openSegment(seg.id + 1)
+	if err != nil {
+		return err
+	}
+	seg.hints = nil
+	store.segments = append(store.segments, next)
+	return nil
+}
+
+// appendRecord appends a record of op on name, with data, to the active segment and,
+// if sync is set, flushes it to disk, starting a new segment first if this one is full.
+// The caller should apply the returned hint to the index.
+func (store *LogStore) appendRecord(op byte, name string, data []byte, sync bool) (h hint, err error) {
+	if len(name) > 0xffff {
+		return h, ErrNameTooLong
+	}
+	record := make([]byte, logHeaderSize+len(name)+len(data))
+	record[4] = op
+	binary.BigEndian.PutUint16(record[5:7], uint16(len(name)))
+	binary.BigEndian.PutUint32(record[7:11], uint32(len(data)))
+	copy(record[logHeaderSize:], name)
+	copy(record[logHeaderSize+len(name):], data)
+	binary.BigEndian.PutUint32(record[:4], crc32.ChecksumIEEE(record[4:]))
+
+	seg := store.active()
+	if seg.size > 0 && seg.size+int64(len(record)) > store.config.SegmentSize {
+		if err = store.roll(); err != nil {
+			return h, err
+		}
+		seg = store.active()
+	}
+	if _, err = seg.file.WriteAt(record, seg.size); err != nil {
+		return h, err
+	}
+	if sync {
+		if err = seg.file.Sync(); err != nil {
+			return h, err
+		}
+	}
+	h = hint{op: op, name: name, offset: seg.size, size: int64(len(data))}
+	seg.size += int64(len(record))
+	seg.hints = append(seg.hints, h)
+	return h, nil
+}
+
+// read returns the contents entry locates.
+func (store *LogStore) read(entry logEntry) (contents []byte, err error) {
+	contents = make([]byte, entry.size)
+	if _, err = entry.segment.file.ReadAt(contents, entry.offset+logHeaderSize+int64(len(entry.name))); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// Put implements Store.Put for a LogStore.
+func (store *LogStore) Put(name string, contents []byte) (err error) {
+	return store.put(name, contents, true)
+}
+
+// PutNoSync implements Syncer.PutNoSync for a LogStore.
+func (store *LogStore) PutNoSync(name string, contents []byte) (err error) {
+	return store.put(name, contents, false)
+}
+
+// put appends a record putting contents as name, flushing it to disk if sync is set.
+func (store *LogStore) put(name string, contents []byte, sync bool) (err error) {
+	if store.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	h, err := store.appendRecord(opPut, name, contents, sync)
+	if err != nil {
+		return err
+	}
+	store.apply(store.active(), h)
+	return nil
+}
+
+// Sync implements Syncer.Sync for a LogStore.  Sealed segments were flushed
+// when they were sealed, so only the active one needs it.
+func (store *LogStore) Sync() (err error) {
+	if store.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	return store.active().file.Sync()
+}
+
+// Get implements Store.Get for a LogStore.
+func (store *LogStore) Get(name string) (contents []byte, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.index[name]
+	if !ok {
+		return nil, notExist("get", name)
+	}
+	return store.read(entry)
+}
+
+// Delete implements Store.Delete for a LogStore.
+func (store *LogStore) Delete(name string) (err error) {
+	if store.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	if _, ok := store.index[name]; !ok {
+		return notExist("delete", name)
+	}
+	h, err := store.appendRecord(opDelete, name, nil, true)
+	if err != nil {
+		return err
+	}
+	store.apply(store.active(), h)
+	return nil
+}
+
+// List implements Store.List for a LogStore.
+func (store *LogStore) List() (names []string, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	for name := range store.index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Stat implements Store.Stat for a LogStore.
+func (store *LogStore) Stat(name string) (size int64, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.index[name]
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return entry.size, nil
+}
+
+// Compact rewrites every sealed segment that is at least GarbageRatio garbage:
+// live records are copied into the active segment, and the old segment deleted.
+// It returns how many bytes of disk were reclaimed.  The store is only locked
+// a record at a time, so Compact can run alongside everything else.
+func (store *LogStore) Compact() (reclaimed int64, err error) {
+	if store.config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	store.Lock()
+	var candidates []*segment
+	for _, seg := range store.segments[:len(store.segments)-1] {
+		if seg.size == 0 || float64(seg.size-seg.live)/float64(seg.size) >= store.config.GarbageRatio {
+			candidates = append(candidates, seg)
+		}
+	}
+	store.Unlock()
+
+	for _, seg := range candidates {
+		size, err := store.compactSegment(seg)
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += size
+	}
+	return reclaimed, nil
+}
+
+// compactSegment copies every live record out of the sealed segment seg into the
+// active segment, then deletes seg.  It returns the size of seg.
+func (store *LogStore) compactSegment(seg *segment) (size int64, err error) {
+	// Copy forward every file whose latest contents are in seg, one at a time.
+	store.Lock()
+	var names []string
+	for name, entry := range store.index {
+		if entry.segment == seg {
+			names = append(names, name)
+		}
+	}
+	store.Unlock()
+	for _, name := range names {
+		if err = store.copyForward(seg, name); err != nil {
+			return 0, err
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	// Anything written since we listed names went to the active segment,
+	// so nothing points into seg anymore; drop it, unless someone beat us to it.
+	found := false
+	for i, s := range store.segments {
+		if s == seg {
+			store.segments = append(store.segments[:i], store.segments[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+
+	// A delete record only matters while an older segment may still hold
+	// contents for its file, so carry those forward too unless seg is the oldest.
+	if seg.id > store.segments[0].id {
+		hints, err := store.readHints(seg)
+		if err != nil {
+			if hints, err = store.scan(seg, false); err != nil {
+				return 0, err
+			}
+		}
+		for _, h := range hints {
+			if _, ok := store.index[h.name]; h.op == opDelete && !ok {
+				if _, err = store.appendRecord(opDelete, h.name, nil, true); err != nil {
+					return 0, err
+				}
+			}
+		}
+	}
+
+	seg.file.Close()
+	os.Remove(store.hintPath(seg.id))
+	return seg.size, os.Remove(store.segmentPath(seg.id))
+}
+
+// copyForward copies the contents of name into the active segment, if they
+// are still in seg.
+func (store *LogStore) copyForward(seg *segment, name string) (err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	entry, ok := store.index[name]
+	if !ok || entry.segment != seg {
+		return nil
+	}
+	contents, err := store.read(entry)
+	if err != nil {
+		return err
+	}
+	h, err := store.appendRecord(opPut, name, contents, true)
+	if err != nil {
+		return err
+	}
+	store.apply(store.active(), h)
+	return nil
+}
+
+// compactEvery runs Compact over and over, resting interval between runs,
+// until the store is closed.
+func (store *LogStore) compactEvery(interval time.Duration) {
+	for {
+		select {
+		case <-store.done:
+			return
+		case <-time.After(interval):
+			store.Compact()
+		}
+	}
+}
+
+// closeSegments closes every segment file.
+func (store *LogStore) closeSegments() (err error) {
+	for _, seg := range store.segments {
+		if closeErr := seg.file.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Close stops background compaction, closes the store's files and unlocks
+// its directory.  The store can't be used afterwards.
+func (store *LogStore) Close() (err error) {
+	close(store.done)
+
+	store.Lock()
+	defer store.Unlock()
+
+	err = store.closeSegments()
+	if unlockErr := store.lock.unlock(); err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// locks implements locker for a LogStore.
+func (store *LogStore) locks(dir string) bool {
+	return store.lock.holds(dir)
+}
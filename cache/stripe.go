@@ -0,0 +1,406 @@
+package cache
+
+import (
+	"errors"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoStripes means a StripedStore was given no stores, or every one of them has failed.
+var ErrNoStripes = errors.New("No mount paths left to store files in")
+
+// stripeReplicas is how many points on the hash ring each unit of weight gets.
+// More points spread files more evenly.
+const stripeReplicas = 64
+
+// Stripe is one of the stores a StripedStore spreads files over.  Weight is its
+// share of the files, relative to the other stripes; 0 counts as 1.
+type Stripe struct {
+	Store  Store
+	Weight int
+}
+
+// StripedStore is a Store spreading files over several stores, such as DirStores
+// on different disks, by consistent hashing: every stripe owns points on a ring
+// in proportion to its weight, and each file goes to the stripe owning the next
+// point round the ring from the file's hash.  Stripes are identified by their
+// position, so adding one to the end only moves the files it takes on.
+// A stripe that fails is taken out of the ring: the files on it are out of reach,
+// but the others carry on, and files it would have held go to the next stripe round.
+// Once it works again, it can be put back; see revive.
+// down marks the failed stripes, and onDown, if set, is told about each one.
+// strayed is set once any stripe has failed: from then on a file may have an
+// older copy in a stripe other than the one it is put in, which putting it deletes.
+type StripedStore struct {
+	stripes []Stripe
+	down    []bool
+	strayed bool
+	ring    []ringPoint
+	onDown  func(stripe int, err error)
+	sync.Mutex
+}
+
+// ringPoint is a point on a StripedStore's hash ring, owned by the stripe at index stripe.
+type ringPoint struct {
+	hash   uint32
+	stripe int
+}
+
+// NewStripedStore returns a StripedStore over stripes.  Keep stripes in the same
+// order from one run to the next, so that files are looked for where they were put.
+func NewStripedStore(stripes []Stripe) (store *StripedStore, err error) {
+	if len(stripes) == 0 {
+		return nil, ErrNoStripes
+	}
+	store = &StripedStore{stripes: stripes, down: make([]bool, len(stripes))}
+	for i, stripe := range stripes {
+		weight := stripe.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		for j := 0; j < weight*stripeReplicas; j++ {
+			point := ringPoint{hash: ringHash(strconv.Itoa(i) + "-" + strconv.Itoa(j)), stripe: i}
+			store.ring = append(store.ring, point)
+		}
+	}
+	sort.Slice(store.ring, func(i, j int) bool {
+		return store.ring[i].hash < store.ring[j].hash
+	})
+	return store, nil
+}
+
+// ringHash places key on the ring.
+func ringHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// owners returns the stripes that are still up, in the order the file name
+// should be looked for in them: its own stripe first, then the ones after it
+// round the ring.
+func (store *StripedStore) owners(name string) (owners []int) {
+	store.Lock()
+	defer store.Unlock()
+
+	seen := make([]bool, len(store.stripes))
+	start := sort.Search(len(store.ring), func(i int) bool {
+		return store.ring[i].hash >= ringHash(name)
+	})
+	for i := 0; i < len(store.ring) && len(owners) < len(store.stripes); i++ {
+		stripe := store.ring[(start+i)%len(store.ring)].stripe
+		if !seen[stripe] && !store.down[stripe] {
+			owners = append(owners, stripe)
+		}
+		seen[stripe] = true
+	}
+	return owners
+}
+
+// failed reports whether err means stripe has failed, taking it out of the
+// ring if so.  Missing files, and refusals that any stripe would make, don't count.
+func (store *StripedStore) failed(stripe int, err error) bool {
+	if err == nil || os.IsNotExist(err) || err == ErrReadOnly || err == ErrNameTooLong {
+		return false
+	}
+	store.markDown(stripe, err)
+	return true
+}
+
+// markDown takes stripe, which failed with err, out of the ring.
+func (store *StripedStore) markDown(stripe int, err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if !store.down[stripe] {
+		store.down[stripe] = true
+		store.strayed = true
+		if store.onDown != nil {
+			store.onDown(stripe, err)
+		}
+	}
+}
+
+// revive puts stripe, which failed, back in the ring if it works again, as
+// far as listing it goes.  Files on it that were put in another stripe while it
+// was down are out of date, so they are deleted from it first; files of the
+// stripe's own, like its manifest, are left be.  The store is locked
+// throughout, so that nothing is put in the meantime.
+func (store *StripedStore) revive(stripe int) (err error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if !store.down[stripe] {
+		return nil
+	}
+	revived := store.stripes[stripe].Store
+	listed, err := revived.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range listed {
+		if !strings.HasPrefix(name, headerPrefix) && !strings.HasPrefix(name, blobPrefix) && !strings.HasPrefix(name, partPrefix) {
+			continue
+		}
+		for i, other := range store.stripes {
+			if i == stripe || store.down[i] {
+				continue
+			}
+			if _, err = other.Store.Stat(name); err != nil {
+				continue
+			}
+			if err = revived.Delete(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			break
+		}
+	}
+	store.down[stripe] = false
+	return nil
+}
+
+// downStripes returns the stripes that have failed.
+func (store *StripedStore) downStripes() (down []int) {
+	store.Lock()
+	defer store.Unlock()
+
+	for i, isDown := range store.down {
+		if isDown {
+			down = append(down, i)
+		}
+	}
+	return down
+}
+
+// wouldHold reports whether the file name would have been put in stripe,
+// were it up: that is, if it is the first stripe round the ring from name
+// that is either up or stripe itself.
+func (store *StripedStore) wouldHold(stripe int, name string) bool {
+	store.Lock()
+	defer store.Unlock()
+
+	start := sort.Search(len(store.ring), func(i int) bool {
+		return store.ring[i].hash >= ringHash(name)
+	})
+	for i := 0; i < len(store.ring); i++ {
+		owner := store.ring[(start+i)%len(store.ring)].stripe
+		if owner == stripe || !store.down[owner] {
+			return owner == stripe
+		}
+	}
+	return false
+}
+
+// Live returns how much weight is left in stripes that haven't failed, out of total.
+func (store *StripedStore) Live() (live, total int) {
+	store.Lock()
+	defer store.Unlock()
+
+	for i, stripe := range store.stripes {
+		weight := stripe.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		if !store.down[i] {
+			live += weight
+		}
+	}
+	return live, total
+}
+
+// Down returns how many stripes have failed.
+func (store *StripedStore) Down() (down int) {
+	store.Lock()
+	defer store.Unlock()
+
+	for _, isDown := range store.down {
+		if isDown {
+			down++
+		}
+	}
+	return down
+}
+
+// put saves contents as name with put, in the first stripe that hasn't failed.
+// Once stripes have failed, any older copy further round the ring is deleted,
+// so that it can't turn up again if that stripe fails too.
+func (store *StripedStore) put(name string, put func(stripe Store) error) (err error) {
+	owners := store.owners(name)
+	for n, i := range owners {
+		if err = put(store.stripes[i].Store); store.failed(i, err) {
+			continue
+		}
+		if err == nil && store.hasStrayed() {
+			for _, j := range owners[n+1:] {
+				store.stripes[j].Store.Delete(name)
+			}
+		}
+		return err
+	}
+	return ErrNoStripes
+}
+
+// hasStrayed reports whether any stripe has ever failed.
+func (store *StripedStore) hasStrayed() bool {
+	store.Lock()
+	defer store.Unlock()
+
+	return store.strayed
+}
+
+// Put implements Store.Put for a StripedStore.
+func (store *StripedStore) Put(name string, contents []byte) (err error) {
+	return store.put(name, func(stripe Store) error {
+		return stripe.Put(name, contents)
+	})
+}
+
+// PutNoSync implements Syncer.PutNoSync for a StripedStore.  Stripes that
+// aren't Syncers flush every file as usual.
+func (store *StripedStore) PutNoSync(name string, contents []byte) (err error) {
+	return store.put(name, func(stripe Store) error {
+		if syncer, ok := stripe.(Syncer); ok {
+			return syncer.PutNoSync(name, contents)
+		}
+		return stripe.Put(name, contents)
+	})
+}
+
+// Sync implements Syncer.Sync for a StripedStore.
+func (store *StripedStore) Sync() (err error) {
+	for i, stripe := range store.stripes {
+		syncer, ok := stripe.Store.(Syncer)
+		if !ok || store.isDown(i) {
+			continue
+		}
+		if err = syncer.Sync(); store.failed(i, err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDown reports whether stripe has failed.
+func (store *StripedStore) isDown(stripe int) bool {
+	store.Lock()
+	defer store.Unlock()
+
+	return store.down[stripe]
+}
+
+// Get implements Store.Get for a StripedStore.  A file put while its own
+// stripe was down may be further round the ring, so that's looked in too.
+func (store *StripedStore) Get(name string) (contents []byte, err error) {
+	for _, i := range store.owners(name) {
+		contents, err = store.stripes[i].Store.Get(name)
+		if err == nil || (!os.IsNotExist(err) && !store.failed(i, err)) {
+			return contents, err
+		}
+	}
+	return nil, notExist("get", name)
+}
+
+// Delete implements Store.Delete for a StripedStore.  It deletes name from
+// every stripe holding it, so that no older copy turns up again later.
+func (store *StripedStore) Delete(name string) (err error) {
+	found := false
+	for _, i := range store.owners(name) {
+		err = store.stripes[i].Store.Delete(name)
+		if err == nil {
+			found = true
+		} else if !os.IsNotExist(err) && !store.failed(i, err) {
+			return err
+		}
+	}
+	if !found {
+		return notExist("delete", name)
+	}
+	return nil
+}
+
+// List implements Store.List for a StripedStore.
+func (store *StripedStore) List() (names []string, err error) {
+	seen := make(map[string]bool)
+	live := 0
+	for i, stripe := range store.stripes {
+		if store.isDown(i) {
+			continue
+		}
+		listed, err := stripe.Store.List()
+		if store.failed(i, err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		live++
+		for _, name := range listed {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if live == 0 {
+		return nil, ErrNoStripes
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Stat implements Store.Stat for a StripedStore.
+func (store *StripedStore) Stat(name string) (size int64, err error) {
+	for _, i := range store.owners(name) {
+		size, err = store.stripes[i].Store.Stat(name)
+		if err == nil || (!os.IsNotExist(err) && !store.failed(i, err)) {
+			return size, err
+		}
+	}
+	return 0, notExist("stat", name)
+}
+
+// Compact compacts every stripe that can be compacted, like a LogStore,
+// and returns how many bytes that reclaimed.
+func (store *StripedStore) Compact() (reclaimed int64, err error) {
+	for i, stripe := range store.stripes {
+		c, ok := stripe.Store.(compacter)
+		if !ok || store.isDown(i) {
+			continue
+		}
+		compacted, err := c.Compact()
+		reclaimed += compacted
+		if err != nil && !store.failed(i, err) {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// Close closes every stripe that can be closed, like a LogStore.
+func (store *StripedStore) Close() (err error) {
+	for _, stripe := range store.stripes {
+		if closer, ok := stripe.Store.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// locks implements locker for a StripedStore: dir is locked if a stripe has locked it.
+func (store *StripedStore) locks(dir string) bool {
+	for _, stripe := range store.stripes {
+		if l, ok := stripe.Store.(locker); ok && l.locks(dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrBadWARC means ImportWARC was given something that isn't a WARC file, or a damaged one.
+var ErrBadWARC = errors.New("Not a WARC file, or a damaged one")
+
+// warcVersion is the version of the WARC format written; see ISO 28500:2017.
+// Files in WARC 1.0 are read too, as the records we read haven't changed.
+const warcVersion = "WARC/1.1"
+
+// warcField is one named field of a WARC record header.  Fields are kept in
+// order, as the order they are written in is the order they are read in.
+type warcField struct {
+	name, value string
+}
+
+// warcRecordID returns a new, globally unique WARC-Record-ID: a random UUID.
+func warcRecordID() (id string, err error) {
+	var uuid [16]byte
+	if _, err = rand.Read(uuid[:]); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40 // Version 4, random.
+	uuid[8] = uuid[8]&0x3f | 0x80 // RFC 4122 variant.
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// warcDigest returns the labelled SHA-256 digest of a block or payload, as WARC writes it.
+func warcDigest(sum [sha256.Size]byte) string {
+	return "sha256:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeWARCRecord writes a record with header fields, then Content-Length, and
+// content block to w.
+func writeWARCRecord(w io.Writer, fields []warcField, block []byte) (err error) {
+	var buf bytes.Buffer
+	buf.WriteString(warcVersion + "\r\n")
+	for _, field := range fields {
+		buf.WriteString(field.name + ": " + field.value + "\r\n")
+	}
+	buf.WriteString("Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n")
+	buf.Write(block)
+	buf.WriteString("\r\n\r\n")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// exportWARC writes every resource in the cache to w as a WARC file: a warcinfo
+// record, then a request and a response record per resource.  Requests are
+// reconstructed, as the cache only keeps the url.  The cache is only locked a
+// resource at a time, as for export.
+func (cache *memoryCache) exportWARC(w io.Writer) (err error) {
+	now := time.Now().UTC()
+	id, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	info := []byte("software: web-cache\r\nformat: WARC File Format 1.1\r\n")
+	if err = writeWARCRecord(w, []warcField{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", id},
+		{"WARC-Date", now.Format(time.RFC3339Nano)},
+		{"Content-Type", "application/warc-fields"},
+	}, info); err != nil {
+		return err
+	}
+
+	cache.Lock()
+	urls := make([]url.URL, 0, len(cache.memory))
+	for u := range cache.memory {
+		urls = append(urls, u)
+	}
+	cache.Unlock()
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].String() < urls[j].String()
+	})
+
+	for _, u := range urls {
+		entry, sum, body, ok := cache.exportResource(u)
+		if !ok {
+			continue
+		}
+		if err = writeWARCExchange(w, u, entry, sum, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWARCExchange writes the request and response records for the resource at
+// u, described by entry, with body and its SHA-256 sum.
+func writeWARCExchange(w io.Writer, u url.URL, entry snapshotEntry, sum [sha256.Size]byte, body []byte) (err error) {
+	date := entry.Fetched
+	if date.IsZero() {
+		// Saved before fetch times were recorded.
+		date = time.Now()
+	}
+	status := entry.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	// The response, as it would have come over the wire.  The body is as it was
+	// saved, so its length is given, rather than whatever the origin sent.
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/1.1 %03d %s\r\n", status, http.StatusText(status))
+	header := http.Header{}
+	for k, v := range entry.Header {
+		header[k] = v
+	}
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if err = header.Write(&response); err != nil {
+		return err
+	}
+	response.WriteString("\r\n")
+	response.Write(body)
+
+	responseID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	if err = writeWARCRecord(w, []warcField{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date.UTC().Format(time.RFC3339Nano)},
+		{"WARC-Target-URI", u.String()},
+		{"WARC-Block-Digest", warcDigest(sha256.Sum256(response.Bytes()))},
+		{"WARC-Payload-Digest", warcDigest(sum)},
+		{"Content-Type", "application/http;msgtype=response"},
+	}, response.Bytes()); err != nil {
+		return err
+	}
+
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", u.RequestURI(), u.Host)
+	requestID, err := warcRecordID()
+	if err != nil {
+		return err
+	}
+	return writeWARCRecord(w, []warcField{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", requestID},
+		{"WARC-Date", date.UTC().Format(time.RFC3339Nano)},
+		{"WARC-Target-URI", u.String()},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, request.Bytes())
+}
+
+// importWARC saves every successful response in the WARC file read from r into
+// the cache, as fetched when the WARC file says, replacing any already at the
+// same url.  Gzipped WARC files, record by record or as a whole, are read too.
+// Other records, and responses that weren't 200 OK or don't fit, are left out.
+// The cache is locked a resource at a time.
+func (cache *memoryCache) importWARC(r io.Reader) (err error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// Gzip readers read concatenated members, so this covers both.
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return ErrBadWARC
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	tp := textproto.NewReader(br)
+
+	for first := true; ; first = false {
+		version, err := tp.ReadLine()
+		if err == io.EOF && !first {
+			return nil
+		} else if err != nil {
+			return ErrBadWARC
+		}
+		if version == "" && !first {
+			// Tolerate stray blank lines between records.
+			continue
+		}
+		if version != warcVersion && version != "WARC/1.0" {
+			return ErrBadWARC
+		}
+		fields, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return ErrBadWARC
+		}
+		length, err := strconv.ParseInt(fields.Get("Content-Length"), 10, 64)
+		if err != nil || length < 0 {
+			return ErrBadWARC
+		}
+		block := make([]byte, length)
+		if _, err = io.ReadFull(br, block); err != nil {
+			return ErrBadWARC
+		}
+
+		if fields.Get("WARC-Type") != "response" || !strings.HasPrefix(fields.Get("Content-Type"), "application/http") {
+			continue
+		}
+		if err = cache.importWARCResponse(fields, block); err != nil {
+			return err
+		}
+	}
+}
+
+// importWARCResponse saves the response in the block of a response record with header
+// fields into the cache.
+func (cache *memoryCache) importWARCResponse(fields textproto.MIMEHeader, block []byte) (err error) {
+	target := fields.Get("WARC-Target-URI")
+	u, err := url.Parse(strings.Trim(target, "<>"))
+	if err != nil {
+		return ErrBadWARC
+	}
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+	if err != nil {
+		return ErrBadWARC
+	}
+	defer response.Body.Close()
+	var body bytes.Buffer
+	if _, err = body.ReadFrom(response.Body); err != nil {
+		return ErrBadWARC
+	}
+	if response.StatusCode != http.StatusOK {
+		fmt.Println("Not importing", target, "as it was a", response.Status, "response")
+		return nil
+	}
+
+	opts := SaveOptions{Header: response.Header, Status: response.StatusCode}
+	if date, err := time.Parse(time.RFC3339Nano, fields.Get("WARC-Date")); err == nil {
+		opts.Fetched = date
+	}
+
+	cache.Lock()
+	defer cache.Unlock()
+
+	err = cache.saveResource(*u, &body, cache.nextToGo, opts)
+	if err == ErrCacheSizeExceeded {
+		fmt.Println("Not importing", target, "as it doesn't fit in the cache")
+		return nil
+	}
+	return err
+}
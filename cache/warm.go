@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"sort"
+)
+
+// warm reads every body that is still only on disk into memory, and closes
+// cache.ready once it is done.  Bodies of pinned resources go first, then the
+// bodies shared by the most urls.  The cache is only locked a body at a time,
+// and not while the body is read (see fetchBlob), so warm can run alongside
+// everything else.
+func (cache *memoryCache) warm() {
+	defer close(cache.ready)
+
+	// Work out what to read, and in what order.
+	cache.Lock()
+	pinned := make(map[[sha256.Size]byte]bool)
+	for url, resource := range cache.memory {
+		if cache.pinned[url] {
+			pinned[resource.sum] = true
+		}
+	}
+	var cold [][sha256.Size]byte
+	refs := make(map[[sha256.Size]byte]int)
+	for sum, b := range cache.blobs {
+		if b.file == nil {
+			cold = append(cold, sum)
+			refs[sum] = b.refs
+		}
+	}
+	cache.Unlock()
+	sort.Slice(cold, func(i, j int) bool {
+		if pinned[cold[i]] != pinned[cold[j]] {
+			return pinned[cold[i]]
+		}
+		return refs[cold[i]] > refs[cold[j]]
+	})
+
+	// Bodies that fail to load are left to getResource, which
+	// drops their resources the next time they are asked for.
+	// Stop if the cache is closed meanwhile.
+	for _, sum := range cold {
+		cache.Lock()
+		if cache.closed {
+			cache.Unlock()
+			return
+		}
+		cache.fetchBlob(sum)
+		cache.Unlock()
+	}
+}
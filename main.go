@@ -2,9 +2,17 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
@@ -17,7 +25,111 @@ func init() {
 }
 
 // ErrInvalidArgs is an error signifying incorrectly supplied command line arguments.
-var ErrInvalidArgs = errors.New("Invalid arguments supplied.  Usage:\n\tgo run web-cache.go [ip:port] [replacement_policy ('LRU' or 'LFU')] [cache_size (in MB)] [expiration_time]")
+var ErrInvalidArgs = errors.New("Invalid arguments supplied.  Usage:\n\tgo run web-cache.go [-pin url,url,...] [-dimension logical|memory|disk] [-compress none|gzip|flate] [-keyfile path] [-scrub interval] [-store dir|log] [-lazy] [-warm] [-minfree MB] [-workers n] [-syncbatch n] [-mount path[:weight],...] [-har] [-harfile path] [-mode normal|record|replay|offline] [-stalegrace duration] [-staleiferror duration] [-coalesce timeout] [-refreshahead duration] [-missstatus code] [-missbody text] [ip:port] [replacement_policy ('LRU' or 'LFU')] [cache_size (in MB)] [expiration_time]")
+
+// pinList is a comma separated list of urls that should never be evicted from the cache.
+var pinList = flag.String("pin", "", "comma separated list of urls to pin in the cache")
+
+// dimension names the measure of usage the cache size is enforced against: "logical", "memory" or "disk".
+var dimension = flag.String("dimension", "memory", "what the cache size caps: 'logical' (body bytes), 'memory' (bodies, headers and bookkeeping) or 'disk' (files, rounded up to whole blocks)")
+
+// compression names how compressible resources are stored: "none", "gzip" or "flate".
+var compression = flag.String("compress", "none", "store compressible resources compressed: 'none', 'gzip' or 'flate'")
+
+// keyFile is a file of hex encoded AES keys to encrypt the disk cache with, current key first.
+// Keys can be given in the environment variable keyEnv instead.
+var keyFile = flag.String("keyfile", "", "file of hex encoded AES keys (current key first) to encrypt the disk cache with")
+
+// scrubInterval is how often the disk cache is checked for corrupt files, if at all.
+var scrubInterval = flag.Duration("scrub", 0, "how often to check the disk cache for corrupt files (0, the default, to never check)")
+
+// storeKind names how the disk cache lays out its files: "dir" for a file per header
+// and body, or "log" for a single append-only log.
+var storeKind = flag.String("store", "dir", "how to lay out the disk cache: 'dir' (a file per header and body) or 'log' (one append-only log)")
+
+// lazy makes startup read only the index of the disk cache, leaving bodies on disk until they are asked for.
+var lazy = flag.Bool("lazy", false, "only read the disk cache's index at startup, and read bodies when they are first asked for")
+
+// warm makes a lazy cache read its bodies into memory in the background after startup.
+var warm = flag.Bool("warm", false, "with -lazy, read bodies into memory in the background after startup")
+
+// minFree is how many MB to keep free on the disk holding the disk cache.
+var minFree = flag.Int("minfree", 0, "MB to keep free on the disk holding the disk cache, evicting resources if need be (0 to not check)")
+
+// workers is how many goroutines write to the disk cache in the background.
+var workers = flag.Int("workers", 4, "how many goroutines write to the disk cache in the background")
+
+// syncBatch is how many writes each of those goroutines may flush to disk at once.
+var syncBatch = flag.Int("syncbatch", 1, "how many writes to the disk cache to flush to disk together (1 to flush each one)")
+
+// mountList lists the directories to keep the disk cache in, each with an optional weight.
+var mountList = flag.String("mount", "/tmp/cache", "comma separated list of directories to spread the disk cache over, each optionally followed by ':weight'")
+
+// snapshotFrom is the ip:port of a running web cache for the snapshot and export-warc commands to read.
+var snapshotFrom = flag.String("from", "", "with snapshot or export-warc, the ip:port of a running web cache to read, instead of reading -mount")
+
+// recordHAR makes the proxy record a HAR log of the requests passing through it, served at proxy.HARPath.
+var recordHAR = flag.Bool("har", false, "record a HAR log of proxied requests, downloadable from "+proxy.HARPath)
+
+// harFile is where to write the HAR log when the web cache is shut down; it implies -har.
+var harFile = flag.String("harfile", "", "file to write the HAR log of proxied requests to on shutdown (implies -har)")
+
+// mode names how the proxy uses its cache: "normal", "record", "replay" or "offline".
+var mode = flag.String("mode", "normal", "how to use the cache: 'normal', 'record' (keep every response for good), 'replay' (only serve from the cache) or 'offline' (serve anything in the cache, however stale)")
+
+// staleGrace is how long expired resources are kept, to be served if the origin fails or the proxy is offline.
+var staleGrace = flag.Duration("stalegrace", 10*time.Minute, "how long to keep expired resources, to serve if the origin fails or with -mode offline")
+
+// staleIfError is how long after they expire resources are served if the origin fails,
+// unless it said otherwise with stale-if-error.
+var staleIfError = flag.Duration("staleiferror", 0, "how long after they expire to serve resources if the origin fails, when it didn't say with stale-if-error (0, the default, to only serve them if it did)")
+
+// missStatus and missBody are the error the proxy answers requests that aren't in the cache with in replay mode.
+var missStatus = flag.Int("missstatus", http.StatusGatewayTimeout, "with -mode replay, the status to answer requests that aren't in the cache with")
+var missBody = flag.String("missbody", "Not in the cache, and the proxy is replaying", "with -mode replay, the message to answer requests that aren't in the cache with")
+
+// coalesceTimeout is how long a request waits on another request's fetch of the same resource.
+var coalesceTimeout = flag.Duration("coalesce", 10*time.Second, "how long a request waits for another request's fetch of the same resource before fetching it itself (0 to never wait)")
+
+// refreshAhead is how long before a resource expires that using it has it fetched again in the background.
+var refreshAhead = flag.Duration("refreshahead", 0, "how long before a resource expires that using it has it fetched again in the background (0 to never refresh ahead)")
+
+// keyEnv is the environment variable consulted for encryption keys when -keyfile isn't given.
+const keyEnv = "WEBCACHE_KEYS"
+
+// adminEnv is the environment variable holding the admin token, which requests for
+// the proxy's own endpoints, like proxy.SnapshotPath, must bear.  Unless it is set,
+// those endpoints are off.  snapshot and export-warc send it to the web cache at -from.
+const adminEnv = "WEBCACHE_ADMIN_TOKEN"
+
+// ErrBadCompression signifies that an unknown -compress option was given.
+var ErrBadCompression = errors.New("Bad compression: must be one of 'none', 'gzip' or 'flate'")
+
+// ErrBadDimension signifies that an unknown -dimension option was given.
+var ErrBadDimension = errors.New("Bad dimension: must be one of 'logical', 'memory' or 'disk'")
+
+// ErrBadMode signifies that an unknown -mode option was given.
+var ErrBadMode = errors.New("Bad mode: must be one of 'normal', 'record', 'replay' or 'offline'")
+
+// ErrBadStore signifies that an unknown -store option was given.
+var ErrBadStore = errors.New("Bad store: must be one of 'dir' or 'log'")
+
+// ErrNoMounts signifies that -mount was given no directories.
+var ErrNoMounts = errors.New("No mount paths: -mount must list at least one directory")
+
+// ErrInvalidCommandArgs is an error signifying incorrectly supplied arguments to a command.
+var ErrInvalidCommandArgs = errors.New("Invalid arguments supplied.  Usage:\n\tgo run web-cache.go [-mount path[:weight],...] [-store dir|log] [-keyfile path] [-from ip:port] snapshot|export-warc [file]\n\tgo run web-cache.go [-mount path[:weight],...] [-store dir|log] [-keyfile path] [-compress none|gzip|flate] [-dimension logical|memory|disk] restore|import-warc [file] [cache_size (in MB)]")
+
+// ErrCacheRunning signifies that snapshot or export-warc was asked to read the mount paths of a running web cache.
+var ErrCacheRunning = errors.New("Mount path is in use by a running web cache: read it with -from ip:port instead")
+
+// snapshotSize is the cache size, in MB, that snapshot and export-warc read a disk cache with;
+// far bigger than any disk cache, so that all of it is read.
+const snapshotSize = 1 << 20
+
+// commandExpiration is how long resources last in the caches that commands open;
+// long enough that nothing expires while they run.
+const commandExpiration = 24 * time.Hour
 
 // If error is non-nil, print it out and return it.
 func checkError(err error) (duplErr error) {
@@ -31,12 +143,14 @@ func checkError(err error) (duplErr error) {
 // parseArgs parses and returns command line arguments supplied to the program.
 // Arguments should be supplied in the format:
 // go run web-cache.go [ip:port] [replacement_policy ("LRU" or "LFU")] [cache_size (in MB)] [expiration_time (seconds)]
-// (As per A2 spec)
+// (As per A2 spec), optionally preceded by flags.
 func parseArgs() (ipPort, replacementPolicy string, size int, expirationTime time.Duration, err error) {
+	flag.Parse()
+	args := flag.Args()
+
 	// If an incorrect length of arguments were specified, return and error and the zero-value
-	// for the rest of the arguments.  We should have five arguments: the four specified above as well
-	// as the file name of this file.
-	if len(os.Args) != 5 {
+	// for the rest of the arguments.  We should have the four arguments specified above.
+	if len(args) != 4 {
 		err = ErrInvalidArgs
 		return
 	}
@@ -47,15 +161,15 @@ func parseArgs() (ipPort, replacementPolicy string, size int, expirationTime tim
 	// and expiration time from a string to a time.Duration.
 
 	// These two are already read from the cmd line as strings; easy.
-	ipPort, replacementPolicy = os.Args[1], os.Args[2]
+	ipPort, replacementPolicy = args[0], args[1]
 
 	// Otherwise, do the conversions.
-	size, err = strconv.Atoi(os.Args[3])
+	size, err = strconv.Atoi(args[2])
 	if checkError(err) != nil {
 		return
 	}
 
-	expTimeInt, err := strconv.Atoi(os.Args[4])
+	expTimeInt, err := strconv.Atoi(args[3])
 	if checkError(err) != nil {
 		return
 	}
@@ -67,26 +181,408 @@ func parseArgs() (ipPort, replacementPolicy string, size int, expirationTime tim
 	return
 }
 
+// parsePins parses the urls given by the -pin flag.
+func parsePins() (pinned []url.URL, err error) {
+	for _, link := range strings.Split(*pinList, ",") {
+		if link = strings.TrimSpace(link); link == "" {
+			continue
+		}
+		u, err := url.Parse(link)
+		if checkError(err) != nil {
+			return nil, err
+		}
+		pinned = append(pinned, *u)
+	}
+	return pinned, nil
+}
+
+// parseCompression parses the -compress flag.
+func parseCompression() (c cache.Compression, err error) {
+	switch *compression {
+	case "none":
+		return cache.CompressionNone, nil
+	case "gzip":
+		return cache.CompressionGzip, nil
+	case "flate":
+		return cache.CompressionFlate, nil
+	}
+	return cache.CompressionNone, ErrBadCompression
+}
+
+// parseDimension parses the -dimension flag.
+func parseDimension() (d cache.Dimension, err error) {
+	switch *dimension {
+	case "logical":
+		return cache.DimensionLogical, nil
+	case "memory":
+		return cache.DimensionMemory, nil
+	case "disk":
+		return cache.DimensionDisk, nil
+	}
+	return cache.DimensionMemory, ErrBadDimension
+}
+
+// parseMode parses the -mode flag.
+func parseMode() (m proxy.Mode, err error) {
+	switch *mode {
+	case "normal":
+		return proxy.ModeNormal, nil
+	case "record":
+		return proxy.ModeRecord, nil
+	case "replay":
+		return proxy.ModeReplay, nil
+	case "offline":
+		return proxy.ModeOffline, nil
+	}
+	return proxy.ModeNormal, ErrBadMode
+}
+
+// parseKeyring loads the keyring given by -keyfile or keyEnv.  If neither is set,
+// the disk cache is not encrypted and keyring is nil.
+func parseKeyring() (keyring *cache.Keyring, err error) {
+	if *keyFile != "" {
+		return cache.LoadKeyring(*keyFile)
+	}
+	if os.Getenv(keyEnv) != "" {
+		return cache.KeyringFromEnv(keyEnv)
+	}
+	return nil, nil
+}
+
+// parseMounts parses the directories given by the -mount flag.
+func parseMounts() (mounts []cache.MountPoint, err error) {
+	for _, mount := range strings.Split(*mountList, ",") {
+		if mount = strings.TrimSpace(mount); mount == "" {
+			continue
+		}
+		m := cache.MountPoint{Path: mount}
+		if i := strings.LastIndex(mount, ":"); i >= 0 {
+			// Only a number after the last colon is a weight; it could be part of the path.
+			if weight, err := strconv.Atoi(mount[i+1:]); err == nil {
+				m.Path, m.Weight = mount[:i], weight
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	if len(mounts) == 0 {
+		return nil, ErrNoMounts
+	}
+	return mounts, nil
+}
+
+// parseStore opens the store given by the -store flag over mounts,
+// striped across them if there is more than one, read-only if readOnly is set.
+// For "dir", store is nil: the cache keeps a file per header and body in mounts
+// itself, and carries on without any of them that fail, even at startup.
+func parseStore(mounts []cache.MountPoint, readOnly bool) (store cache.Store, err error) {
+	if *storeKind == "dir" {
+		return nil, nil
+	}
+	stripes := make([]cache.Stripe, len(mounts))
+	for i, mount := range mounts {
+		switch *storeKind {
+		case "log":
+			stripes[i].Store, err = cache.NewLogStoreWithConfig(mount.Path, cache.LogConfig{CompactInterval: time.Minute, ReadOnly: readOnly})
+		default:
+			return nil, ErrBadStore
+		}
+		if err != nil {
+			return nil, err
+		}
+		stripes[i].Weight = mount.Weight
+	}
+	if len(stripes) == 1 {
+		return stripes[0].Store, nil
+	}
+	return cache.NewStripedStore(stripes)
+}
+
+// closeStore closes store, opened by parseStore, once the cache using it is closed,
+// if it is a kind of store that needs closing, like a LogStore.
+func closeStore(store cache.Store) (err error) {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// dump writes a disk cache to the file named by args with export: that of the
+// running web cache at -from, fetched from path on it, if given, or else the one
+// in the -mount directories, which mustn't be in use.
+func dump(args []string, path string, export func(c cache.Cache, w io.Writer) error) (err error) {
+	if len(args) != 1 {
+		return ErrInvalidCommandArgs
+	}
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(args[0])
+		}
+	}()
+
+	if *snapshotFrom != "" {
+		request, err := http.NewRequest("GET", "http://"+*snapshotFrom+path, nil)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+os.Getenv(adminEnv))
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("Web cache at %s refused the export: %s", *snapshotFrom, response.Status)
+		}
+		if _, err = io.Copy(file, response.Body); err != nil {
+			return err
+		}
+		log.Println("Wrote the web cache at", *snapshotFrom, "to", args[0])
+		return file.Sync()
+	}
+
+	mounts, err := parseMounts()
+	if err != nil {
+		return err
+	}
+	store, err := parseStore(mounts, true)
+	if err == cache.ErrLocked {
+		return ErrCacheRunning
+	} else if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	keyring, err := parseKeyring()
+	if err != nil {
+		return err
+	}
+	c, err := cache.NewWithConfig(cache.Config{
+		Policy:     "LRU",
+		Size:       snapshotSize,
+		Expiration: commandExpiration,
+		MountPaths: mounts,
+		Store:      store,
+		Keyring:    keyring,
+		Lazy:       true,
+		ReadOnly:   true,
+	})
+	if err == cache.ErrLocked {
+		return ErrCacheRunning
+	} else if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = export(c, file); err != nil {
+		return err
+	}
+	log.Println("Wrote", c.Stats().Entries, "resources to", args[0])
+	return file.Sync()
+}
+
+// load reads the file named by args into the disk cache in the -mount
+// directories, of the size given by args, with load.
+func load(args []string, load func(c cache.Cache, r io.Reader) error) (err error) {
+	if len(args) != 2 {
+		return ErrInvalidCommandArgs
+	}
+	size, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	mounts, err := parseMounts()
+	if err != nil {
+		return err
+	}
+	store, err := parseStore(mounts, false)
+	if err != nil {
+		return err
+	}
+	// The store goes once the cache using it has, whatever happens.
+	defer func() {
+		if closeErr := closeStore(store); err == nil {
+			err = closeErr
+		}
+	}()
+	keyring, err := parseKeyring()
+	if err != nil {
+		return err
+	}
+	compression, err := parseCompression()
+	if err != nil {
+		return err
+	}
+	dimension, err := parseDimension()
+	if err != nil {
+		return err
+	}
+	c, err := cache.NewWithConfig(cache.Config{
+		Policy:      "LRU",
+		Size:        size,
+		Dimension:   dimension,
+		Expiration:  commandExpiration,
+		MountPaths:  mounts,
+		Store:       store,
+		Keyring:     keyring,
+		Compression: compression,
+	})
+	if err != nil {
+		return err
+	}
+	if err = load(c, file); err != nil {
+		c.Close()
+		return err
+	}
+	// Everything has to be on disk before we exit.
+	if err = c.Close(); err != nil {
+		return err
+	}
+	log.Println("Loaded", args[0], "into the disk cache, which now holds", c.Stats().Entries, "resources")
+	return nil
+}
+
+// shutDownOn waits for the web cache to be interrupted or terminated, then
+// writes the HAR log to -harfile if it was given, and closes c, flushing it to disk,
+// and then store, the store c keeps it in, before exiting.
+func shutDownOn(c cache.Cache, store cache.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if *harFile != "" {
+		f, err := os.Create(*harFile)
+		if checkError(err) == nil {
+			if checkError(proxy.WriteHAR(f)) == nil {
+				log.Println("Wrote HAR log to", *harFile)
+			}
+			checkError(f.Close())
+		}
+	}
+	checkError(c.Close())
+	checkError(closeStore(store))
+	os.Exit(0)
+}
+
 // Entry point.
 func main() {
+	// Run a command instead of the web cache, if one is given.
+	flag.Parse()
+	if args := flag.Args(); len(args) > 0 {
+		switch args[0] {
+		case "snapshot":
+			checkError(dump(args[1:], proxy.SnapshotPath, cache.Cache.Export))
+			return
+		case "restore":
+			checkError(load(args[1:], cache.Cache.Import))
+			return
+		case "export-warc":
+			checkError(dump(args[1:], proxy.WARCPath, cache.Cache.ExportWARC))
+			return
+		case "import-warc":
+			checkError(load(args[1:], cache.Cache.ImportWARC))
+			return
+		}
+	}
+
 	// Try and parse arguments from command line.
 	ipPort, replacementPolicy, maxSize, expirationTime, err := parseArgs()
 	if checkError(err) != nil {
 		return
 	}
 
-	// Cache files on disk at root /cache.
-	mountPath := "/tmp/cache"
+	pinned, err := parsePins()
+	if checkError(err) != nil {
+		return
+	}
+
+	dimension, err := parseDimension()
+	if checkError(err) != nil {
+		return
+	}
+
+	compression, err := parseCompression()
+	if checkError(err) != nil {
+		return
+	}
+
+	keyring, err := parseKeyring()
+	if checkError(err) != nil {
+		return
+	}
+
+	proxyMode, err := parseMode()
+	if checkError(err) != nil {
+		return
+	}
+
+	// Cache files on disk in the -mount directories, /tmp/cache by default.
+	mounts, err := parseMounts()
+	if checkError(err) != nil {
+		return
+	}
+
+	store, err := parseStore(mounts, false)
+	if checkError(err) != nil {
+		return
+	}
+
+	// Offline, whatever the cache has is all there is, so none of it is purged.
+	grace := *staleGrace
+	if proxyMode == proxy.ModeOffline {
+		grace = cache.NoExpiry
+	}
 
 	// Create a new cache.
-	cache, err := cache.New(replacementPolicy, maxSize, expirationTime, mountPath)
+	cache, err := cache.NewWithConfig(cache.Config{
+		Policy:         replacementPolicy,
+		Size:           maxSize,
+		Dimension:      dimension,
+		Expiration:     expirationTime,
+		StaleGrace:     grace,
+		RefreshAhead:   *refreshAhead,
+		OnRefreshAhead: proxy.RefreshAhead,
+		MountPaths:     mounts,
+		Store:          store,
+		Pinned:         pinned,
+		Compression:    compression,
+		Keyring:        keyring,
+		ScrubInterval:  *scrubInterval,
+		Lazy:           *lazy,
+		Warm:           *warm,
+		MinFreeDisk:    *minFree,
+		Workers:        *workers,
+		SyncBatch:      *syncBatch,
+	})
 	if checkError(err) != nil {
+		closeStore(store)
 		return
 	}
+	go func() {
+		<-cache.Ready()
+		log.Println("Cache is warm")
+	}()
 
 	// Start up our proxy server, transmitting through ipPort, and set up with
 	// our newly configured cache.
 	proxy.ListenOn(ipPort)
 	proxy.UseCache(cache)
+	proxy.UseMode(proxyMode)
+	proxy.ReplayMissWith(*missStatus, *missBody)
+	proxy.CoalesceFor(*coalesceTimeout)
+	proxy.StaleIfErrorFor(*staleIfError)
+	proxy.UseAdminToken(os.Getenv(adminEnv))
+	if *recordHAR || *harFile != "" {
+		proxy.RecordHAR()
+	}
+	go shutDownOn(cache, store)
 	proxy.InterceptGET()
 }
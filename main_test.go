@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
+)
+
+func TestParseStore(t *testing.T) {
+	t.Run("The web cache starts without a mount path that fails", func(t *testing.T) {
+		dir := t.TempDir()
+		defer func(mounts string) { *mountList = mounts }(*mountList)
+		*mountList = filepath.Join(dir, "good") + "," + filepath.Join(dir, "missing", "bad")
+
+		mounts, err := parseMounts()
+		if err != nil {
+			t.Fatalf("Couldn't parse the mount paths: %v", err)
+		}
+		store, err := parseStore(mounts, false)
+		if err != nil {
+			t.Fatalf("Couldn't open the store: %v", err)
+		}
+		c, err := cache.NewWithConfig(cache.Config{
+			Policy:     "LRU",
+			Size:       1,
+			Expiration: time.Hour,
+			MountPaths: mounts,
+			Store:      store,
+		})
+		if err != nil {
+			t.Fatalf("Couldn't start the cache with one mount path failing: %v", err)
+		}
+		defer closeStore(store)
+		defer c.Close()
+		if down := c.Stats().MountPathsDown; down != 1 {
+			t.Errorf("Cache has %d mount paths down instead of 1", down)
+		}
+	})
+}
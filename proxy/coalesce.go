@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultCoalesceTimeout is how long a request waits on another's fetch of the
+// same resource, unless CoalesceFor says otherwise.
+const defaultCoalesceTimeout = 10 * time.Second
+
+// flight is a fetch of a resource from the origin that other requests for it
+// are waiting on.  done is closed once the fetch is over, and the resource is
+// in the cache if it could be saved.  header is the headers of the request that
+// made the fetch, which picked the response if the origin varies it; see shares.
+type flight struct {
+	done   chan struct{}
+	header http.Header
+}
+
+// varyNames returns the request headers the response with headers h varies by,
+// as named by its Vary header.  any is set if it varies by something other than
+// request headers, as Vary: * says.
+func varyNames(h http.Header) (names []string, any bool) {
+	for _, value := range h["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return nil, true
+			} else if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, false
+}
+
+// selected returns the values of the request headers named in names in h, as one string.
+func selected(names []string, h http.Header) string {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = name + ": " + strings.Join(h[name], ", ")
+	}
+	return strings.Join(values, "\n")
+}
+
+// flightKey returns the key a fetch of the resource at resourceURL for clientRequest
+// is shared under: the url, along with the request headers that pick the response,
+// if what is cached of it, stale, says which ones do.  ok is false if the fetch
+// mustn't be shared at all, as the response varies by more than request headers,
+// or as the fetch is of ranges of it, which aren't cached whole.
+func flightKey(resourceURL url.URL, clientRequest *http.Request, stale *staleResponse) (key string, ok bool) {
+	if clientRequest.Header.Get("Range") != "" {
+		return "", false
+	}
+	if stale == nil {
+		return resourceURL.String(), true
+	}
+	names, any := varyNames(stale.header)
+	if any {
+		return "", false
+	}
+	return resourceURL.String() + "\n" + selected(names, clientRequest.Header), true
+}
+
+// shares reports whether a response with headers h, fetched for a request with headers
+// fetchedFor, may be served to a request with headers header: if the request headers
+// it varies by, if any, are the same in both.
+func shares(h, fetchedFor, header http.Header) bool {
+	names, any := varyNames(h)
+	return !any && selected(names, fetchedFor) == selected(names, header)
+}
+
+// serveShared fetches the resource at resourceURL from the origin for clientRequest,
+// as serveAndCache does, unless it is being fetched already.  If it is, this waits
+// for that fetch and serves what it cached, with the status it was cached with, so
+// that however many requests for a resource come in at once, the origin only sees
+// one.  If that takes longer than the proxy's coalesce timeout, or leaves nothing in
+// the cache, or leaves a response the origin picked for different request headers
+// (see Vary), this fetches the resource itself after all.
+func serveShared(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request, resourceURL url.URL, stale *staleResponse) {
+	key, ok := flightKey(resourceURL, clientRequest, stale)
+	if defaultProxy.coalesceTimeout <= 0 || !ok {
+		serveAndCache(proxyWriter, client, clientRequest, stale)
+		return
+	}
+
+	defaultProxy.Lock()
+	f, ok := defaultProxy.inflight[key]
+	if !ok {
+		f = &flight{done: make(chan struct{}), header: clientRequest.Header}
+		defaultProxy.inflight[key] = f
+	}
+	defaultProxy.Unlock()
+
+	if !ok {
+		// Nobody else is fetching it, so it's up to us.
+		defer func() {
+			defaultProxy.Lock()
+			delete(defaultProxy.inflight, key)
+			defaultProxy.Unlock()
+			close(f.done)
+		}()
+		serveAndCache(proxyWriter, client, clientRequest, stale)
+		return
+	}
+
+	fmt.Println("Waiting for the resource to be fetched by another request", hash(resourceURL.String()))
+	select {
+	case <-f.done:
+		cachedResponse, originalHeaders, status, age, err := defaultProxy.cache.GetResponse(resourceURL)
+		if err == nil && age == 0 && shares(originalHeaders, f.header, clientRequest.Header) {
+			serveWithCache(proxyWriter, clientRequest, status, originalHeaders, cachedResponse)
+			return
+		}
+		fmt.Println("The other request didn't cache the resource for this request, fetching it again", hash(resourceURL.String()))
+	case <-time.After(defaultProxy.coalesceTimeout):
+		fmt.Println("Gave up waiting for the other request, fetching the resource again", hash(resourceURL.String()))
+	}
+	serveAndCache(proxyWriter, client, clientRequest, stale)
+}
@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotRecording means the HAR log was asked for, but RecordHAR wasn't called.
+var ErrNotRecording = errors.New("The proxy isn't recording a HAR log")
+
+// HARPath is where the proxy serves its HAR log, to requests made to the proxy
+// itself bearing the admin token; see UseAdminToken.
+const HARPath = "/_cache/har"
+
+// maxHAREntries is how many requests the HAR log holds; older ones are dropped.
+const maxHAREntries = 10000
+
+// redactedHeaders are the headers whose values are left out of the HAR log, as
+// they carry credentials; redacted stands in for them.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+const redacted = "[redacted]"
+
+// The HAR 1.2 format, as at http://www.softwareishard.com/blog/har-12-spec/.
+// Fields starting with an underscore are our own, as the format allows.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	CacheHit        bool        `json:"_cacheHit"`
+}
+
+type harRequest struct {
+	Method      string   `json:"method"`
+	URL         string   `json:"url"`
+	HTTPVersion string   `json:"httpVersion"`
+	Cookies     []harNVP `json:"cookies"`
+	Headers     []harNVP `json:"headers"`
+	QueryString []harNVP `json:"queryString"`
+	HeadersSize int      `json:"headersSize"`
+	BodySize    int64    `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int        `json:"status"`
+	StatusText  string     `json:"statusText"`
+	HTTPVersion string     `json:"httpVersion"`
+	Cookies     []harNVP   `json:"cookies"`
+	Headers     []harNVP   `json:"headers"`
+	Content     harContent `json:"content"`
+	RedirectURL string     `json:"redirectURL"`
+	HeadersSize int        `json:"headersSize"`
+	BodySize    int64      `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+// harNVP is a name/value pair: a header, cookie or query string parameter.
+type harNVP struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harTimings is how long each phase of a request took, in milliseconds; -1 means
+// it doesn't apply.  Wait is how long the origin took to start responding, and
+// Receive how long the rest took, so a cache hit is all Receive.
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+// harRecorder is a request passing through the proxy, as the HAR log sees it.
+// It wraps the ResponseWriter the proxy responds through, noting the status and
+// how much body it wrote.  hit, wait and proto, the HTTP version the origin
+// responded with, are filled in by whatever serves it.
+type harRecorder struct {
+	http.ResponseWriter
+	request *http.Request
+	start   time.Time
+	status  int
+	written int64
+	hit     bool
+	wait    time.Duration
+	proto   string
+}
+
+// newHARRecorder starts recording clientRequest, responded to through proxyWriter.
+func newHARRecorder(proxyWriter http.ResponseWriter, clientRequest *http.Request) *harRecorder {
+	return &harRecorder{ResponseWriter: proxyWriter, request: clientRequest, start: time.Now()}
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader for a harRecorder.
+func (rec *harRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.Write for a harRecorder.
+func (rec *harRecorder) Write(p []byte) (n int, err error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err = rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// waited notes that the origin took from the start of the request until now to
+// start responding with response, which is nil if it didn't.  rec may be nil,
+// if the HAR log isn't being recorded.
+func (rec *harRecorder) waited(response *http.Response) {
+	if rec == nil {
+		return
+	}
+	rec.wait = time.Since(rec.start)
+	if response != nil {
+		rec.proto = response.Proto
+	}
+}
+
+// served notes that the request was served from the cache.  rec may be nil.
+func (rec *harRecorder) served() {
+	if rec != nil {
+		rec.hit = true
+	}
+}
+
+// entry returns the HAR entry for the finished request.
+func (rec *harRecorder) entry() (entry harEntry) {
+	total := time.Since(rec.start)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	u := rec.request.RequestURI
+	if !strings.HasPrefix(u, "http://") {
+		u = "http://" + rec.request.Host + u
+	}
+	// Anything not from the origin is sent back as the client asked.
+	proto := rec.proto
+	if proto == "" {
+		proto = rec.request.Proto
+	}
+
+	entry.StartedDateTime = rec.start.Format(time.RFC3339Nano)
+	entry.Time = milliseconds(total)
+	entry.Request = harRequest{
+		Method:      rec.request.Method,
+		URL:         u,
+		HTTPVersion: rec.request.Proto,
+		Cookies:     []harNVP{},
+		Headers:     harHeaders(rec.request.Header),
+		QueryString: []harNVP{},
+		HeadersSize: -1,
+		BodySize:    rec.request.ContentLength,
+	}
+	for name, values := range rec.request.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNVP{Name: name, Value: value})
+		}
+	}
+	entry.Response = harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: proto,
+		Cookies:     []harNVP{},
+		Headers:     harHeaders(rec.Header()),
+		Content:     harContent{Size: rec.written, MimeType: rec.Header().Get("Content-Type")},
+		HeadersSize: -1,
+		BodySize:    rec.written,
+	}
+	entry.Timings = harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		SSL:     -1,
+		Wait:    milliseconds(rec.wait),
+		Receive: milliseconds(total - rec.wait),
+	}
+	entry.CacheHit = rec.hit
+	return entry
+}
+
+// harHeaders returns h as HAR name/value pairs, in order, with credentials redacted.
+func harHeaders(h http.Header) (pairs []harNVP) {
+	pairs = []harNVP{}
+	for name, values := range h {
+		for _, value := range values {
+			if redactedHeaders[http.CanonicalHeaderKey(name)] {
+				value = redacted
+			}
+			pairs = append(pairs, harNVP{Name: name, Value: value})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Name < pairs[j].Name
+	})
+	return pairs
+}
+
+// milliseconds returns d in milliseconds, as HAR counts time.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// harRecording is the HAR log of the proxy, if it is recording one.
+type harRecording struct {
+	entries []harEntry
+	sync.Mutex
+}
+
+// add adds entry to the log, dropping the oldest entry if it is full.
+func (har *harRecording) add(entry harEntry) {
+	har.Lock()
+	defer har.Unlock()
+
+	if len(har.entries) >= maxHAREntries {
+		har.entries = har.entries[1:]
+	}
+	har.entries = append(har.entries, entry)
+}
+
+// write writes the log to w as a HAR file.
+func (har *harRecording) write(w io.Writer) (err error) {
+	har.Lock()
+	file := harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "web-cache", Version: "1.0"},
+		Entries: append([]harEntry{}, har.entries...),
+	}}
+	har.Unlock()
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(file)
+}
+
+// serveHAR sends back the HAR log, to requests bearing the admin token; see admitted.
+func serveHAR(proxyWriter http.ResponseWriter, clientRequest *http.Request) {
+	if !admitted(proxyWriter, clientRequest) {
+		return
+	}
+	if defaultProxy.har == nil {
+		http.Error(proxyWriter, ErrNotRecording.Error(), http.StatusNotFound)
+		return
+	}
+	proxyWriter.Header().Set("Content-Type", "application/json")
+	if err := defaultProxy.har.write(proxyWriter); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// recording returns the recorder for the request being responded to through
+// proxyWriter, or nil if the HAR log isn't being recorded.
+func recording(proxyWriter http.ResponseWriter) *harRecorder {
+	rec, _ := proxyWriter.(*harRecorder)
+	return rec
+}
+
+// RecordHAR makes the default proxy record a HAR log of the requests passing
+// through it, served from HARPath.
+func RecordHAR() {
+	defaultProxy.har = &harRecording{}
+}
+
+// WriteHAR writes the default proxy's HAR log to w.
+func WriteHAR(w io.Writer) (err error) {
+	if defaultProxy.har == nil {
+		return ErrNotRecording
+	}
+	return defaultProxy.har.write(w)
+}
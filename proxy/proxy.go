@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"fmt"
 	"hash/fnv"
 	"io"
@@ -11,22 +12,72 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
 	"golang.org/x/net/html"
 )
 
 // Proxy ...
+// Urls in revalidating are being fetched again in the background; see revalidate.
+// Resources in inflight, keyed by flightKey, are being fetched by one request that
+// others are waiting on, for up to coalesceTimeout; see serveShared.  Stale responses
+// are served in place of errors from the origin for up to staleIfError after they
+// expire, unless the origin says otherwise; see staleResponse.onError.  The proxy's
+// own endpoints, under /_cache/, are only served to requests bearing adminToken,
+// and not at all if it is empty; see admitted.
 type Proxy struct {
-	ipPort string
-	cache  cache.Cache
+	ipPort          string
+	adminToken      string
+	cache           cache.Cache
+	har             *harRecording
+	mode            Mode
+	missStatus      int
+	missBody        string
+	revalidating    map[url.URL]bool
+	inflight        map[string]*flight
+	coalesceTimeout time.Duration
+	staleIfError    time.Duration
+	sync.Mutex
 }
 
+// Mode is how the proxy uses its cache.
+type Mode int
+
+// In ModeNormal, the proxy caches responses as their Cache-Control headers allow,
+// and fetches whatever isn't in the cache from the origin.  ModeRecord is the same,
+// but keeps every response it fetches for good, whatever its headers say: for
+// recording test fixtures.  ModeReplay only serves from the cache, and answers
+// anything that isn't in it with the replay miss error, never contacting an origin.
+// ModeOffline doesn't contact origins either, but serves anything in the cache,
+// however stale, with a Warning saying so.
+const (
+	ModeNormal Mode = iota
+	ModeRecord
+	ModeReplay
+	ModeOffline
+)
+
+// The replay miss error, unless ReplayMissWith says otherwise.  504 is what
+// a cache answers a request it was told to only serve from cache with.
+const (
+	defaultMissStatus = http.StatusGatewayTimeout
+	defaultMissBody   = "Not in the cache, and the proxy is replaying"
+	offlineBody       = "Not in the cache, and the proxy is offline"
+)
+
 // For now, the default proxy serves as a singleton.
 // We could extend this package to include an implementation
 // of proxy.New and receiver methods on multiple instances of Proxy,
 // but that is out of the scope of what is needed for A2.
-var defaultProxy = &Proxy{}
+var defaultProxy = &Proxy{
+	missStatus:      defaultMissStatus,
+	missBody:        defaultMissBody,
+	revalidating:    make(map[url.URL]bool),
+	inflight:        make(map[string]*flight),
+	coalesceTimeout: defaultCoalesceTimeout,
+}
 
 func dumpLink(link string) (dumpedLink string) {
 	return "http://" + defaultProxy.ipPort + "/?referrer='" + strings.Replace(link, "/", "-", -1) + "'"
@@ -67,10 +118,105 @@ func cacheResource(resourceLink string) (cached bool) {
 
 	fmt.Println(debugPrompt, "saving", resourceLink, "to cache")
 	fmt.Println(debugPrompt, "... with header", response.Header)
-	defaultProxy.cache.SaveWithHeaders(*resourceURL, &responseBuffer, response.Header)
+	saveToCache(*resourceURL, &responseBuffer, response.Header, response.StatusCode)
 	return true
 }
 
+// freshness returns how long a response with headers h stays fresh, as given by
+// the origin in a Cache-Control s-maxage or max-age directive, or else an Expires header.
+// ok is false if the origin didn't say.
+func freshness(h http.Header) (ttl time.Duration, ok bool) {
+	maxAge := -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if strings.HasPrefix(directive, "s-maxage=") {
+			// s-maxage is meant for shared caches like us, so it wins over max-age.
+			if seconds, err := strconv.Atoi(directive[len("s-maxage="):]); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		} else if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(directive[len("max-age="):]); err == nil {
+				maxAge = seconds
+			}
+		}
+	}
+	if maxAge >= 0 {
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		if t, err := http.ParseTime(expires); err == nil {
+			return time.Until(t), true
+		}
+	}
+	return 0, false
+}
+
+// staleAlready reports whether the origin gave a response with headers h no freshness
+// lifetime at all, with max-age=0 or an Expires in the past, so it's stale as soon as
+// it arrives.
+func staleAlready(h http.Header) bool {
+	ttl, ok := freshness(h)
+	return ok && ttl <= 0
+}
+
+// cacheableStatuses are the final statuses that may be cached by default (RFC 7231, section
+// 6.1).  Anything else, like a 304 meant for a conditional request or a 500 the origin will
+// get over, would be served in place of the resource to every client that asks after it.
+var cacheableStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+}
+
+// saveToCache saves a response body, its headers and its status to the cache.  If the origin
+// gave the response an explicit freshness lifetime, it expires from the cache after that long,
+// unless the proxy is recording, when it never expires, and is pinned so that nothing recorded
+// later evicts it: once the cache is full, the rest isn't recorded.  Otherwise only responses
+// with cacheableStatuses are cached, and not those that are stale already, as they'd have to
+// be fetched again before being served.
+func saveToCache(resourceURL url.URL, responseBuffer *bytes.Buffer, h http.Header, status int) {
+	if status == http.StatusPartialContent {
+		// Only part of the resource; caching it would serve that part as all of it.
+		fmt.Println("Not caching a partial response for", resourceURL.String())
+		return
+	}
+	if defaultProxy.mode != ModeRecord && !cacheableStatuses[status] {
+		fmt.Println("Not caching", resourceURL.String(), "as its status", status, "isn't cacheable")
+		return
+	}
+	if defaultProxy.mode != ModeRecord && staleAlready(h) {
+		fmt.Println("Not caching", resourceURL.String(), "as it is stale already")
+		return
+	}
+	err := defaultProxy.cache.SaveWithOptions(resourceURL, responseBuffer, saveOptions(h, status))
+	if err != nil && defaultProxy.mode == ModeRecord {
+		fmt.Println("Couldn't record", resourceURL.String(), "so it won't be replayed:", err)
+	} else if err != nil {
+		fmt.Println("Couldn't cache", resourceURL.String(), err)
+	} else if defaultProxy.mode == ModeRecord {
+		defaultProxy.cache.Pin(resourceURL)
+	}
+}
+
+// saveOptions returns the options to cache a response with headers h and status
+// with: see saveToCache.
+func saveOptions(h http.Header, status int) (opts cache.SaveOptions) {
+	opts = cache.SaveOptions{Header: h, Status: status}
+	if defaultProxy.mode == ModeRecord {
+		opts.TTL = cache.NoExpiry
+	} else if ttl, ok := freshness(h); ok && ttl > 0 {
+		opts.TTL = ttl
+	}
+	return opts
+}
+
 func hash(s string) string {
 	h := fnv.New32a()
 	h.Write([]byte(s))
@@ -83,6 +229,7 @@ func serveDirectly(proxyWriter http.ResponseWriter, client *http.Client, clientR
 		proxyRequest.Header.Set(name, value[0])
 	}
 	serverResponse, err := client.Do(proxyRequest)
+	recording(proxyWriter).waited(serverResponse)
 	defer clientRequest.Body.Close()
 
 	if err != nil {
@@ -99,7 +246,12 @@ func serveDirectly(proxyWriter http.ResponseWriter, client *http.Client, clientR
 	proxyWriter.Write(responseBodyData)
 }
 
-func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request) {
+// serveAndCache fetches clientRequest from the origin, caches it and sends it back.
+// If the origin can't be reached or fails, stale is sent back instead, if it may be.
+// Range and If-Range are passed on as they are: if the origin sends back all of the
+// resource anyway, it is cached, and the ranges cut out of it here, but anything
+// else it sends back for them is only ever cached as a part; see cachePart.
+func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request, stale *staleResponse) {
 	resourceURL, _ := url.Parse(clientRequest.RequestURI)
 	hashedLink := hash(clientRequest.RequestURI)
 
@@ -109,16 +261,32 @@ func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientR
 		proxyRequest.Header.Set(name, value[0])
 	}
 	serverResponse, err := client.Do(proxyRequest)
+	recording(proxyWriter).waited(serverResponse)
 	fmt.Println("Received response from the server", hashedLink)
 
-	if err != nil {
+	if err != nil && stale.onError() {
+		serveStale(proxyWriter, clientRequest, stale, warningStale, warningRevalidationFailed)
+		return
+	} else if err != nil {
 		http.Error(proxyWriter, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if serverResponse.StatusCode >= http.StatusInternalServerError && stale.onError() {
+		serverResponse.Body.Close()
+		serveStale(proxyWriter, clientRequest, stale, warningStale, warningRevalidationFailed)
+		return
+	}
 	responseBodyData, err := ioutil.ReadAll(serverResponse.Body)
 	if err != nil {
 		fmt.Println(err)
 		return
+	} else if clientRequest.Header.Get("Range") != "" && serverResponse.StatusCode != http.StatusOK {
+		// Some of the resource, or none of it; not to be cached as all of it.
+		serverResponse.Body.Close()
+		if serverResponse.StatusCode == http.StatusPartialContent && mayStore(serverResponse.Header) {
+			cachePart(*resourceURL, serverResponse, responseBodyData)
+		}
+		relay(proxyWriter, serverResponse, responseBodyData)
 	} else {
 		// contentGzipped := false
 		for k, v := range serverResponse.Header {
@@ -133,8 +301,6 @@ func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientR
 				}
 			}*/
 		}
-		proxyWriter.WriteHeader(serverResponse.StatusCode)
-
 		var responseBuffer, parseBuffer bytes.Buffer
 		/*
 			if contentGzipped {
@@ -147,16 +313,25 @@ func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientR
 		defer serverResponse.Body.Close()
 
 		// no-store would have no effect
-		if serverResponse.Header.Get("Cache-Control") == "public" || serverResponse.Header.Get("Cache-Control") == "" {
+		if stale != nil && serverResponse.StatusCode >= http.StatusInternalServerError {
+			// The stale copy is kept for the rest of its grace, rather than the origin's error.
+			fmt.Println("Not caching an error from the origin over the stale copy")
+		} else if defaultProxy.mode == ModeRecord {
+			fmt.Println("Recording the server response, whatever its Cache-Control")
+			saveToCache(*resourceURL, bytes.NewBuffer(responseBuffer.Bytes()), serverResponse.Header, serverResponse.StatusCode)
+		} else if mayStore(serverResponse.Header) {
 			fmt.Println("Calling cache.Save to cache the server response")
-			defaultProxy.cache.SaveWithHeaders(*resourceURL, bytes.NewBuffer(responseBuffer.Bytes()), serverResponse.Header)
-		} else if serverResponse.Header.Get("Cache-Control") == "no-store" {
-			fmt.Println("Cache-Control specifies a no-store option")
+			saveToCache(*resourceURL, bytes.NewBuffer(responseBuffer.Bytes()), serverResponse.Header, serverResponse.StatusCode)
 		} else {
-			fmt.Println("Cache-Control specifies a option that's not supported, but we'll cache anyway")
-			defaultProxy.cache.SaveWithHeaders(*resourceURL, bytes.NewBuffer(responseBuffer.Bytes()), serverResponse.Header)
+			fmt.Println("Cache-Control specifies a no-store or private option")
 		}
 
+		if clientRequest.Header.Get("Range") != "" && serverResponse.StatusCode == http.StatusOK {
+			serveRange(proxyWriter, clientRequest, serverResponse.Header, responseBodyData)
+			return
+		}
+		proxyWriter.WriteHeader(serverResponse.StatusCode)
+
 		if strings.HasPrefix(serverResponse.Header.Get("Content-Type"), "text/html") {
 			fmt.Println("Parsing the response body to find more resources to cache")
 			lists, _ := ParseResponseBody(&parseBuffer, serverResponse.Header)
@@ -166,12 +341,21 @@ func serveAndCache(proxyWriter http.ResponseWriter, client *http.Client, clientR
 				dumpedResponseData = bytes.Replace(dumpedResponseData, []byte(k), []byte(v), -1)
 			}
 			proxyWriter.Write(dumpedResponseData)
+		} else {
+			proxyWriter.Write(responseBuffer.Bytes())
 		}
 	}
 }
 
-func serveWithCache(proxyWriter http.ResponseWriter, originalHeaders http.Header, cachedResponseBuffer *bytes.Buffer) {
+// serveWithCache sends back a response from the cache to clientRequest, with the
+// status it was cached with, or just the ranges of it that clientRequest asked for.
+func serveWithCache(proxyWriter http.ResponseWriter, clientRequest *http.Request, status int, originalHeaders http.Header, cachedResponseBuffer *bytes.Buffer) {
 	fmt.Println("Got the requested resource from cache, serving content...")
+	recording(proxyWriter).served()
+	if clientRequest.Header.Get("Range") != "" && status == http.StatusOK {
+		serveRange(proxyWriter, clientRequest, originalHeaders, cachedResponseBuffer.Bytes())
+		return
+	}
 
 	// Make a temporary copy of this cache resource.  We do not
 	// want to drain the actual buffer in the cache.
@@ -185,28 +369,145 @@ func serveWithCache(proxyWriter http.ResponseWriter, originalHeaders http.Header
 	for k, v := range originalHeaders {
 		proxyWriter.Header().Set(k, v[0])
 	}
+	proxyWriter.WriteHeader(status)
 	if _, err := io.Copy(proxyWriter, &tmp); err != nil {
 		fmt.Println(err)
 	}
 }
 
+// serveRange sends back the ranges of body, a complete response with headers h, that
+// clientRequest asked for in its Range header: as a 206, in a multipart/byteranges body
+// if there are several, or a 416 if none of them are in body.  If clientRequest has an
+// If-Range that h's ETag or Last-Modified doesn't match, all of body is sent back instead.
+func serveRange(proxyWriter http.ResponseWriter, clientRequest *http.Request, h http.Header, body []byte) {
+	fmt.Println("Serving", clientRequest.Header.Get("Range"), "of the resource")
+	for k, v := range h {
+		// ServeContent works out the length of whatever it sends back.
+		if k != "Content-Length" && k != "Transfer-Encoding" {
+			proxyWriter.Header().Set(k, v[0])
+		}
+	}
+	modified, _ := http.ParseTime(h.Get("Last-Modified"))
+	http.ServeContent(proxyWriter, clientRequest, "", modified, bytes.NewReader(body))
+}
+
+// serveMiss sends back the replay miss error, or if offline a 504, for a request
+// that isn't in the cache.
+func serveMiss(proxyWriter http.ResponseWriter, clientRequest *http.Request) {
+	fmt.Println("Not contacting the origin, so not fetching", clientRequest.Method, clientRequest.RequestURI)
+	if defaultProxy.mode == ModeOffline {
+		http.Error(proxyWriter, offlineBody, http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(proxyWriter, defaultProxy.missBody, defaultProxy.missStatus)
+}
+
+// serveResource sends back the resource at resourceURL, asked for by clientRequest,
+// from the cache if it's there and fresh, and otherwise as the proxy's mode and the
+// origin's Cache-Control allow: a stale resource may be served while it is fetched
+// again in the background, or if fetching it fails.  Concurrent requests for a
+// resource that has to be fetched share one fetch.  Ranges of a resource that isn't
+// cached whole are served from whatever parts of it are, see serveSparse.
+func serveResource(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request, resourceURL url.URL) {
+	cachedResponse, originalHeaders, status, stale, err := defaultProxy.cache.GetResponse(resourceURL)
+	response := &staleResponse{body: cachedResponse, header: originalHeaders, status: status, age: stale}
+	switch {
+	case err != nil && clientRequest.Method == "GET" && clientRequest.Header.Get("Range") != "":
+		serveSparse(proxyWriter, client, clientRequest, resourceURL)
+	case err != nil && (defaultProxy.mode == ModeReplay || defaultProxy.mode == ModeOffline):
+		serveMiss(proxyWriter, clientRequest)
+	case err != nil:
+		fmt.Println("The requested resource is not in cache", hash(resourceURL.String()))
+		serveShared(proxyWriter, client, clientRequest, resourceURL, nil)
+	case defaultProxy.mode == ModeOffline && stale > 0:
+		serveStale(proxyWriter, clientRequest, response, warningStale, warningDisconnected)
+	case defaultProxy.mode == ModeOffline:
+		serveStale(proxyWriter, clientRequest, response, warningDisconnected)
+	case stale == 0:
+		serveWithCache(proxyWriter, clientRequest, status, originalHeaders, cachedResponse)
+	case defaultProxy.mode == ModeReplay:
+		serveMiss(proxyWriter, clientRequest)
+	default:
+		fmt.Println("The requested resource in cache is stale", hash(resourceURL.String()))
+		if response.whileRevalidating() {
+			revalidate(resourceURL, originalHeaders)
+			serveStale(proxyWriter, clientRequest, response, warningStale)
+		} else {
+			serveShared(proxyWriter, client, clientRequest, resourceURL, response)
+		}
+	}
+}
+
+// SnapshotPath is where the proxy serves a snapshot of its cache (see cache.Cache.Export),
+// and WARCPath a WARC file of it (see cache.Cache.ExportWARC), to requests made to
+// the proxy itself rather than through it.  Both hold everything in the cache, so
+// they are only served to requests bearing the admin token; see UseAdminToken.
+const (
+	SnapshotPath = "/_cache/snapshot"
+	WARCPath     = "/_cache/warc"
+)
+
+// admitted reports whether clientRequest, for one of the proxy's own endpoints,
+// bears the admin token in an "Authorization: Bearer" header.  If not, it is
+// answered here: with a 404 if there is no admin token, as though the endpoints
+// weren't there, or a 401.
+func admitted(proxyWriter http.ResponseWriter, clientRequest *http.Request) bool {
+	if defaultProxy.adminToken == "" {
+		http.NotFound(proxyWriter, clientRequest)
+		return false
+	}
+	token := strings.TrimPrefix(clientRequest.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(defaultProxy.adminToken)) != 1 {
+		fmt.Println("Refusing", clientRequest.RequestURI, "to a request without the admin token")
+		proxyWriter.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(proxyWriter, "Missing or wrong admin token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// serveExport sends back the cache as written by export, with content type contentType.
+func serveExport(proxyWriter http.ResponseWriter, contentType string, export func(w io.Writer) error) {
+	fmt.Println("Serving an export of the cache as", contentType)
+	proxyWriter.Header().Set("Content-Type", contentType)
+	if err := export(proxyWriter); err != nil {
+		// Too late to send an error status; the client gets a truncated file.
+		fmt.Println(err)
+	}
+}
+
 func handler(proxyWriter http.ResponseWriter, clientRequest *http.Request) {
 	client := &http.Client{}
 
 	fmt.Println("Client requested", clientRequest.Method, clientRequest.RequestURI)
 
+	// Record everything but requests for the proxy itself, if asked to.
+	if defaultProxy.har != nil && !strings.HasPrefix(clientRequest.RequestURI, "/_cache/") {
+		rec := newHARRecorder(proxyWriter, clientRequest)
+		defer func() { defaultProxy.har.add(rec.entry()) }()
+		proxyWriter = rec
+	}
+
 	if strings.HasPrefix(clientRequest.RequestURI, "http://") && clientRequest.Method == "GET" {
 		// We only handle http GET requests
 		// this is not a local/rewritten request
 		hashedLink := hash(clientRequest.RequestURI)
 		resourceURL, _ := url.Parse(clientRequest.RequestURI)
 		fmt.Println("Trying to fetch resource from cache.Get", hashedLink)
-		cachedResponse, originalHeaders, err := defaultProxy.cache.GetWithHeaders(*resourceURL)
-		if err == cache.ErrResourceNotInCache {
-			serveAndCache(proxyWriter, client, clientRequest)
-		} else {
-			serveWithCache(proxyWriter, originalHeaders, cachedResponse)
+		serveResource(proxyWriter, client, clientRequest, *resourceURL)
+	} else if clientRequest.RequestURI == SnapshotPath && clientRequest.Method == "GET" {
+		// this is a request for the proxy itself
+		if admitted(proxyWriter, clientRequest) {
+			serveExport(proxyWriter, "application/x-tar", defaultProxy.cache.Export)
+		}
+	} else if clientRequest.RequestURI == WARCPath && clientRequest.Method == "GET" {
+		// so is this
+		if admitted(proxyWriter, clientRequest) {
+			serveExport(proxyWriter, "application/warc", defaultProxy.cache.ExportWARC)
 		}
+	} else if clientRequest.RequestURI == HARPath && clientRequest.Method == "GET" {
+		// and this
+		serveHAR(proxyWriter, clientRequest)
 	} else if strings.HasPrefix(clientRequest.RequestURI, "/?referrer") && clientRequest.Method == "GET" {
 		// this is a local/rewritten request
 		originalLink := loadLink(clientRequest.RequestURI)
@@ -216,15 +517,11 @@ func handler(proxyWriter http.ResponseWriter, clientRequest *http.Request) {
 
 		resourceURL, _ := url.Parse(originalLink)
 		fmt.Println("Trying to fetch resource from cache.Get", originalLink)
-		cachedResponse, originalHeaders, err := defaultProxy.cache.GetWithHeaders(*resourceURL)
-		if err == cache.ErrResourceNotInCache {
-			// resouce not in cache should not happen, but we can deal with it
-			fmt.Println("The requested resource is not in cache", hashedLink)
-			serveAndCache(proxyWriter, client, clientRequest)
-		} else {
-			// resource is in cache and we can serve it
-			serveWithCache(proxyWriter, originalHeaders, cachedResponse)
-		}
+		// resouce not in cache should not happen, but serveResource can deal with it
+		serveResource(proxyWriter, client, clientRequest, *resourceURL)
+	} else if defaultProxy.mode == ModeReplay || defaultProxy.mode == ModeOffline {
+		// nothing else is ever cached, so it's always a miss
+		serveMiss(proxyWriter, clientRequest)
 	} else {
 		// ... http POST and other stuffs go here
 		fmt.Println("Cannot parse the provided URI, will simply serve w/o caching")
@@ -300,6 +597,31 @@ func ListenOn(ipPort string) { defaultProxy.ipPort = ipPort }
 // UseCache sets the default proxy to use cache cache.
 func UseCache(cache cache.Cache) { defaultProxy.cache = cache }
 
+// UseMode sets how the default proxy uses its cache; ModeNormal unless this is called.
+func UseMode(mode Mode) { defaultProxy.mode = mode }
+
+// CoalesceFor sets how long a request for a resource that is already being fetched
+// waits for that fetch before fetching the resource itself; 10 seconds unless this is
+// called.  A timeout of 0 turns coalescing off, so every request fetches for itself.
+func CoalesceFor(timeout time.Duration) { defaultProxy.coalesceTimeout = timeout }
+
+// UseAdminToken sets the token requests for the proxy's own endpoints, like
+// SnapshotPath, must bear, as "Authorization: Bearer token".  Unless this is
+// called with a token, those endpoints are off.
+func UseAdminToken(token string) { defaultProxy.adminToken = token }
+
+// StaleIfErrorFor sets how long after a resource expires it may be served in place
+// of an error from the origin, if the origin didn't say with stale-if-error.  Unless
+// this is called, it isn't, as the origin never allowed it.  It is served for no
+// longer than the cache keeps it; see cache.Config.StaleGrace.
+func StaleIfErrorFor(window time.Duration) { defaultProxy.staleIfError = window }
+
+// ReplayMissWith sets the error the default proxy answers requests that aren't in the
+// cache with in ModeReplay: status, with body as the message.
+func ReplayMissWith(status int, body string) {
+	defaultProxy.missStatus, defaultProxy.missBody = status, body
+}
+
 // InterceptGET ...
 func InterceptGET() (err error) {
 	// Some shit here.
@@ -0,0 +1,900 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
+)
+
+// newTestProxy points the default proxy at a fresh cache of 1MB, kept in memory,
+// in mode, and serves it.  client sends requests through the proxy.  Whatever
+// else the test sets on the default proxy is put back afterwards.
+func newTestProxy(t *testing.T, mode Mode) (server *httptest.Server, client *http.Client, c cache.Cache) {
+	t.Helper()
+	c, err := cache.NewWithConfig(cache.Config{
+		Policy:     "LRU",
+		Size:       1,
+		Expiration: time.Hour,
+		StaleGrace: time.Hour,
+		Store:      cache.NewMemoryStore(),
+	})
+	if err != nil {
+		t.Fatalf("Couldn't instantiate cache: %v", err)
+	}
+	UseCache(c)
+	UseMode(mode)
+
+	server = httptest.NewServer(http.HandlerFunc(handler))
+	proxyURL, _ := url.Parse(server.URL)
+	client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	t.Cleanup(func() {
+		server.Close()
+		c.Close()
+		UseMode(ModeNormal)
+		UseAdminToken("")
+		CoalesceFor(defaultCoalesceTimeout)
+		StaleIfErrorFor(0)
+		ReplayMissWith(defaultMissStatus, defaultMissBody)
+		defaultProxy.har = nil
+	})
+	return server, client, c
+}
+
+// get sends a GET for target, with the headers in h, through client, and returns
+// the response with its body read.
+func get(t *testing.T, client *http.Client, target string, h http.Header) (response *http.Response, body string) {
+	t.Helper()
+	request, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		t.Fatalf("Couldn't make a request for %s: %v", target, err)
+	}
+	for k, v := range h {
+		request.Header[k] = v
+	}
+	response, err = client.Do(request)
+	if err != nil {
+		t.Fatalf("Couldn't get %s: %v", target, err)
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %v", target, err)
+	}
+	return response, string(contents)
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	server, _, _ := newTestProxy(t, ModeNormal)
+
+	t.Run("Admin endpoints are off without an admin token", func(t *testing.T) {
+		for _, path := range []string{SnapshotPath, WARCPath} {
+			if response, _ := get(t, http.DefaultClient, server.URL+path, nil); response.StatusCode != http.StatusNotFound {
+				t.Errorf("%s answered %d instead of 404", path, response.StatusCode)
+			}
+		}
+	})
+
+	t.Run("Admin endpoints are only served to requests bearing the admin token", func(t *testing.T) {
+		UseAdminToken("s3cret")
+		for _, path := range []string{SnapshotPath, WARCPath} {
+			if response, _ := get(t, http.DefaultClient, server.URL+path, nil); response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s answered %d instead of 401 without the token", path, response.StatusCode)
+			}
+			wrong := http.Header{"Authorization": {"Bearer guess"}}
+			if response, _ := get(t, http.DefaultClient, server.URL+path, wrong); response.StatusCode != http.StatusUnauthorized {
+				t.Errorf("%s answered %d instead of 401 to the wrong token", path, response.StatusCode)
+			}
+			right := http.Header{"Authorization": {"Bearer s3cret"}}
+			if response, _ := get(t, http.DefaultClient, server.URL+path, right); response.StatusCode != http.StatusOK {
+				t.Errorf("%s answered %d instead of 200 to the token", path, response.StatusCode)
+			}
+		}
+	})
+}
+
+// newCountingOrigin serves requests with serve, counting them in hits.
+func newCountingOrigin(t *testing.T, serve http.HandlerFunc) (origin *httptest.Server, hits *int32) {
+	t.Helper()
+	hits = new(int32)
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		serve(w, r)
+	}))
+	t.Cleanup(origin.Close)
+	return origin, hits
+}
+
+// newTestOrigin serves body, with the headers in h, counting the requests it gets in hits.
+func newTestOrigin(t *testing.T, h http.Header, body string) (origin *httptest.Server, hits *int32) {
+	t.Helper()
+	return newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range h {
+			w.Header()[k] = v
+		}
+		io.WriteString(w, body)
+	})
+}
+
+// newSlowOrigin serves body with status after delay, counting the requests it gets in hits.
+func newSlowOrigin(t *testing.T, status int, delay time.Duration, body string) (origin *httptest.Server, hits *int32) {
+	t.Helper()
+	return newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	})
+}
+
+// getAll sends n GETs for target, with the headers picked by header for each, through
+// client all at once, and returns the statuses and bodies of the responses.
+func getAll(t *testing.T, client *http.Client, target string, n int, header func(i int) http.Header) (statuses []int, bodies []string) {
+	t.Helper()
+	statuses, bodies = make([]int, n), make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request, _ := http.NewRequest("GET", target, nil)
+			if header != nil {
+				request.Header = header(i)
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				t.Errorf("Couldn't get %s: %v", target, err)
+				return
+			}
+			defer response.Body.Close()
+			contents, _ := ioutil.ReadAll(response.Body)
+			statuses[i], bodies[i] = response.StatusCode, string(contents)
+		}(i)
+	}
+	wg.Wait()
+	return statuses, bodies
+}
+
+func TestProxy(t *testing.T) {
+	_, client, _ := newTestProxy(t, ModeNormal)
+	h := http.Header{"Content-Type": {"text/plain"}}
+
+	t.Run("Misses are fetched from the origin, and hits served from the cache", func(t *testing.T) {
+		origin, hits := newTestOrigin(t, h, "hello")
+		for i := 0; i < 2; i++ {
+			response, body := get(t, client, origin.URL+"/hello", nil)
+			if response.StatusCode != http.StatusOK || body != "hello" {
+				t.Errorf("Got %d %q instead of 200 %q", response.StatusCode, body, "hello")
+			}
+		}
+		if atomic.LoadInt32(hits) != 1 {
+			t.Errorf("Origin was asked %d times instead of once", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Responses the origin says not to store aren't cached", func(t *testing.T) {
+		origin, hits := newTestOrigin(t, http.Header{"Cache-Control": {"no-store"}}, "secret")
+		for i := 0; i < 2; i++ {
+			if _, body := get(t, client, origin.URL+"/secret", nil); body != "secret" {
+				t.Errorf("Got %q instead of %q", body, "secret")
+			}
+		}
+		if atomic.LoadInt32(hits) != 2 {
+			t.Errorf("Origin was asked %d times instead of twice", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Responses the origin says not to store among other directives, or private ones, aren't cached", func(t *testing.T) {
+		for _, cacheControl := range []string{"max-age=60, no-store", "No-Store", "private", "private, max-age=60"} {
+			origin, hits := newTestOrigin(t, http.Header{"Cache-Control": {cacheControl}}, "secret")
+			for i := 0; i < 2; i++ {
+				if _, body := get(t, client, origin.URL+"/secret", nil); body != "secret" {
+					t.Errorf("Got %q instead of %q", body, "secret")
+				}
+			}
+			if atomic.LoadInt32(hits) != 2 {
+				t.Errorf("Origin was asked %d times instead of twice for a response with Cache-Control %q", atomic.LoadInt32(hits), cacheControl)
+			}
+		}
+	})
+
+	t.Run("Responses that are stale already aren't cached", func(t *testing.T) {
+		for _, stale := range []http.Header{
+			{"Cache-Control": {"max-age=0"}},
+			{"Expires": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+		} {
+			origin, hits := newTestOrigin(t, stale, "stale")
+			for i := 0; i < 2; i++ {
+				if _, body := get(t, client, origin.URL+"/stale", nil); body != "stale" {
+					t.Errorf("Got %q instead of %q", body, "stale")
+				}
+			}
+			if atomic.LoadInt32(hits) != 2 {
+				t.Errorf("Origin was asked %d times instead of twice for a response with %v", atomic.LoadInt32(hits), stale)
+			}
+		}
+	})
+
+	t.Run("Not Modified responses to conditional requests aren't cached", func(t *testing.T) {
+		origin, _ := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("modified"))
+		})
+		if response, _ := get(t, client, origin.URL+"/conditional", http.Header{"If-None-Match": {`"v1"`}}); response.StatusCode != http.StatusNotModified {
+			t.Errorf("Got %d instead of the origin's 304", response.StatusCode)
+		}
+		if response, body := get(t, client, origin.URL+"/conditional", nil); response.StatusCode != http.StatusOK || body != "modified" {
+			t.Errorf("Got %d %q instead of 200 %q", response.StatusCode, body, "modified")
+		}
+	})
+
+	t.Run("Errors from the origin aren't cached", func(t *testing.T) {
+		var broken int32 = 1
+		origin, _ := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&broken) == 1 {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("recovered"))
+		})
+		if response, _ := get(t, client, origin.URL+"/flaky", nil); response.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Got %d instead of the origin's 500", response.StatusCode)
+		}
+		atomic.StoreInt32(&broken, 0)
+		if response, body := get(t, client, origin.URL+"/flaky", nil); response.StatusCode != http.StatusOK || body != "recovered" {
+			t.Errorf("Got %d %q instead of 200 %q", response.StatusCode, body, "recovered")
+		}
+	})
+
+	t.Run("Requests other than GET go straight to the origin", func(t *testing.T) {
+		origin, hits := newTestOrigin(t, h, "posted")
+		for i := 0; i < 2; i++ {
+			response, err := client.Post(origin.URL+"/post", "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("Couldn't post: %v", err)
+			}
+			response.Body.Close()
+		}
+		if atomic.LoadInt32(hits) != 2 {
+			t.Errorf("Origin was asked %d times instead of twice", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Replaying proxies never contact the origin", func(t *testing.T) {
+		origin, hits := newTestOrigin(t, h, "never")
+		UseMode(ModeReplay)
+		defer UseMode(ModeNormal)
+		if response, body := get(t, client, origin.URL+"/never", nil); response.StatusCode != defaultMissStatus || !strings.Contains(body, defaultMissBody) {
+			t.Errorf("Got %d %q instead of the replay miss error", response.StatusCode, body)
+		}
+		if atomic.LoadInt32(hits) != 0 {
+			t.Errorf("Origin was asked %d times instead of never", atomic.LoadInt32(hits))
+		}
+	})
+}
+
+func TestHAR(t *testing.T) {
+	server, client, _ := newTestProxy(t, ModeNormal)
+	RecordHAR()
+	UseAdminToken("s3cret")
+	origin, _ := newTestOrigin(t, http.Header{"Content-Type": {"text/plain"}, "Set-Cookie": {"session=hunter2"}}, "hello")
+
+	credentials := http.Header{"Cookie": {"session=hunter2"}, "Authorization": {"Basic aHVudGVyMg=="}}
+	for i := 0; i < 2; i++ {
+		get(t, client, origin.URL+"/hello?q=1", credentials)
+	}
+	if response, _ := get(t, http.DefaultClient, server.URL+HARPath, nil); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("HAR log was served without the admin token: %d", response.StatusCode)
+	}
+	response, contents := get(t, http.DefaultClient, server.URL+HARPath, http.Header{"Authorization": {"Bearer s3cret"}})
+	var har harFile
+	if response.StatusCode != http.StatusOK || json.Unmarshal([]byte(contents), &har) != nil {
+		t.Fatalf("Couldn't get the HAR log: %d", response.StatusCode)
+	}
+
+	t.Run("The HAR log has an entry per request, noting cache hits", func(t *testing.T) {
+		entries := har.Log.Entries
+		if len(entries) != 2 {
+			t.Fatalf("HAR log has %d entries instead of 2", len(entries))
+		}
+		for i, entry := range entries {
+			if entry.Request.URL != origin.URL+"/hello?q=1" || len(entry.Request.QueryString) != 1 {
+				t.Errorf("Entry %d is for %s", i, entry.Request.URL)
+			}
+			if entry.Response.Status != http.StatusOK || entry.Response.HTTPVersion != "HTTP/1.1" || entry.Response.BodySize != int64(len("hello")) {
+				t.Errorf("Entry %d has response %d %s of %d bytes", i, entry.Response.Status, entry.Response.HTTPVersion, entry.Response.BodySize)
+			}
+			if entry.CacheHit != (i == 1) {
+				t.Errorf("Entry %d has _cacheHit %v", i, entry.CacheHit)
+			}
+		}
+	})
+
+	t.Run("HAR timings add up", func(t *testing.T) {
+		for i, entry := range har.Log.Entries {
+			timings := entry.Timings
+			if timings.Wait < 0 || timings.Receive < 0 || timings.Wait+timings.Receive > entry.Time+0.001 {
+				t.Errorf("Entry %d has wait %v and receive %v, taking %v in all", i, timings.Wait, timings.Receive, entry.Time)
+			}
+		}
+		if entries := har.Log.Entries; len(entries) == 2 && entries[1].Timings.Wait != 0 {
+			t.Errorf("Cache hit waited %vms on the origin", entries[1].Timings.Wait)
+		}
+	})
+
+	t.Run("Credentials are redacted from the HAR log", func(t *testing.T) {
+		if strings.Contains(contents, "hunter2") || strings.Contains(contents, "aHVudGVyMg") {
+			t.Error("HAR log holds credentials")
+		}
+		if !strings.Contains(contents, redacted) {
+			t.Error("HAR log doesn't note the redacted headers")
+		}
+	})
+}
+
+func TestCoalescing(t *testing.T) {
+	_, client, _ := newTestProxy(t, ModeNormal)
+	const clients = 10
+
+	t.Run("Concurrent requests for a resource share one fetch", func(t *testing.T) {
+		origin, hits := newSlowOrigin(t, http.StatusOK, 200*time.Millisecond, "shared")
+		statuses, bodies := getAll(t, client, origin.URL+"/shared", clients, nil)
+		for i := range statuses {
+			if statuses[i] != http.StatusOK || bodies[i] != "shared" {
+				t.Errorf("Client %d got %d %q instead of 200 %q", i, statuses[i], bodies[i], "shared")
+			}
+		}
+		if atomic.LoadInt32(hits) != 1 {
+			t.Errorf("Origin was asked %d times instead of once", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Requests waiting on a fetch get the status the origin sent back", func(t *testing.T) {
+		origin, hits := newSlowOrigin(t, http.StatusNotFound, 200*time.Millisecond, "gone")
+		statuses, bodies := getAll(t, client, origin.URL+"/gone", clients, nil)
+		for i := range statuses {
+			if statuses[i] != http.StatusNotFound || bodies[i] != "gone" {
+				t.Errorf("Client %d got %d %q instead of 404 %q", i, statuses[i], bodies[i], "gone")
+			}
+		}
+		if atomic.LoadInt32(hits) != 1 {
+			t.Errorf("Origin was asked %d times instead of once", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Requests stop waiting on a fetch after the coalesce timeout", func(t *testing.T) {
+		CoalesceFor(50 * time.Millisecond)
+		defer CoalesceFor(defaultCoalesceTimeout)
+		origin, hits := newSlowOrigin(t, http.StatusOK, 300*time.Millisecond, "slow")
+		statuses, bodies := getAll(t, client, origin.URL+"/slow", clients, nil)
+		for i := range statuses {
+			if statuses[i] != http.StatusOK || bodies[i] != "slow" {
+				t.Errorf("Client %d got %d %q instead of 200 %q", i, statuses[i], bodies[i], "slow")
+			}
+		}
+		if atomic.LoadInt32(hits) != clients {
+			t.Errorf("Origin was asked %d times instead of once per client", atomic.LoadInt32(hits))
+		}
+	})
+
+	t.Run("Requests waiting on a fetch don't get a response picked for other request headers", func(t *testing.T) {
+		origin, _ := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, r.Header.Get("Accept-Language"))
+		})
+		languages := []string{"en", "fr"}
+		_, bodies := getAll(t, client, origin.URL+"/greeting", len(languages), func(i int) http.Header {
+			return http.Header{"Accept-Language": {languages[i]}}
+		})
+		for i, language := range languages {
+			if bodies[i] != language {
+				t.Errorf("Client asking for %q got %q", language, bodies[i])
+			}
+		}
+	})
+}
+
+func TestRecordReplay(t *testing.T) {
+	_, client, c := newTestProxy(t, ModeRecord)
+	big := strings.Repeat("a", 600*1024)
+	statuses := map[string]int{"/ok": http.StatusOK, "/missing": http.StatusNotFound, "/broken": http.StatusInternalServerError}
+	origin, hits := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		// Nothing the origin says should keep a recording from being kept.
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.URL.Path == "/big" || r.URL.Path == "/bigger" {
+			// Different bodies, or they would be stored once.
+			io.WriteString(w, big+r.URL.Path)
+			return
+		}
+		w.WriteHeader(statuses[r.URL.Path])
+		io.WriteString(w, r.URL.Path)
+	})
+	for path := range statuses {
+		get(t, client, origin.URL+path, nil)
+	}
+	get(t, client, origin.URL+"/big", nil)
+	get(t, client, origin.URL+"/bigger", nil)
+	recorded := atomic.LoadInt32(hits)
+	origin.Close()
+	UseMode(ModeReplay)
+
+	t.Run("Replays send back what was recorded, with its status", func(t *testing.T) {
+		for path, status := range statuses {
+			if response, body := get(t, client, origin.URL+path, nil); response.StatusCode != status || body != path {
+				t.Errorf("Replayed %d %q for %s instead of %d %q", response.StatusCode, body, path, status, path)
+			}
+		}
+		if atomic.LoadInt32(hits) != recorded {
+			t.Error("Origin was asked while replaying")
+		}
+	})
+
+	t.Run("Recorded responses aren't evicted to record others", func(t *testing.T) {
+		if response, body := get(t, client, origin.URL+"/big", nil); response.StatusCode != http.StatusOK || body != big+"/big" {
+			t.Errorf("Replayed %d for /big instead of what was recorded", response.StatusCode)
+		}
+		if response, _ := get(t, client, origin.URL+"/bigger", nil); response.StatusCode != defaultMissStatus {
+			t.Errorf("Replayed %d for /bigger, which didn't fit, instead of the replay miss error", response.StatusCode)
+		}
+		if entries := c.Stats().PinnedEntries; entries != len(statuses)+1 {
+			t.Errorf("Cache has %d pinned entries instead of %d", entries, len(statuses)+1)
+		}
+	})
+}
+
+func TestStaleIfError(t *testing.T) {
+	_, client, c := newTestProxy(t, ModeNormal)
+	origin, _ := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	})
+
+	// expired caches a response for path, with the headers in h, that has just expired.
+	expired := func(t *testing.T, path string, h http.Header) string {
+		u, _ := url.Parse(origin.URL + path)
+		h.Set("Content-Type", "text/plain")
+		if err := c.SaveWithTTL(*u, bytes.NewBufferString("stale"), h, time.Millisecond); err != nil {
+			t.Fatalf("Couldn't save %s to the cache", u.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+		return u.String()
+	}
+
+	t.Run("Stale responses aren't served in place of errors unless the origin allows it", func(t *testing.T) {
+		target := expired(t, "/unsaid", http.Header{})
+		if response, _ := get(t, client, target, nil); response.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Got %d instead of the origin's 500", response.StatusCode)
+		}
+	})
+
+	t.Run("Stale responses are served in place of errors within stale-if-error", func(t *testing.T) {
+		target := expired(t, "/allowed", http.Header{"Cache-Control": {"stale-if-error=3600"}})
+		response, body := get(t, client, target, nil)
+		if response.StatusCode != http.StatusOK || body != "stale" {
+			t.Errorf("Got %d %q instead of the stale response", response.StatusCode, body)
+		}
+		if warning := response.Header.Get("Warning"); !strings.Contains(warning, warningStale) || !strings.Contains(warning, warningRevalidationFailed) {
+			t.Errorf("Stale response has Warning %q", warning)
+		}
+	})
+
+	t.Run("Errors from the origin aren't cached over stale responses", func(t *testing.T) {
+		target := expired(t, "/kept", http.Header{})
+		if response, _ := get(t, client, target, nil); response.StatusCode != http.StatusInternalServerError {
+			t.Errorf("Got %d instead of the origin's 500", response.StatusCode)
+		}
+		u, _ := url.Parse(target)
+		if body, _, status, _, err := c.GetResponse(*u); err != nil || status != http.StatusOK || body.String() != "stale" {
+			t.Errorf("The stale response was replaced by %d %q", status, body)
+		}
+	})
+
+	t.Run("Stale responses are served in place of errors within the proxy's own window", func(t *testing.T) {
+		StaleIfErrorFor(time.Hour)
+		defer StaleIfErrorFor(0)
+		target := expired(t, "/configured", http.Header{"Warning": {`199 - "Kept"`}})
+		response, body := get(t, client, target, nil)
+		if response.StatusCode != http.StatusOK || body != "stale" {
+			t.Errorf("Got %d %q instead of the stale response", response.StatusCode, body)
+		}
+		if warning := response.Header.Get("Warning"); !strings.HasPrefix(warning, `199 - "Kept", `) || !strings.Contains(warning, warningStale) {
+			t.Errorf("Stale response has Warning %q, instead of the cached one and ours", warning)
+		}
+	})
+}
+
+func TestRanges(t *testing.T) {
+	_, client, _ := newTestProxy(t, ModeNormal)
+	const body = "0123456789"
+	var asked atomic.Value
+	origin, hits := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		asked.Store(r.Header.Get("Range") + "|" + r.Header.Get("If-Range"))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	})
+
+	type rangeCase struct {
+		name    string
+		h       http.Header
+		status  int
+		want    string // the body, or for several ranges what the parts hold, in order
+		several bool
+	}
+	cases := []rangeCase{
+		{"single", http.Header{"Range": {"bytes=2-5"}}, http.StatusPartialContent, "2345", false},
+		{"multi", http.Header{"Range": {"bytes=0-1,4-5"}}, http.StatusPartialContent, "0145", true},
+		{"suffix", http.Header{"Range": {"bytes=-3"}}, http.StatusPartialContent, "789", false},
+		{"unsatisfiable", http.Header{"Range": {"bytes=20-30"}}, http.StatusRequestedRangeNotSatisfiable, "", false},
+		{"if-range mismatch", http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"v0"`}}, http.StatusOK, body, false},
+	}
+
+	// check checks that response, with contents, is what c asked for.
+	check := func(t *testing.T, response *http.Response, contents string, c rangeCase) {
+		t.Helper()
+		if response.StatusCode != c.status {
+			t.Fatalf("Got %d instead of %d", response.StatusCode, c.status)
+		}
+		if c.status == http.StatusRequestedRangeNotSatisfiable {
+			return
+		}
+		got := contents
+		if c.several {
+			got = ""
+			_, params, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+			reader := multipart.NewReader(strings.NewReader(contents), params["boundary"])
+			for {
+				part, err := reader.NextPart()
+				if err != nil {
+					break
+				}
+				data, _ := ioutil.ReadAll(part)
+				got += string(data)
+			}
+		}
+		if got != c.want {
+			t.Errorf("Got %q instead of %q", got, c.want)
+		}
+	}
+
+	t.Run("Ranges of resources that aren't cached are passed on to the origin", func(t *testing.T) {
+		for _, c := range cases {
+			target := origin.URL + "/miss/" + strings.Replace(c.name, " ", "-", -1)
+			response, contents := get(t, client, target, c.h)
+			check(t, response, contents, c)
+			if want := c.h.Get("Range") + "|" + c.h.Get("If-Range"); asked.Load() != want {
+				t.Errorf("%s: the origin was asked for %q instead of %q", c.name, asked.Load(), want)
+			}
+		}
+	})
+
+	t.Run("Ranges of cached resources are served from the cache", func(t *testing.T) {
+		target := origin.URL + "/whole"
+		if response, _ := get(t, client, target, nil); response.StatusCode != http.StatusOK {
+			t.Fatalf("Couldn't cache %s", target)
+		}
+		before := atomic.LoadInt32(hits)
+		for _, c := range cases {
+			response, contents := get(t, client, target, c.h)
+			check(t, response, contents, c)
+		}
+		if after := atomic.LoadInt32(hits); after != before {
+			t.Errorf("The origin was asked %d more times", after-before)
+		}
+	})
+}
+
+func TestParseRanges(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []cache.Range
+		err  error
+	}{
+		{"bytes=0-4", []cache.Range{{Offset: 0, Length: 5}}, nil},
+		{"bytes=2-", []cache.Range{{Offset: 2, Length: 8}}, nil},
+		{"bytes=-3", []cache.Range{{Offset: 7, Length: 3}}, nil},
+		{"bytes=-20", []cache.Range{{Offset: 0, Length: 10}}, nil},
+		{"bytes=8-20", []cache.Range{{Offset: 8, Length: 2}}, nil},
+		{"bytes=0-1, 4-5", []cache.Range{{Offset: 0, Length: 2}, {Offset: 4, Length: 2}}, nil},
+		{"bytes=0-1,10-20", []cache.Range{{Offset: 0, Length: 2}}, nil},
+		{"bytes=10-20", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		{"bytes=5-2", nil, errRangeSyntax},
+		{"bytes=a-b", nil, errRangeSyntax},
+		{"bytes=1", nil, errRangeSyntax},
+		{"items=0-1", nil, errRangeSyntax},
+	}
+	for _, c := range cases {
+		ranges, err := parseRanges(c.spec, 10)
+		if err != c.err || !reflect.DeepEqual(ranges, c.want) {
+			t.Errorf("%q parsed to %v, %v; expected %v, %v", c.spec, ranges, err, c.want, c.err)
+		}
+	}
+}
+
+func TestContentRange(t *testing.T) {
+	cases := []struct {
+		r    cache.Range
+		size int64
+		want string
+	}{
+		{cache.Range{Offset: 0, Length: 5}, 10, "bytes 0-4/10"},
+		{cache.Range{Offset: 9, Length: 1}, 10, "bytes 9-9/10"},
+		{cache.Range{Offset: 0, Length: 1}, 1, "bytes 0-0/1"},
+	}
+	for _, c := range cases {
+		if got := contentRange(c.r, c.size); got != c.want {
+			t.Errorf("Range %v of %d bytes is %q, expected %q", c.r, c.size, got, c.want)
+		}
+	}
+}
+
+func TestServePart(t *testing.T) {
+	h := http.Header{"Content-Type": {"text/plain"}, "Etag": {`"v1"`}, "Content-Length": {"10"}}
+	cases := []struct {
+		name   string
+		ranges []cache.Range
+		parts  []string
+	}{
+		{"single", []cache.Range{{Offset: 2, Length: 4}}, []string{"2345"}},
+		{"multi", []cache.Range{{Offset: 0, Length: 2}, {Offset: 7, Length: 3}}, []string{"01", "789"}},
+	}
+	for _, c := range cases {
+		parts := make([][]byte, len(c.parts))
+		for i, part := range c.parts {
+			parts[i] = []byte(part)
+		}
+		recorder := httptest.NewRecorder()
+		servePart(recorder, h, 10, c.ranges, parts)
+		response := recorder.Result()
+		body, _ := ioutil.ReadAll(response.Body)
+		if response.StatusCode != http.StatusPartialContent {
+			t.Errorf("%s: got %d instead of 206", c.name, response.StatusCode)
+		}
+		if response.Header.Get("ETag") != `"v1"` || response.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+			t.Errorf("%s: sent back ETag %q and Content-Length %q", c.name, response.Header.Get("ETag"), response.Header.Get("Content-Length"))
+		}
+		if len(c.ranges) == 1 {
+			if got := response.Header.Get("Content-Range"); got != contentRange(c.ranges[0], 10) || string(body) != c.parts[0] {
+				t.Errorf("%s: sent back %q of %q", c.name, body, got)
+			}
+			continue
+		}
+		mediaType, params, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+		if mediaType != "multipart/byteranges" {
+			t.Errorf("%s: sent back %s instead of multipart/byteranges", c.name, mediaType)
+			continue
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i, r := range c.ranges {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("%s: couldn't read part %d: %v", c.name, i, err)
+			}
+			data, _ := ioutil.ReadAll(part)
+			if part.Header.Get("Content-Range") != contentRange(r, 10) || part.Header.Get("Content-Type") != "text/plain" || string(data) != c.parts[i] {
+				t.Errorf("%s: part %d is %q of %q, %s", c.name, i, data, part.Header.Get("Content-Range"), part.Header.Get("Content-Type"))
+			}
+		}
+	}
+}
+
+func TestSparse(t *testing.T) {
+	_, client, _ := newTestProxy(t, ModeNormal)
+	const body = "0123456789"
+	var asked atomic.Value
+	// newRangeOrigin serves body in ranges, with the headers in h, counting the
+	// requests it gets in hits and noting the last Range it was asked for.
+	newRangeOrigin := func(h http.Header) (origin *httptest.Server, hits *int32) {
+		return newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+			asked.Store(r.Header.Get("Range"))
+			for k, v := range h {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		})
+	}
+
+	t.Run("Missing ranges are fetched in one request", func(t *testing.T) {
+		origin, hits := newRangeOrigin(http.Header{"Etag": {`"v1"`}})
+		for _, spec := range []string{"bytes=0-1", "bytes=6-7"} {
+			get(t, client, origin.URL, http.Header{"Range": {spec}})
+		}
+		response, contents := get(t, client, origin.URL, http.Header{"Range": {"bytes=0-9"}})
+		if response.StatusCode != http.StatusPartialContent || contents != body {
+			t.Errorf("Got %d %q instead of all of the resource", response.StatusCode, contents)
+		}
+		if n := atomic.LoadInt32(hits); n != 3 || asked.Load() != "bytes=2-5,8-9" {
+			t.Errorf("The origin was asked %d times, lastly for %q", n, asked.Load())
+		}
+		response, contents = get(t, client, origin.URL, http.Header{"Range": {"bytes=3-4"}})
+		if response.StatusCode != http.StatusPartialContent || contents != "34" || atomic.LoadInt32(hits) != 3 {
+			t.Errorf("Got %d %q instead of a range from the cache", response.StatusCode, contents)
+		}
+	})
+
+	t.Run("Ranges aren't cached without a strong validator", func(t *testing.T) {
+		origin, hits := newRangeOrigin(http.Header{"Etag": {`W/"v1"`}})
+		for i := 0; i < 2; i++ {
+			if response, contents := get(t, client, origin.URL, http.Header{"Range": {"bytes=0-1"}}); contents != "01" {
+				t.Errorf("Got %d %q instead of the range", response.StatusCode, contents)
+			}
+		}
+		if n := atomic.LoadInt32(hits); n != 2 {
+			t.Errorf("The origin was asked %d times instead of 2", n)
+		}
+	})
+
+	t.Run("Ranges aren't cached if the origin says not to", func(t *testing.T) {
+		origin, hits := newRangeOrigin(http.Header{"Etag": {`"v1"`}, "Cache-Control": {"no-store, private"}})
+		for i := 0; i < 2; i++ {
+			if response, contents := get(t, client, origin.URL, http.Header{"Range": {"bytes=0-1"}}); contents != "01" {
+				t.Errorf("Got %d %q instead of the range", response.StatusCode, contents)
+			}
+		}
+		if n := atomic.LoadInt32(hits); n != 2 {
+			t.Errorf("The origin was asked %d times instead of 2", n)
+		}
+	})
+}
+
+func TestServingStale(t *testing.T) {
+	_, client, c := newTestProxy(t, ModeNormal)
+	origin, hits := newTestOrigin(t, http.Header{"Content-Type": {"text/plain"}}, "fetched")
+
+	// cached caches a response for path, with the headers in h, for ttl, and waits
+	// a little, so that it has expired if ttl is short.
+	cached := func(t *testing.T, path string, h http.Header, ttl time.Duration) string {
+		u, _ := url.Parse(origin.URL + path)
+		h.Set("Content-Type", "text/plain")
+		if err := c.SaveWithTTL(*u, bytes.NewBufferString("cached"), h, ttl); err != nil {
+			t.Fatalf("Couldn't save %s to the cache", u.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+		return u.String()
+	}
+
+	t.Run("Stale responses are served while they are fetched again in the background", func(t *testing.T) {
+		target := cached(t, "/revalidated", http.Header{"Cache-Control": {"stale-while-revalidate=3600"}}, time.Millisecond)
+		response, body := get(t, client, target, nil)
+		if body != "cached" || response.Header.Get("Warning") != warningStale {
+			t.Errorf("Got %q with Warning %q instead of the stale response", body, response.Header.Get("Warning"))
+		}
+		u, _ := url.Parse(target)
+		for i := 0; i < 100; i++ {
+			if body, _, _, _, err := c.GetResponse(*u); err == nil && body.String() == "fetched" {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if response, body = get(t, client, target, nil); body != "fetched" || response.Header.Get("Warning") != "" {
+			t.Errorf("Got %q with Warning %q instead of the response fetched in the background", body, response.Header.Get("Warning"))
+		}
+		if n := atomic.LoadInt32(hits); n != 1 {
+			t.Errorf("Origin was asked %d times instead of once", n)
+		}
+	})
+
+	t.Run("Offline proxies serve whatever they have, saying so", func(t *testing.T) {
+		UseMode(ModeOffline)
+		defer UseMode(ModeNormal)
+		before := atomic.LoadInt32(hits)
+		fresh := cached(t, "/fresh", http.Header{}, time.Hour)
+		if response, body := get(t, client, fresh, nil); body != "cached" || response.Header.Get("Warning") != warningDisconnected {
+			t.Errorf("Got %q with Warning %q instead of the cached response", body, response.Header.Get("Warning"))
+		}
+		stale := cached(t, "/stale", http.Header{"Cache-Control": {"must-revalidate"}}, time.Millisecond)
+		if response, body := get(t, client, stale, nil); body != "cached" || response.Header.Get("Warning") != warningStale+", "+warningDisconnected {
+			t.Errorf("Got %q with Warning %q instead of the stale response", body, response.Header.Get("Warning"))
+		}
+		if response, _ := get(t, client, origin.URL+"/missing", nil); response.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("Got %d instead of 504 for a resource that isn't cached", response.StatusCode)
+		}
+		if after := atomic.LoadInt32(hits); after != before {
+			t.Errorf("Origin was asked %d times instead of never", after-before)
+		}
+	})
+}
+
+func TestRefreshAhead(t *testing.T) {
+	_, client, _ := newTestProxy(t, ModeNormal)
+	// Everything is refreshed ahead as soon as it's used, as it all expires within a second.
+	c, err := cache.NewWithConfig(cache.Config{
+		Policy:         "LRU",
+		Size:           1,
+		Expiration:     time.Hour,
+		Store:          cache.NewMemoryStore(),
+		RefreshAhead:   2 * time.Second,
+		OnRefreshAhead: RefreshAhead,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't instantiate cache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	UseCache(c)
+
+	var broken, conditional int32
+	origin, hits := newCountingOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", `"v1"`)
+		if atomic.LoadInt32(&broken) == 1 {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+
+	// refreshed waits until the origin has been asked n times, and the proxy is done with it.
+	refreshed := func(t *testing.T, n int32) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			defaultProxy.Lock()
+			revalidating := len(defaultProxy.revalidating)
+			defaultProxy.Unlock()
+			if atomic.LoadInt32(hits) >= n && revalidating == 0 {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Origin was asked %d times instead of %d", atomic.LoadInt32(hits), n)
+	}
+
+	t.Run("Resources that fail to refresh are refreshed again when they're next used", func(t *testing.T) {
+		target := origin.URL + "/failing"
+		before := atomic.LoadInt32(hits)
+		get(t, client, target, nil)
+		refreshed(t, before+1)
+		atomic.StoreInt32(&broken, 1)
+		defer atomic.StoreInt32(&broken, 0)
+		get(t, client, target, nil)
+		refreshed(t, before+2)
+		get(t, client, target, nil)
+		refreshed(t, before+3)
+	})
+
+	t.Run("Resources are revalidated ahead, and not fetched again if they haven't changed", func(t *testing.T) {
+		target := origin.URL + "/unchanged"
+		before := atomic.LoadInt32(hits)
+		get(t, client, target, nil)
+		time.Sleep(600 * time.Millisecond)
+		if _, body := get(t, client, target, nil); body != "body" {
+			t.Errorf("Got %q instead of %q", body, "body")
+		}
+		refreshed(t, before+2)
+		if n := atomic.LoadInt32(&conditional); n != 1 {
+			t.Errorf("Origin was asked for %s with If-None-Match %d times instead of once", target, n)
+		}
+		// Past when the response first fetched expires, but not the one revalidated.
+		time.Sleep(600 * time.Millisecond)
+		u, _ := url.Parse(target)
+		if body, _, stale, err := c.GetStale(*u); err != nil || stale != 0 || body.String() != "body" {
+			t.Errorf("Got %q, stale for %v, instead of the revalidated response", body, stale)
+		}
+	})
+}
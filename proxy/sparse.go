@@ -0,0 +1,389 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.ugrad.cs.ubc.ca/CPSC416-2018W-T1/A2-i8b0b-e8y0b/cache"
+)
+
+// Errors parseRanges returns: errRangeSyntax if a Range header can't be
+// understood, so is to be ignored, and errRangeNotSatisfiable if none of its
+// ranges are in the resource.
+var (
+	errRangeSyntax         = errors.New("Malformed Range header")
+	errRangeNotSatisfiable = errors.New("None of the ranges are in the resource")
+)
+
+// parseRanges parses spec, the value of a Range header, into the ranges it asks
+// for of a resource size bytes long.  Ranges that run past the end are cut short,
+// and ones that start past it are left out.
+func parseRanges(spec string, size int64) (ranges []cache.Range, err error) {
+	if !strings.HasPrefix(spec, "bytes=") {
+		return nil, errRangeSyntax
+	}
+	for _, ra := range strings.Split(spec[len("bytes="):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, errRangeSyntax
+		}
+		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		if start == "" {
+			// A suffix: the last so many bytes.
+			n, err := strconv.ParseInt(end, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errRangeSyntax
+			}
+			if n > size {
+				n = size
+			}
+			if n > 0 {
+				ranges = append(ranges, cache.Range{Offset: size - n, Length: n})
+			}
+			continue
+		}
+		first, err := strconv.ParseInt(start, 10, 64)
+		if err != nil || first < 0 {
+			return nil, errRangeSyntax
+		}
+		last := size - 1
+		if end != "" {
+			if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < first {
+				return nil, errRangeSyntax
+			}
+			if last >= size {
+				last = size - 1
+			}
+		}
+		if first < size {
+			ranges = append(ranges, cache.Range{Offset: first, Length: last - first + 1})
+		}
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// contentRange returns the Content-Range header for the range r of a resource size bytes long.
+func contentRange(r cache.Range, size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Offset, r.Offset+r.Length-1, size)
+}
+
+// rangeSpec returns a Range header asking for ranges, in order, with any that
+// overlap or touch merged into one.
+func rangeSpec(ranges []cache.Range) string {
+	sorted := append([]cache.Range{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	var merged []cache.Range
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].Offset+merged[n-1].Length {
+			if end := r.Offset + r.Length; end > merged[n-1].Offset+merged[n-1].Length {
+				merged[n-1].Length = end - merged[n-1].Offset
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	specs := make([]string, len(merged))
+	for i, r := range merged {
+		specs[i] = fmt.Sprintf("%d-%d", r.Offset, r.Offset+r.Length-1)
+	}
+	return "bytes=" + strings.Join(specs, ",")
+}
+
+// mayStore reports whether a response from the origin with headers h may be cached:
+// unless its Cache-Control says no-store, or private, as the proxy is shared by
+// everyone using it.  In ModeRecord, everything is.
+func mayStore(h http.Header) bool {
+	if defaultProxy.mode == ModeRecord {
+		return true
+	}
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		switch strings.TrimSpace(strings.ToLower(directive)) {
+		case "no-store", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// fetchRange fetches the ranges spec (as in a Range header) of the resource at
+// resourceURL from the origin for clientRequest, if it still matches ifRange.  If the
+// origin sends back ranges of it, they are cached as parts of the resource; if it
+// sends back all of it, that is cached whole.
+func fetchRange(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request, resourceURL url.URL, spec, ifRange string) (response *http.Response, body []byte, err error) {
+	request, err := http.NewRequest("GET", resourceURL.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range clientRequest.Header {
+		request.Header.Set(name, value[0])
+	}
+	// Whatever the client has cached itself is none of the origin's business here.
+	request.Header.Del("If-None-Match")
+	request.Header.Del("If-Modified-Since")
+	request.Header.Del("If-Range")
+	request.Header.Set("Range", spec)
+	if ifRange != "" {
+		request.Header.Set("If-Range", ifRange)
+	}
+	response, err = client.Do(request)
+	recording(proxyWriter).waited(response)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if body, err = ioutil.ReadAll(response.Body); err != nil {
+		return nil, nil, err
+	}
+	if !mayStore(response.Header) {
+		return response, body, nil
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		saveToCache(resourceURL, bytes.NewBuffer(body), response.Header, response.StatusCode)
+	case http.StatusPartialContent:
+		cachePart(resourceURL, response, body)
+	}
+	return response, body, nil
+}
+
+// cachePart caches body, that of response, a 206 from the origin, as parts of the
+// resource at resourceURL: one, or one per range of a multipart/byteranges body.
+func cachePart(resourceURL url.URL, response *http.Response, body []byte) {
+	h := http.Header{}
+	for k, v := range response.Header {
+		if k != "Content-Range" && k != "Content-Length" {
+			h[k] = v
+		}
+	}
+	mediaType, params, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		savePart(resourceURL, h, response.Header.Get("Content-Range"), body)
+		return
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			fmt.Println("Couldn't read the ranges of", resourceURL.String(), err)
+			return
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			fmt.Println("Couldn't read the ranges of", resourceURL.String(), err)
+			return
+		}
+		// Each range says what the resource itself is.
+		h.Del("Content-Type")
+		if contentType := part.Header.Get("Content-Type"); contentType != "" {
+			h.Set("Content-Type", contentType)
+		}
+		savePart(resourceURL, h, part.Header.Get("Content-Range"), data)
+	}
+}
+
+// savePart caches data, the range of the resource at resourceURL with headers h
+// given by contentRange (as in a Content-Range header), as a part of it.  A range
+// of a resource of unknown size isn't cached.
+func savePart(resourceURL url.URL, h http.Header, contentRange string, data []byte) {
+	var first, last, size int64
+	if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%d", &first, &last, &size); err != nil || last-first+1 != int64(len(data)) {
+		fmt.Println("Not caching a partial response for", resourceURL.String())
+		return
+	}
+	if defaultProxy.mode != ModeRecord && staleAlready(h) {
+		return
+	}
+	// Recorded parts are pinned, like whole responses; see saveToCache.
+	err := defaultProxy.cache.SavePart(resourceURL, first, data, size, saveOptions(h, http.StatusOK))
+	if err != nil && defaultProxy.mode == ModeRecord {
+		fmt.Println("Couldn't record part of", resourceURL.String(), "so it won't be replayed:", err)
+	} else if err != nil {
+		fmt.Println("Couldn't cache part of", resourceURL.String(), err)
+	} else if defaultProxy.mode == ModeRecord {
+		defaultProxy.cache.Pin(resourceURL)
+	}
+}
+
+// relay sends back a response from the origin, with body, as it is.
+func relay(proxyWriter http.ResponseWriter, response *http.Response, body []byte) {
+	for k, v := range response.Header {
+		if k != "Content-Length" {
+			proxyWriter.Header().Set(k, v[0])
+		}
+	}
+	proxyWriter.WriteHeader(response.StatusCode)
+	proxyWriter.Write(body)
+}
+
+// servePart sends back parts, the ranges of a resource size bytes long with headers h,
+// as a 206: in a multipart/byteranges body if there are several.
+func servePart(proxyWriter http.ResponseWriter, h http.Header, size int64, ranges []cache.Range, parts [][]byte) {
+	for k, v := range h {
+		if k != "Content-Length" && k != "Content-Range" && k != "Transfer-Encoding" {
+			proxyWriter.Header().Set(k, v[0])
+		}
+	}
+	proxyWriter.Header().Set("Accept-Ranges", "bytes")
+	body := parts[0]
+	if len(ranges) == 1 {
+		proxyWriter.Header().Set("Content-Range", contentRange(ranges[0], size))
+	} else {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		for i, r := range ranges {
+			partHeader := textproto.MIMEHeader{"Content-Range": {contentRange(r, size)}}
+			if contentType := h.Get("Content-Type"); contentType != "" {
+				partHeader.Set("Content-Type", contentType)
+			}
+			part, err := w.CreatePart(partHeader)
+			if err != nil {
+				http.Error(proxyWriter, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			part.Write(parts[i])
+		}
+		w.Close()
+		proxyWriter.Header().Set("Content-Type", "multipart/byteranges; boundary="+w.Boundary())
+		body = buf.Bytes()
+	}
+	proxyWriter.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	proxyWriter.WriteHeader(http.StatusPartialContent)
+	proxyWriter.Write(body)
+}
+
+// serveSparse sends back the ranges clientRequest asked for of the resource at
+// resourceURL, which isn't cached whole.  Whatever of them is cached in parts is
+// served from the cache, and only what's missing is fetched from the origin, all
+// in one request, and cached in turn, so that a large resource is cached piece
+// by piece as it's asked for.  Until some of it is cached its size isn't known,
+// so a single range is passed on to the origin as it is; several, like a Range
+// header that can't be understood, are left to serveAndCache, which passes them
+// on too, and caches all of the resource if that's what the origin sends back.  Unless the proxy is in ModeNormal or ModeRecord, ranges that
+// aren't all cached are misses.
+func serveSparse(proxyWriter http.ResponseWriter, client *http.Client, clientRequest *http.Request, resourceURL url.URL) {
+	offline := defaultProxy.mode == ModeReplay || defaultProxy.mode == ModeOffline
+	spec := clientRequest.Header.Get("Range")
+
+	// fetchWhole fetches all of the resource, to cut the ranges out of.
+	fetchWhole := func() {
+		if offline {
+			serveMiss(proxyWriter, clientRequest)
+			return
+		}
+		serveShared(proxyWriter, client, clientRequest, resourceURL, nil)
+	}
+
+	_, h, size, _, err := defaultProxy.cache.GetPart(resourceURL, cache.Range{})
+	if err != nil {
+		if offline || strings.Contains(spec, ",") {
+			fetchWhole()
+			return
+		}
+		fmt.Println("None of the requested resource is in cache", hash(resourceURL.String()))
+		response, body, err := fetchRange(proxyWriter, client, clientRequest, resourceURL, spec, clientRequest.Header.Get("If-Range"))
+		if err != nil {
+			http.Error(proxyWriter, err.Error(), http.StatusInternalServerError)
+		} else if response.StatusCode == http.StatusOK {
+			serveRange(proxyWriter, clientRequest, response.Header, body)
+		} else {
+			relay(proxyWriter, response, body)
+		}
+		return
+	}
+
+	// The client wants all of it if what it has is of some other version.
+	if ifRange := clientRequest.Header.Get("If-Range"); ifRange != "" && ifRange != cache.StrongValidator(h) {
+		fetchWhole()
+		return
+	}
+	ranges, err := parseRanges(spec, size)
+	if err == errRangeNotSatisfiable {
+		proxyWriter.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		http.Error(proxyWriter, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	} else if err != nil {
+		fetchWhole()
+		return
+	}
+
+	parts := make([][]byte, len(ranges))
+	var gaps []cache.Range
+	for i, r := range ranges {
+		data, _, _, missing, err := defaultProxy.cache.GetPart(resourceURL, r)
+		if err != nil {
+			// Evicted, or expired, in the meantime.
+			fetchWhole()
+			return
+		}
+		parts[i], gaps = data, append(gaps, missing...)
+	}
+
+	fetched := len(gaps) > 0
+	if fetched {
+		if offline {
+			serveMiss(proxyWriter, clientRequest)
+			return
+		}
+		response, body, err := fetchRange(proxyWriter, client, clientRequest, resourceURL, rangeSpec(gaps), cache.StrongValidator(h))
+		if err != nil {
+			http.Error(proxyWriter, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch response.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			// It changed at the origin, which sent back all of it instead.
+			serveRange(proxyWriter, clientRequest, response.Header, body)
+			return
+		default:
+			relay(proxyWriter, response, body)
+			return
+		}
+	}
+	for i, r := range ranges {
+		if parts[i] != nil {
+			continue
+		}
+		data, _, _, missing, err := defaultProxy.cache.GetPart(resourceURL, r)
+		if err != nil || len(missing) > 0 {
+			// Evicted in the meantime, or the origin sent back something else.
+			fmt.Println("Couldn't put the requested ranges together from cache, fetching all of the resource", hash(resourceURL.String()))
+			fetchWhole()
+			return
+		}
+		parts[i] = data
+	}
+
+	if !fetched {
+		fmt.Println("Got the requested ranges from cache, serving content...")
+		recording(proxyWriter).served()
+	}
+	if defaultProxy.mode == ModeOffline {
+		h = warn(h, warningDisconnected)
+	}
+	servePart(proxyWriter, h, size, ranges, parts)
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Warnings added to responses served stale, or while offline, as in RFC 7234.
+const (
+	warningStale              = `110 - "Response is Stale"`
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+	warningDisconnected       = `112 - "Disconnected Operation"`
+)
+
+// staleResponse is a response in the cache that has expired, but hasn't been
+// purged yet, so can still be served if need be.  age is how long ago it expired.
+type staleResponse struct {
+	body   *bytes.Buffer
+	header http.Header
+	status int
+	age    time.Duration
+}
+
+// staleDirective returns the number of seconds given by the Cache-Control directive
+// name (such as stale-if-error) in h.  ok is false if h doesn't have it.
+func staleDirective(h http.Header, name string) (d time.Duration, ok bool) {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if strings.HasPrefix(directive, name+"=") {
+			if seconds, err := strconv.Atoi(directive[len(name)+1:]); err == nil {
+				return time.Duration(seconds) * time.Second, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// mustRevalidate reports whether the origin forbade serving a response with headers h
+// once it is stale.
+func mustRevalidate(h http.Header) bool {
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		switch strings.TrimSpace(strings.ToLower(directive)) {
+		case "must-revalidate", "proxy-revalidate", "no-cache":
+			return true
+		}
+	}
+	return false
+}
+
+// whileRevalidating reports whether stale can be served while it is fetched again
+// in the background: if the origin gave it a stale-while-revalidate window, and it's
+// still in it.
+func (stale *staleResponse) whileRevalidating() bool {
+	window, ok := staleDirective(stale.header, "stale-while-revalidate")
+	return ok && stale.age <= window && !mustRevalidate(stale.header)
+}
+
+// onError reports whether stale can be served in place of an error from the origin:
+// if it's still in the stale-if-error window the origin gave it or, if the origin
+// didn't, the proxy's own; see StaleIfErrorFor.  stale may be nil, if there's nothing to serve.
+func (stale *staleResponse) onError() bool {
+	if stale == nil || mustRevalidate(stale.header) {
+		return false
+	}
+	window, ok := staleDirective(stale.header, "stale-if-error")
+	if !ok {
+		window = defaultProxy.staleIfError
+	}
+	return stale.age <= window && window > 0
+}
+
+// warn returns h with warnings added to its Warning header, after any it already has.
+// h itself is left as it is.
+func warn(h http.Header, warnings ...string) http.Header {
+	warned := http.Header{}
+	for k, v := range h {
+		warned[k] = v
+	}
+	all := append(append([]string{}, h["Warning"]...), warnings...)
+	warned.Set("Warning", strings.Join(all, ", "))
+	return warned
+}
+
+// serveStale sends back stale, a response from the cache, with warnings added.
+func serveStale(proxyWriter http.ResponseWriter, clientRequest *http.Request, stale *staleResponse, warnings ...string) {
+	fmt.Println("Serving the resource from cache with warnings", warnings)
+	serveWithCache(proxyWriter, clientRequest, stale.status, warn(stale.header, warnings...), stale.body)
+}
+
+// revalidate fetches the resource at resourceURL, cached with headers h, from the origin
+// again in the background, and caches it if the origin gives it back, unless it is already
+// being fetched.  If h has validators, the fetch is conditional: if the origin says the
+// resource hasn't changed, the cached body is saved again with the origin's new headers.
+// Either way, the cache is told once it is over, so that a resource that couldn't be
+// fetched is refreshed ahead again the next time it is used.
+func revalidate(resourceURL url.URL, h http.Header) {
+	defaultProxy.Lock()
+	if defaultProxy.revalidating[resourceURL] {
+		defaultProxy.Unlock()
+		return
+	}
+	defaultProxy.revalidating[resourceURL] = true
+	defaultProxy.Unlock()
+
+	go func() {
+		defer func() {
+			defaultProxy.Lock()
+			delete(defaultProxy.revalidating, resourceURL)
+			defaultProxy.Unlock()
+			defaultProxy.cache.RefreshDone(resourceURL)
+		}()
+
+		fmt.Println("Revalidating", resourceURL.String(), "in the background")
+		request, err := http.NewRequest("GET", resourceURL.String(), nil)
+		if err != nil {
+			fmt.Println("Couldn't revalidate", resourceURL.String(), err)
+			return
+		}
+		if etag := h.Get("ETag"); etag != "" {
+			request.Header.Set("If-None-Match", etag)
+		}
+		if modified := h.Get("Last-Modified"); modified != "" {
+			request.Header.Set("If-Modified-Since", modified)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Println("Couldn't revalidate", resourceURL.String(), err)
+			return
+		}
+		defer response.Body.Close()
+		if response.StatusCode == http.StatusNotModified {
+			refreshCached(resourceURL, response.Header)
+			return
+		}
+		responseBodyData, err := ioutil.ReadAll(response.Body)
+		if err != nil || response.StatusCode >= http.StatusInternalServerError {
+			fmt.Println("Couldn't revalidate", resourceURL.String(), response.Status, err)
+			return
+		}
+		if !mayStore(response.Header) {
+			return
+		}
+		saveToCache(resourceURL, bytes.NewBuffer(responseBodyData), response.Header, response.StatusCode)
+	}()
+}
+
+// refreshCached saves the resource at resourceURL again with the headers it is
+// cached with, updated by the headers of a 304 Not Modified response, so that it
+// is fresh for as long as the origin now says.
+func refreshCached(resourceURL url.URL, notModified http.Header) {
+	cachedResponse, originalHeaders, status, _, err := defaultProxy.cache.GetResponse(resourceURL)
+	if err != nil {
+		// Gone in the meantime; it'll be fetched in full when it's next asked for.
+		return
+	}
+	h := http.Header{}
+	for k, v := range originalHeaders {
+		h[k] = v
+	}
+	for k, v := range notModified {
+		h[k] = v
+	}
+	fmt.Println("Not modified, refreshing", resourceURL.String(), "in the cache")
+	saveToCache(resourceURL, bytes.NewBuffer(cachedResponse.Bytes()), h, status)
+}
+
+// RefreshAhead fetches the resource at u, cached with headers h, from the origin again
+// in the background, conditionally if h has validators, so that it is fresh again before
+// it expires.  It's meant for cache.Config.OnRefreshAhead.  Unless the proxy is in
+// ModeNormal or ModeRecord, it does nothing, as the origin isn't to be contacted.
+func RefreshAhead(u url.URL, h http.Header) {
+	if defaultProxy.mode == ModeReplay || defaultProxy.mode == ModeOffline {
+		return
+	}
+	revalidate(u, h)
+}